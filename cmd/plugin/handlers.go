@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal"
+)
+
+// driver serves the Docker VolumeDriver API.
+type driver struct {
+	cfg        *internal.Config
+	meta       *internal.InstanceMetadata
+	ec2        internal.EC2API
+	host       internal.Host
+	operations *internal.OperationTracker
+	locks      *internal.VolumeLocks
+	devices    *internal.DeviceNames
+	fencer     *internal.Fencer
+	leases     *internal.Leases
+	mounts     *internal.MountRefs
+	index      *internal.TaskIndex
+	callers    *internal.CallerResolver
+}
+
+func (d *driver) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", d.health)
+	mux.HandleFunc("POST /Plugin.Activate", d.activate)
+	mux.HandleFunc("POST /VolumeDriver.Create", d.create)
+	mux.HandleFunc("POST /VolumeDriver.Mount", d.mount)
+	mux.HandleFunc("POST /VolumeDriver.Remove", d.remove)
+	mux.HandleFunc("POST /VolumeDriver.Capabilities", d.capabilities)
+	mux.HandleFunc("POST /VolumeDriver.Get", d.get)
+	mux.HandleFunc("POST /VolumeDriver.Unmount", d.unmount)
+	mux.HandleFunc("POST /VolumeDriver.Path", d.path)
+	mux.HandleFunc("POST /VolumeDriver.List", d.list)
+	return mux
+}
+
+// beginOperation waits for the turn of a state-changing operation on volume and registers it. The returned function
+// must be called once the operation is over.
+func (d *driver) beginOperation(ctx context.Context, kind, volume string) (context.Context, func(), error) {
+	unlock, err := d.locks.Lock(ctx, volume)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, done := d.operations.Begin(ctx, kind, volume)
+	return ctx, func() {
+		done()
+		unlock()
+	}, nil
+}
+
+func (d *driver) health(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok", Timestamp: time.Now().Format(time.RFC3339), Commit: CommitHash})
+}
+
+func (d *driver) activate(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, ActivateResponse{Implements: []string{"VolumeDriver"}})
+}
+
+func (d *driver) create(w http.ResponseWriter, r *http.Request) {
+	var req CreateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Create request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	ctx, done, err := d.beginOperation(ctx, "Create", req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+	defer done()
+
+	options, err := internal.ParseVolumeOptions(req.Opts)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+
+	vol, err := internal.DescribeVolume(ctx, d.ec2, req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: fmt.Sprintf("Failed to describe volume: %v", err)})
+		return
+	}
+
+	if *vol.AvailabilityZone != d.meta.AvailabilityZone {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: fmt.Sprintf("Volume %s is not in the same availability zone as the instance (%s)", req.Name, d.meta.AvailabilityZone)})
+		return
+	}
+
+	mountpoint := d.cfg.MountPath(req.Name)
+	if _, err := os.Stat(mountpoint); err == nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: "Volume already exists"})
+	} else if os.IsNotExist(err) {
+		if err := os.MkdirAll(mountpoint, 0755); err != nil {
+			writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		} else if err := internal.SaveVolumeOptions(d.cfg.StateDir, req.Name, options); err != nil {
+			writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		} else {
+			writeResponse(w, http.StatusOK, ErrorResponse{})
+		}
+	} else {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+	}
+}
+
+func (d *driver) mount(w http.ResponseWriter, r *http.Request) {
+	var req MountRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Mount request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, MountResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	// every phase shares the deadline, so that the answer, an error included, reaches Docker before it gives up
+	ctx, cancel := context.WithTimeout(ctx, internal.MountTimeout)
+	defer cancel()
+
+	ctx, done, err := d.beginOperation(ctx, "Mount", req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: err.Error()})
+		return
+	}
+	defer done()
+
+	vol, err := internal.DescribeVolume(ctx, d.ec2, req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to describe volume: %v", err)})
+		return
+	}
+
+	// an outdated answer is only acceptable while the volume is not about to be taken from another instance
+	attachedElsewhere := len(vol.Attachments) > 0 && aws.ToString(vol.Attachments[0].InstanceId) != d.meta.InstanceID
+	// the task mounting the volume is one of its users, it must not count as a conflicting one
+	callers, callersErr := d.callers.CallingTasks(ctx, req.Name)
+	if callersErr != nil {
+		slog.WarnContext(ctx, "Cannot tell which task is mounting the volume, it will count as a user", "error", callersErr)
+	}
+	checkVolRes, checkVolErr := d.index.CheckForTasksWithVolumeInUse(ctx, req.Name, callers, attachedElsewhere)
+	switch checkVolRes {
+	case internal.OK:
+		slog.InfoContext(ctx, "Volume is not in use by any ECS tasks")
+	case internal.ProcessingError:
+		writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Error checking volume usage: %v", checkVolErr)})
+		return
+	default:
+		message := checkVolErr.Error()
+		if callersErr != nil {
+			message += fmt.Sprintf(" (the task mounting it could not be identified: %v)", callersErr)
+		}
+		writeResponse(w, http.StatusOK, MountResponse{Err: message})
+		return
+	}
+
+	// the lease keeps plugins on other hosts from racing for the volume, it is held for as long as it is mounted
+	if err := d.leases.Acquire(ctx, req.Name); err != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: err.Error()})
+		return
+	}
+	mounted := false
+	defer func() {
+		if mounted {
+			return
+		}
+		// the lease still covers the containers the volume is already mounted for
+		if count, err := d.mounts.Count(req.Name); err != nil || count > 0 {
+			return
+		}
+		if err := d.leases.Release(context.WithoutCancel(ctx), req.Name); err != nil {
+			slog.WarnContext(ctx, "Failed to release the lease of a volume that was not mounted", "error", err)
+		}
+	}()
+
+	// a volume that is still being created or detached by someone else is waited for, but not forever
+	if vol.State == types.VolumeStateCreating || (len(vol.Attachments) > 0 && vol.Attachments[0].State == types.VolumeAttachmentStateDetaching) {
+		slog.InfoContext(ctx, "Volume is not available yet, waiting...", "state", vol.State)
+		vol, err = internal.WaitVolumeFor(ctx, d.cfg, d.ec2, req.Name, types.VolumeStateAvailable, d.cfg.Timeouts.Available)
+		if err != nil {
+			writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Volume did not become available: %v", err)})
+			return
+		}
+	}
+
+	// attach the volume using aws sdk
+	if vol.State == types.VolumeStateInUse && len(vol.Attachments) > 0 && vol.Attachments[0].InstanceId != nil && *vol.Attachments[0].InstanceId != d.meta.InstanceID {
+		holder := *vol.Attachments[0].InstanceId
+		options, err := internal.LoadVolumeOptions(d.cfg.StateDir, req.Name)
+		if err != nil {
+			writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to load volume options: %v", err)})
+			return
+		}
+		// the holder may still be writing to the volume, so it is only taken from an instance that is gone
+		decision := d.fencer.Check(ctx, vol, holder, options.ForceSteal)
+		if !decision.Allowed {
+			writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Volume %s is attached to %s, which may still be using it: %s", req.Name, holder, strings.Join(decision.Reasons, "; "))})
+			return
+		}
+
+		slog.InfoContext(ctx, "Volume is in-use by another instance, detaching...", "instance_id", holder)
+
+		// NOTE: This overrides the previous volume state check. The device name belongs to the holder, there is
+		// none of ours to release
+		vol, err = internal.DetachVolumeAndWait(ctx, d.cfg, d.ec2, nil, req.Name, holder)
+		if err != nil {
+			writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to detach volume: %v", err)})
+			return
+		}
+		slog.InfoContext(ctx, "Successfully detached volume")
+	}
+
+	if vol.State == types.VolumeStateAvailable {
+		slog.InfoContext(ctx, "Volume is available, attaching...")
+		vol, err = internal.AttachVolumeAndWait(ctx, d.cfg, d.ec2, d.host, d.devices, req.Name, d.meta.InstanceID)
+		if err != nil {
+			writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to attach volume: %v", err)})
+			return
+		}
+	} else if vol.State != types.VolumeStateInUse {
+		slog.WarnContext(ctx, "Volume is in an unhandled state", "state", vol.State)
+	}
+
+	mountErr := internal.Mount(ctx, d.cfg, d.host, req.Name, internal.AttachmentDevice(vol, d.meta.InstanceID))
+	if mountErr != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to mount volume: %v", mountErr)})
+		return
+	}
+
+	count, err := d.mounts.Add(req.Name, req.ID)
+	if err != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: fmt.Sprintf("Failed to record the mount: %v", err)})
+		return
+	}
+	slog.InfoContext(ctx, "Volume is mounted", "mounts", count)
+
+	mounted = true
+	writeResponse(w, http.StatusOK, MountResponse{MountPoint: d.cfg.MountPath(req.Name)})
+}
+
+func (d *driver) remove(w http.ResponseWriter, r *http.Request) {
+	var req NameRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Remove request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	ctx, done, err := d.beginOperation(ctx, "Remove", req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+	defer done()
+
+	slog.InfoContext(ctx, "Removing volume")
+
+	volumePath := d.cfg.MountPath(req.Name)
+
+	if err := os.RemoveAll(volumePath); err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+	} else if err := internal.RemoveVolumeOptions(d.cfg.StateDir, req.Name); err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+	} else {
+		writeResponse(w, http.StatusOK, ErrorResponse{})
+	}
+}
+
+func (d *driver) capabilities(w http.ResponseWriter, r *http.Request) {
+	var req struct{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Received Capabilities request")
+
+	writeResponse(w, http.StatusOK, CapabilitiesResponse{Capabilities: Capability{Scope: "local"}})
+}
+
+func (d *driver) get(w http.ResponseWriter, r *http.Request) {
+	var req NameRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Get request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, GetResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	mountpoint := d.cfg.MountPath(req.Name)
+	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
+		writeResponse(w, http.StatusOK, GetResponse{Err: "Volume not found"})
+	} else if err != nil {
+		writeResponse(w, http.StatusOK, GetResponse{Err: err.Error()})
+	} else {
+		writeResponse(w, http.StatusOK, GetResponse{Volume: &Volume{Name: req.Name, Mountpoint: mountpoint}})
+	}
+}
+
+func (d *driver) unmount(w http.ResponseWriter, r *http.Request) {
+	var req MountRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Unmount request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	ctx, done, err := d.beginOperation(ctx, "Unmount", req.Name)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+	defer done()
+
+	// the volume stays mounted and leased until the last container using it is gone
+	remaining, err := d.mounts.Remove(req.Name, req.ID)
+	if err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+	if remaining > 0 {
+		slog.InfoContext(ctx, "Volume is still used by other containers, leaving it mounted", "mounts", remaining)
+		writeResponse(w, http.StatusOK, ErrorResponse{})
+		return
+	}
+
+	if err := internal.Unmount(ctx, d.cfg, d.host, req.Name); err != nil {
+		writeResponse(w, http.StatusOK, ErrorResponse{Err: err.Error()})
+		return
+	}
+
+	if err := d.leases.Release(ctx, req.Name); err != nil {
+		slog.WarnContext(ctx, "Failed to release the volume lease, it will expire on its own", "error", err)
+	}
+
+	writeResponse(w, http.StatusOK, ErrorResponse{})
+}
+
+func (d *driver) path(w http.ResponseWriter, r *http.Request) {
+	var req NameRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	ctx := internal.WithVolume(r.Context(), req.Name)
+	slog.InfoContext(ctx, "Received Path request")
+
+	if req.Name == "" {
+		writeResponse(w, http.StatusOK, MountResponse{Err: "Name cannot be empty or null"})
+		return
+	}
+
+	mountpoint := d.cfg.MountPath(req.Name)
+	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
+		writeResponse(w, http.StatusOK, MountResponse{Err: "Volume not found"})
+	} else if err != nil {
+		writeResponse(w, http.StatusOK, MountResponse{Err: err.Error()})
+	} else {
+		writeResponse(w, http.StatusOK, MountResponse{MountPoint: mountpoint})
+	}
+}
+
+func (d *driver) list(w http.ResponseWriter, r *http.Request) {
+	var req struct{}
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Received List Volumes request")
+
+	names, err := internal.VolumeNames(d.cfg)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading mount root directory", "error", err)
+		writeResponse(w, http.StatusOK, ListResponse{Volumes: []Volume{}, Err: err.Error()})
+		return
+	}
+
+	response := ListResponse{Volumes: []Volume{}}
+	for _, name := range names {
+		response.Volumes = append(response.Volumes, Volume{Name: name, Mountpoint: d.cfg.MountPath(name)})
+	}
+	writeResponse(w, http.StatusOK, response)
+}
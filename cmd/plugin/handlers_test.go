@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+const (
+	testAZ       = "eu-west-1a"
+	testInstance = "i-0123456789abcdef0"
+)
+
+// newTestDriver returns a driver whose AWS clients call fake, with the instance it runs on already added. Its waits
+// are short enough for the delays of the fake, and it finds neither a Docker daemon nor an ECS agent.
+func newTestDriver(t *testing.T, fake *fakeaws.Server) *driver {
+	t.Helper()
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+
+	cfg := internal.DefaultConfig()
+	cfg.MountRoot = t.TempDir()
+	cfg.StateDir = t.TempDir()
+	cfg.VolumePollInterval = internal.Duration(10 * time.Millisecond)
+	cfg.Timeouts.Attach = internal.Duration(300 * time.Millisecond)
+	cfg.Timeouts.Detach = internal.Duration(2 * time.Second)
+	cfg.Timeouts.ForceDetachAfter = 0
+	cfg.ECS.DockerSocket = filepath.Join(t.TempDir(), "docker.sock")
+	cfg.ECS.AgentEndpoint = "http://127.0.0.1:1"
+
+	awsCfg := fakeaws.Config(server.URL)
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	ecsClient := ecs.NewFromConfig(awsCfg)
+	index := internal.NewTaskIndex(cfg, ecsClient, ec2Client, testAZ)
+	return &driver{
+		cfg:        cfg,
+		meta:       &internal.InstanceMetadata{Region: "eu-west-1", AvailabilityZone: testAZ, InstanceID: testInstance},
+		ec2:        ec2Client,
+		host:       internal.NewFakeHost(),
+		operations: internal.NewOperationTracker(),
+		locks:      internal.NewVolumeLocks(time.Duration(cfg.LockTimeout)),
+		devices:    internal.NewDeviceNames(cfg.Device.Pool),
+		fencer:     internal.NewFencer(cfg, ec2Client, index),
+		leases:     internal.NewLeases(internal.NewTagLeases(ec2Client, 0), testInstance, time.Minute),
+		mounts:     internal.NewMountRefs(cfg.StateDir),
+		index:      index,
+		callers:    internal.NewCallerResolver(cfg),
+	}
+}
+
+func call(t *testing.T, handler http.Handler, path string, body any) map[string]any {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload)))
+
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Errorf("%s returned invalid JSON %q: %v", path, rec.Body.String(), err)
+	}
+	return response
+}
+
+// TestConcurrentHandlers hammers the handlers with operations on a few volumes. Run with -race.
+func TestConcurrentHandlers(t *testing.T) {
+	d := newTestDriver(t, fakeaws.NewServer())
+	handler := d.routes()
+	volumes := []string{"vol-1", "vol-2", "vol-3"}
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		volume := volumes[i%len(volumes)]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				// Stands in for a Mount: the volume directory must survive until the operation is done
+				_, done, err := d.beginOperation(context.Background(), "Mount", volume)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer done()
+				mountpoint := d.cfg.MountPath(volume)
+				if err := os.MkdirAll(mountpoint, 0755); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+				if _, err := os.Stat(mountpoint); err != nil {
+					t.Errorf("%s was changed by another operation while mounting: %v", volume, err)
+				}
+			case 1:
+				if res := call(t, handler, "/VolumeDriver.Remove", map[string]string{"Name": volume}); res["Err"] != "" {
+					t.Errorf("Remove %s failed: %v", volume, res["Err"])
+				}
+			case 2:
+				call(t, handler, "/VolumeDriver.Get", map[string]string{"Name": volume})
+				call(t, handler, "/VolumeDriver.Path", map[string]string{"Name": volume})
+			case 3:
+				call(t, handler, "/VolumeDriver.List", map[string]string{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if pending := d.operations.Pending(); len(pending) != 0 {
+		t.Fatalf("operations left pending: %+v", pending)
+	}
+}
+
+func TestRemoveWaitsForRunningOperation(t *testing.T) {
+	d := newTestDriver(t, fakeaws.NewServer())
+	handler := d.routes()
+
+	mountpoint := d.cfg.MountPath("vol-1")
+	if err := os.MkdirAll(mountpoint, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, done, err := d.beginOperation(context.Background(), "Mount", "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := make(chan map[string]any)
+	go func() {
+		removed <- call(t, handler, "/VolumeDriver.Remove", map[string]string{"Name": "vol-1"})
+	}()
+
+	select {
+	case <-removed:
+		t.Fatal("Remove ran while another operation held the volume")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Operations on other volumes are not held up
+	if res := call(t, handler, "/VolumeDriver.Remove", map[string]string{"Name": "vol-2"}); res["Err"] != "" {
+		t.Fatalf("Remove of another volume failed: %v", res["Err"])
+	}
+
+	done()
+	if res := <-removed; res["Err"] != "" {
+		t.Fatalf("Remove failed: %v", res["Err"])
+	}
+	if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", mountpoint, err)
+	}
+}
+
+func TestOperationTimesOutWaitingForVolume(t *testing.T) {
+	d := newTestDriver(t, fakeaws.NewServer())
+	d.locks = internal.NewVolumeLocks(20 * time.Millisecond)
+
+	_, done, err := d.beginOperation(context.Background(), "Mount", "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	res := call(t, d.routes(), "/VolumeDriver.Remove", map[string]string{"Name": "vol-1"})
+	if res["Err"] == "" {
+		t.Fatal("expected Remove to time out while the volume is busy")
+	}
+	if got := fmt.Sprint(res["Err"]); !strings.Contains(got, "vol-1") {
+		t.Fatalf("expected the error to name the volume, got %q", got)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	handler := d.routes()
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-2", AvailabilityZone: "eu-west-1b"})
+
+	res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-1", "Opts": map[string]string{"force-steal": "true"}})
+	if res["Err"] != "" {
+		t.Fatalf("Create failed: %v", res["Err"])
+	}
+	if _, err := os.Stat(d.cfg.MountPath("vol-1")); err != nil {
+		t.Fatalf("expected the mountpoint to be created: %v", err)
+	}
+	if options, err := internal.LoadVolumeOptions(d.cfg.StateDir, "vol-1"); err != nil || !options.ForceSteal {
+		t.Fatalf("expected the options to be saved, got %+v, %v", options, err)
+	}
+
+	if res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-1"}); res["Err"] != "Volume already exists" {
+		t.Fatalf("expected a second Create to fail, got %v", res["Err"])
+	}
+	if res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-2"}); !strings.Contains(fmt.Sprint(res["Err"]), "not in the same availability zone") {
+		t.Fatalf("expected a volume of another availability zone to be refused, got %v", res["Err"])
+	}
+	if res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-missing"}); !strings.Contains(fmt.Sprint(res["Err"]), "InvalidVolume.NotFound") {
+		t.Fatalf("expected a missing volume to be refused, got %v", res["Err"])
+	}
+}
+
+func TestRemove(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	handler := d.routes()
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+
+	if res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-1", "Opts": map[string]string{"force-steal": "true"}}); res["Err"] != "" {
+		t.Fatalf("Create failed: %v", res["Err"])
+	}
+	if res := call(t, handler, "/VolumeDriver.Remove", map[string]string{"Name": "vol-1"}); res["Err"] != "" {
+		t.Fatalf("Remove failed: %v", res["Err"])
+	}
+	if _, err := os.Stat(d.cfg.MountPath("vol-1")); !os.IsNotExist(err) {
+		t.Fatalf("expected the mountpoint to be removed, got %v", err)
+	}
+	if options, err := internal.LoadVolumeOptions(d.cfg.StateDir, "vol-1"); err != nil || options.ForceSteal {
+		t.Fatalf("expected the options to be removed, got %+v, %v", options, err)
+	}
+	// Remove only forgets the volume, the EBS volume itself is left alone
+	if volume, ok := fake.Volume("vol-1"); !ok || volume.State != "available" {
+		t.Fatalf("expected the EBS volume to be untouched, got %+v", volume)
+	}
+}
+
+func TestMountRefusesVolumeInUseByTask(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	fake.AddCluster("apps", nil)
+	fake.AddInstance(fakeaws.Instance{ID: "i-other", AvailabilityZone: testAZ})
+	ciArn := fake.AddContainerInstance("apps", fakeaws.ContainerInstance{EC2InstanceID: "i-other", Status: "ACTIVE", AgentConnected: true})
+	taskDef := fake.AddTaskDefinition(fakeaws.TaskDefinition{Family: "db", Volumes: []fakeaws.Volume{{Name: "vol-1", Driver: "polarity-ecs-ebs-plugin"}}})
+	fake.AddTask("apps", fakeaws.Task{TaskDefinitionArn: taskDef, LastStatus: "RUNNING", ContainerInstanceArn: ciArn})
+
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "is in use by task") {
+		t.Fatalf("expected the volume to be refused as in use, got %v", res["Err"])
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 0 {
+		t.Fatalf("expected no attach, got %d", calls)
+	}
+}
+
+// mountID returns a mount ID like the ones Docker sends with Mount and Unmount: random, naming no container.
+func mountID(t *testing.T) string {
+	t.Helper()
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// serveDocker lists the containers being created on the Docker socket of d: for each volume in tasks, one container
+// carrying the task ARN label.
+func serveDocker(t *testing.T, d *driver, tasks map[string]string) {
+	t.Helper()
+	// Unix socket paths are limited to around a hundred bytes, shorter than some temporary directories
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d.cfg.ECS.DockerSocket = filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", d.cfg.ECS.DockerSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if r.URL.Path != "/containers/json" || json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters) != nil || len(filters["volume"]) != 1 {
+			http.Error(w, `{"message":"page not found"}`, http.StatusNotFound)
+			return
+		}
+		containers := []map[string]any{}
+		if arn, ok := tasks[filters["volume"][0]]; ok {
+			containers = append(containers, map[string]any{"Id": mountID(t), "State": "created", "Labels": map[string]string{"com.amazonaws.ecs.task-arn": arn}})
+		}
+		json.NewEncoder(w).Encode(containers)
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	d.callers = internal.NewCallerResolver(d.cfg)
+}
+
+func TestMountLeavesOutOnlyTheCallingTask(t *testing.T) {
+	tests := []struct {
+		name string
+		// docker is set when the Docker socket answers
+		docker bool
+		// starting also uses the volume, it is starting on this instance like the calling task
+		starting bool
+		wantErr  string
+	}{
+		{name: "calling task", docker: true, wantErr: "Failed to attach volume"},
+		{name: "another starting task", docker: true, starting: true, wantErr: "is in use by task"},
+		{name: "agent, one starting task", wantErr: "Failed to attach volume"},
+		{name: "agent, several starting tasks", starting: true, wantErr: "could not be identified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeaws.NewServer()
+			d := newTestDriver(t, fake)
+			fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+			fake.AddCluster("apps", nil)
+			ciArn := fake.AddContainerInstance("apps", fakeaws.ContainerInstance{EC2InstanceID: testInstance, Status: "ACTIVE", AgentConnected: true})
+			taskDef := fake.AddTaskDefinition(fakeaws.TaskDefinition{Family: "db", Volumes: []fakeaws.Volume{{Name: "vol-1", Driver: "polarity-ecs-ebs-plugin"}}})
+			caller := fake.AddTask("apps", fakeaws.Task{TaskDefinitionArn: taskDef, LastStatus: "PENDING", ContainerInstanceArn: ciArn})
+			agentTasks := []map[string]string{{"Arn": caller, "DesiredStatus": "RUNNING", "KnownStatus": "PENDING"}}
+			if tt.starting {
+				other := fake.AddTask("apps", fakeaws.Task{TaskDefinitionArn: taskDef, LastStatus: "PENDING", ContainerInstanceArn: ciArn})
+				agentTasks = append(agentTasks, map[string]string{"Arn": other, "DesiredStatus": "RUNNING", "KnownStatus": "PENDING"})
+			}
+			if tt.docker {
+				serveDocker(t, d, map[string]string{"vol-1": caller})
+			}
+
+			// The agent is only asked when Docker cannot be
+			var agentCalls atomic.Int32
+			agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				agentCalls.Add(1)
+				json.NewEncoder(w).Encode(map[string]any{"Tasks": agentTasks})
+			}))
+			t.Cleanup(agent.Close)
+			d.cfg.ECS.AgentEndpoint = agent.URL
+
+			res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1", "ID": mountID(t)})
+			if !strings.Contains(fmt.Sprint(res["Err"]), tt.wantErr) {
+				t.Fatalf("expected an error with %q, got %v", tt.wantErr, res["Err"])
+			}
+			if calls := agentCalls.Load(); (calls != 0) == tt.docker {
+				t.Fatalf("expected the ECS agent to be asked only without Docker, got %d calls", calls)
+			}
+		})
+	}
+}
+
+func TestMountRefusesVolumeOfReachableHolder(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	fake.AddInstance(fakeaws.Instance{ID: "i-holder", AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: "i-holder", Device: "/dev/sdf"}}})
+
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "may still be using it") {
+		t.Fatalf("expected the holder to be fenced, got %v", res["Err"])
+	}
+	if calls := fake.Calls("DetachVolume"); calls != 0 {
+		t.Fatalf("expected no detach, got %d", calls)
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease to be released, got tags %v", volume.Tags)
+	}
+}
+
+func TestMountRefusesVolumeLeasedElsewhere(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, Tags: map[string]string{
+		"polarity-ecs-ebs:lease-owner":   "i-other",
+		"polarity-ecs-ebs:lease-expires": time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano),
+	}})
+
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "i-other") {
+		t.Fatalf("expected the lease of i-other to be reported, got %v", res["Err"])
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 0 {
+		t.Fatalf("expected no attach, got %d", calls)
+	}
+}
+
+func TestMountTakesVolumeFromStoppedHolder(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AttachDelay = 20 * time.Millisecond
+	fake.DetachDelay = 20 * time.Millisecond
+	d := newTestDriver(t, fake)
+	fake.AddInstance(fakeaws.Instance{ID: "i-holder", AvailabilityZone: testAZ, State: "stopped"})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: "i-holder", Device: "/dev/sdf"}}})
+
+	// The volume is only attached in the fake, so its block device never shows up and the attachment is rolled back
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "rolled back") {
+		t.Fatalf("expected the attachment to be rolled back, got %v", res["Err"])
+	}
+
+	if calls := fake.Calls("AttachVolume"); calls != 1 {
+		t.Fatalf("expected a single attach, got %d", calls)
+	}
+	// One detach from the holder, one rolling back the attachment
+	if calls := fake.Calls("DetachVolume"); calls != 2 {
+		t.Fatalf("expected two detaches, got %d", calls)
+	}
+	volume, _ := fake.Volume("vol-1")
+	if volume.State != "available" || len(volume.Tags) != 0 {
+		t.Fatalf("expected the volume to be left available and unleased, got %+v", volume)
+	}
+}
+
+func TestMountTakesVolumeFromFencedHolder(t *testing.T) {
+	tests := []struct {
+		name       string
+		holder     fakeaws.Instance
+		forceSteal bool
+	}{
+		{name: "impaired past the grace period", holder: fakeaws.Instance{ID: "i-holder", AvailabilityZone: testAZ, ImpairedSince: time.Now().Add(-time.Hour)}},
+		{name: "force-steal", holder: fakeaws.Instance{ID: "i-holder", AvailabilityZone: testAZ}, forceSteal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeaws.NewServer()
+			fake.DetachDelay = 20 * time.Millisecond
+			d := newTestDriver(t, fake)
+			fake.AddInstance(tt.holder)
+			fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: "i-holder", Device: "/dev/sdf"}}})
+			if tt.forceSteal {
+				if res := call(t, d.routes(), "/VolumeDriver.Create", map[string]any{"Name": "vol-1", "Opts": map[string]string{"force-steal": "true"}}); res["Err"] != "" {
+					t.Fatalf("failed to create the volume: %v", res["Err"])
+				}
+			}
+
+			res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+			if strings.Contains(fmt.Sprint(res["Err"]), "may still be using it") {
+				t.Fatalf("expected the volume to be taken from the holder, got %v", res["Err"])
+			}
+			if calls := fake.Calls("DetachVolume"); calls < 1 {
+				t.Fatal("expected the volume to be detached from the holder")
+			}
+			if calls := fake.Calls("AttachVolume"); calls != 1 {
+				t.Fatalf("expected the volume to be attached here, got %d attaches", calls)
+			}
+		})
+	}
+}
+
+func TestMountWaitsForCreatingVolume(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.CreateDelay = 50 * time.Millisecond
+	d := newTestDriver(t, fake)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, State: "creating"})
+
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "Failed to attach volume") {
+		t.Fatalf("expected Mount to wait for the volume and attach it, got %v", res["Err"])
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 1 {
+		t.Fatalf("expected the volume to be attached once available, got %d attaches", calls)
+	}
+}
+
+func TestMountAndUnmount(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AttachDelay = 20 * time.Millisecond
+	d := newTestDriver(t, fake)
+	handler := d.routes()
+	host := d.host.(*internal.FakeHost)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	device := host.AddEBSDevice("vol-1", "")
+
+	if res := call(t, handler, "/VolumeDriver.Create", map[string]any{"Name": "vol-1"}); res["Err"] != "" {
+		t.Fatalf("Create failed: %v", res["Err"])
+	}
+	res := call(t, handler, "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if res["Err"] != "" || res["Mountpoint"] != d.cfg.MountPath("vol-1") {
+		t.Fatalf("Mount failed: %v", res)
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Attachments) != 1 || volume.Attachments[0].InstanceID != testInstance || volume.Tags["polarity-ecs-ebs:lease-owner"] != testInstance {
+		t.Fatalf("expected the volume to be attached and leased here, got %+v", volume)
+	}
+	if host.Mounts()[d.cfg.MountPath("vol-1")] != device {
+		t.Fatalf("expected %s to be mounted, got %v", device, host.Mounts())
+	}
+
+	if res := call(t, handler, "/VolumeDriver.Unmount", map[string]string{"Name": "vol-1"}); res["Err"] != "" {
+		t.Fatalf("Unmount failed: %v", res["Err"])
+	}
+	if len(host.Mounts()) != 0 {
+		t.Fatalf("expected nothing to be mounted, got %v", host.Mounts())
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease to be released, got tags %v", volume.Tags)
+	}
+
+	// The volume stays attached, mounting it again neither attaches nor formats it
+	if res := call(t, handler, "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"}); res["Err"] != "" {
+		t.Fatalf("second Mount failed: %v", res["Err"])
+	}
+	if attaches, formats := fake.Calls("AttachVolume"), host.Calls("Format"); attaches != 1 || formats != 1 {
+		t.Fatalf("expected one attach and one format, got %d and %d", attaches, formats)
+	}
+}
+
+func TestUnmountKeepsVolumeForOtherContainers(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AttachDelay = 20 * time.Millisecond
+	d := newTestDriver(t, fake)
+	handler := d.routes()
+	host := d.host.(*internal.FakeHost)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	host.AddEBSDevice("vol-1", "")
+
+	first, second := mountID(t), mountID(t)
+	for _, id := range []string{first, second} {
+		if res := call(t, handler, "/VolumeDriver.Mount", map[string]string{"Name": "vol-1", "ID": id}); res["Err"] != "" {
+			t.Fatalf("Mount %s failed: %v", id, res["Err"])
+		}
+	}
+
+	if res := call(t, handler, "/VolumeDriver.Unmount", map[string]string{"Name": "vol-1", "ID": first}); res["Err"] != "" {
+		t.Fatalf("Unmount failed: %v", res["Err"])
+	}
+	if _, ok := host.Mounts()[d.cfg.MountPath("vol-1")]; !ok {
+		t.Fatalf("expected the volume to stay mounted for the second container, got %v", host.Mounts())
+	}
+	if volume, _ := fake.Volume("vol-1"); volume.Tags["polarity-ecs-ebs:lease-owner"] != testInstance {
+		t.Fatalf("expected the lease to be kept for the second container, got tags %v", volume.Tags)
+	}
+
+	// A Mount failing for another container leaves the lease of the mounted volume alone
+	host.Fail("Filesystem", errors.New("blkid failed"))
+	if res := call(t, handler, "/VolumeDriver.Mount", map[string]string{"Name": "vol-1", "ID": mountID(t)}); !strings.Contains(fmt.Sprint(res["Err"]), "blkid failed") {
+		t.Fatalf("expected Mount to fail, got %v", res["Err"])
+	}
+	host.ClearFailures()
+	if volume, _ := fake.Volume("vol-1"); volume.Tags["polarity-ecs-ebs:lease-owner"] != testInstance {
+		t.Fatalf("expected the lease to be kept for the second container, got tags %v", volume.Tags)
+	}
+
+	if res := call(t, handler, "/VolumeDriver.Unmount", map[string]string{"Name": "vol-1", "ID": second}); res["Err"] != "" {
+		t.Fatalf("Unmount failed: %v", res["Err"])
+	}
+	if len(host.Mounts()) != 0 {
+		t.Fatalf("expected nothing to be mounted, got %v", host.Mounts())
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease to be released, got tags %v", volume.Tags)
+	}
+}
+
+func TestMountFailsWhenDeviceCannotBeMounted(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	host := d.host.(*internal.FakeHost)
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	host.AddEBSDevice("vol-1", "")
+	host.Fail("Mount", errors.New("wrong fs type"))
+
+	res := call(t, d.routes(), "/VolumeDriver.Mount", map[string]string{"Name": "vol-1"})
+	if !strings.Contains(fmt.Sprint(res["Err"]), "wrong fs type") {
+		t.Fatalf("expected the mount error to be reported, got %v", res["Err"])
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease of a volume that was not mounted to be released, got tags %v", volume.Tags)
+	}
+}
@@ -1,434 +1,159 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
+	"errors"
 	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal"
 )
 
-type ErrorResponse struct {
-	Err string `json:"Err,omitempty"`
-}
+var CommitHash string = "unknown"
 
-type MountResponse struct {
-	Err        string `json:"Err,omitempty"`
-	MountPoint string `json:"Mountpoint"`
+// fatal logs err and exits, like log.Fatalf does for the standard logger.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
-var Debug string = "false"
-var CommitHash string = "unknown"
-
 func main() {
-	if Debug == "true" {
-		logFile, err := os.OpenFile("/logging/polarity-ecs-ebs.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-		if err != nil {
-			log.Fatalf("Failed to open log file: %v", err)
-		}
-		defer logFile.Close()
-
-		multiWriter := io.MultiWriter(os.Stdout, logFile)
-
-		log.SetOutput(multiWriter)
-	} else {
-		log.SetOutput(os.Stdout)
+	cfg, err := internal.LoadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	log.Println("Starting Polarity EBS Plugin (debug=" + Debug + ", commit=" + CommitHash + ")...")
 
-	sockPath := os.Getenv("SOCK_PATH")
-	if sockPath == "" {
-		sockPath = "/run/docker/plugins/pl-ebs.sock"
+	logCloser, err := internal.InitLogging(cfg.Log)
+	if err != nil {
+		log.Fatalf("Failed to initialize logging: %v", err)
 	}
+	defer logCloser.Close()
 
-	log.Println("Sock path is " + sockPath)
+	slog.Info("Starting Polarity EBS Plugin...", "commit", CommitHash)
+	slog.Info("Effective configuration", "config", cfg)
 
-	mux := http.NewServeMux()
+	sockPath := cfg.SockPath
 
-	listener, err := net.Listen("unix", sockPath)
+	shutdownTracing, err := internal.InitTracing(context.Background(), cfg, CommitHash)
 	if err != nil {
-		log.Fatalf("Failed to listen on socket: %v", err)
+		fatal("Failed to initialize tracing", err)
 	}
-	defer listener.Close()
+	defer shutdownTracing(context.Background())
 
-	log.Println("Retrieving instance metadata...")
-	meta, err := internal.GetInstanceMetadata()
+	listener, err := internal.ListenSocket(sockPath)
 	if err != nil {
-		log.Fatalf("Failed to get instance metadata: %v", err)
+		fatal("Failed to listen on socket", err)
 	}
 
-	log.Printf("Instance Metadata: Region=%s, AvailabilityZone=%s, InstanceID=%s", meta.Region, meta.AvailabilityZone, meta.InstanceID)
-
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{ "status": "ok", "timestamp": "` + time.Now().Format(time.RFC3339) + `", "commit": "` + CommitHash + `" }`))
-	})
-
-	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`{"Implements": ["VolumeDriver"]}`))
-	})
-
-	mux.HandleFunc("/VolumeDriver.Create", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		json.NewDecoder(r.Body).Decode(&req)
-
-		log.Printf("Received Create Request: %+v", req)
-
-		if req.Name == "" {
-			response := ErrorResponse{Err: "Name cannot be empty or null"}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		client, err := internal.InitClient(r.Context(), meta.Region)
-		if err != nil {
-			response := ErrorResponse{Err: fmt.Sprintf("Failed to initialize EC2 client: %v", err)}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		vol, err := internal.DescribeVolume(r.Context(), client, req.Name)
-		if err != nil {
-			response := ErrorResponse{Err: fmt.Sprintf("Failed to describe volume: %v", err)}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		if *vol.AvailabilityZone != meta.AvailabilityZone {
-			response := ErrorResponse{Err: fmt.Sprintf("Volume %s is not in the same availability zone as the instance (%s)", req.Name, meta.AvailabilityZone)}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		mountpoint := filepath.Join("/mnt", req.Name)
-		if _, err := os.Stat(mountpoint); err == nil {
-			response := ErrorResponse{Err: "Volume already exists"}
-			json.NewEncoder(w).Encode(response)
-		} else if os.IsNotExist(err) {
-			if err := os.MkdirAll(mountpoint, 0755); err != nil {
-				response := ErrorResponse{Err: err.Error()}
-				json.NewEncoder(w).Encode(response)
-			} else {
-				response := ErrorResponse{Err: ""}
-				json.NewEncoder(w).Encode(response)
-			}
-		} else {
-			response := ErrorResponse{Err: err.Error()}
-			json.NewEncoder(w).Encode(response)
-		}
-
-	})
-
-	mux.HandleFunc("/VolumeDriver.Mount", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		json.NewDecoder(r.Body).Decode(&req)
-
-		log.Printf("Received Mount Request: %+v", req)
-
-		if req.Name == "" {
-			response := MountResponse{Err: "Name cannot be empty or null", MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		client, err := internal.InitClient(r.Context(), meta.Region)
-		if err != nil {
-			response := MountResponse{Err: fmt.Sprintf("Failed to initialize EC2 client: %v", err), MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		vol, err := internal.DescribeVolume(r.Context(), client, req.Name)
-		if err != nil {
-			response := MountResponse{Err: fmt.Sprintf("Failed to describe volume: %v", err), MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		checkVolRes, checkVolErr := internal.CheckForTasksWithVolumeInUse(req.Name, meta.Region, meta.AvailabilityZone)
-		switch checkVolRes {
-		case internal.OK:
-			log.Printf("Volume %s is not in use by any ECS tasks", req.Name)
-		case internal.ProcessingError:
-			response := MountResponse{Err: fmt.Sprintf("Error checking volume usage: %v", checkVolErr), MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		default:
-			response := MountResponse{Err: fmt.Sprintf("Volume %s is in use by ECS tasks", req.Name), MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		// attach the volume using aws sdk
-		if vol.State == types.VolumeStateInUse && vol.Attachments[0].InstanceId != nil && *vol.Attachments[0].InstanceId != meta.InstanceID {
-			log.Printf("Volume %s is in-use by another instance (%s), detaching...", req.Name, *vol.Attachments[0].InstanceId)
-
-			_, err := internal.DetachVolume(r.Context(), client, req.Name, *vol.Attachments[0].InstanceId)
-			if err != nil {
-				response := MountResponse{Err: fmt.Sprintf("Failed to detach volume: %v", err), MountPoint: ""}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-
-			log.Printf("Successfully detached volume %s, waiting to be available", req.Name)
-			// NOTE: This overrides the previous volume state check
-			vol, err = internal.WaitVolume(r.Context(), client, req.Name, types.VolumeStateAvailable)
-			if err != nil {
-				response := MountResponse{Err: fmt.Sprintf("Failed to wait for volume to be available: %v", err), MountPoint: ""}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-		}
-
-		if vol.State == types.VolumeStateAvailable {
-			log.Printf("Volume %s is available, attaching...", req.Name)
-			attachRes, err := internal.AttachVolume(r.Context(), client, req.Name, meta.InstanceID)
-			if err != nil {
-				response := MountResponse{Err: fmt.Sprintf("Failed to attach volume: %v", err), MountPoint: ""}
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			log.Printf("Successfully attached volume %s: %v, waiting to be in-use state", req.Name, attachRes)
-
-			internal.WaitVolume(r.Context(), client, req.Name, types.VolumeStateInUse)
-		} else if vol.State != types.VolumeStateInUse {
-			log.Printf("Volume %s is in an unhandled state: %s", req.Name, vol.State)
-		}
-
-		mountErr := internal.Mount(req.Name)
-		if mountErr != nil {
-			response := MountResponse{Err: fmt.Sprintf("Failed to mount volume: %v", mountErr), MountPoint: ""}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		response := MountResponse{Err: "", MountPoint: filepath.Join("/mnt", req.Name)}
-		json.NewEncoder(w).Encode(response)
-	})
-
-	mux.HandleFunc("/VolumeDriver.Remove", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, fmt.Sprintf(`{"Err": "Invalid JSON: %s"}`, err), http.StatusBadRequest)
-			return
-		}
-
-		log.Printf("Received Remove Request: %+v", req)
-
-		if req.Name == "" {
-			response := map[string]string{
-				"Err": "Name cannot be empty or null",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		log.Println("Removing volume " + req.Name)
-
-		volumePath := filepath.Join("/mnt", req.Name)
-
-		if err := os.RemoveAll(volumePath); err != nil {
-			response := map[string]string{
-				"Err": err.Error(),
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			response := map[string]string{
-				"Err": "",
-			}
-			json.NewEncoder(w).Encode(response)
-		}
-	})
-
-	mux.HandleFunc("/VolumeDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
-		var req map[string]interface{}
-		json.NewDecoder(r.Body).Decode(&req)
-
-		log.Printf("Received Capabilities Request: %+v", req)
-
-		response := map[string]interface{}{
-			"Capabilities": map[string]string{
-				"Scope": "local",
-			},
-		}
-		json.NewEncoder(w).Encode(response)
-	})
+	slog.Info("Retrieving instance metadata...")
+	meta, err := internal.GetInstanceMetadata(context.Background(), cfg)
+	if err != nil {
+		fatal("Failed to get instance metadata", err)
+	}
 
-	mux.HandleFunc("/VolumeDriver.Get", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, fmt.Sprintf(`{"Err": "Invalid JSON: %s"}`, err), http.StatusBadRequest)
-			return
-		}
+	slog.Info("Instance metadata", "region", meta.Region, "availability_zone", meta.AvailabilityZone, "instance_id", meta.InstanceID)
 
-		log.Printf("Received Get Request: %+v", req)
+	// One configuration and one client per service for the whole plugin, so that credentials are refreshed and
+	// throttling is handled in one place
+	awsCfg, err := internal.LoadAWSConfig(context.Background(), cfg.AWS, meta.Region, CommitHash)
+	if err != nil {
+		fatal("Failed to load AWS configuration", err)
+	}
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	ecsClient := ecs.NewFromConfig(awsCfg)
 
-		if req.Name == "" {
-			response := map[string]interface{}{
-				"Volume": map[string]interface{}{},
-				"Err":    "Name cannot be empty or null",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	leaseBackend, err := internal.NewLeaseBackend(cfg, awsCfg, ec2Client)
+	if err != nil {
+		fatal("Failed to set up volume leases", err)
+	}
 
-		mountpoint := filepath.Join("/mnt", req.Name)
-		if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
-			response := map[string]interface{}{
-				"Volume": map[string]interface{}{},
-				"Err":    "Volume not found",
-			}
-			json.NewEncoder(w).Encode(response)
-		} else if err != nil {
-			response := map[string]interface{}{
-				"Volume": map[string]interface{}{},
-				"Err":    err.Error(),
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			response := map[string]interface{}{
-				"Volume": map[string]interface{}{
-					"Name":       req.Name,
-					"Mountpoint": mountpoint,
-					"Status":     map[string]interface{}{},
-				},
-				"Err": "",
-			}
-			json.NewEncoder(w).Encode(response)
-		}
-	})
+	index := internal.NewTaskIndex(cfg, ecsClient, ec2Client, meta.AvailabilityZone)
+	indexCtx, stopIndex := context.WithCancel(context.Background())
+	go index.Run(indexCtx)
+
+	d := &driver{
+		cfg:        cfg,
+		meta:       meta,
+		ec2:        ec2Client,
+		host:       internal.NewRealHost(cfg),
+		operations: internal.NewOperationTracker(),
+		locks:      internal.NewVolumeLocks(time.Duration(cfg.LockTimeout)),
+		devices:    internal.NewDeviceNames(cfg.Device.Pool),
+		fencer:     internal.NewFencer(cfg, ec2Client, index),
+		leases:     internal.NewLeases(leaseBackend, meta.InstanceID, time.Duration(cfg.Lease.TTL)),
+		mounts:     internal.NewMountRefs(cfg.StateDir),
+		index:      index,
+		callers:    internal.NewCallerResolver(cfg),
+	}
 
-	mux.HandleFunc("/VolumeDriver.Unmount", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, fmt.Sprintf(`{"Err": "Invalid JSON: %s"}`, err), http.StatusBadRequest)
-			return
+	// Operations cut short by the previous shutdown are cleaned up before any new request comes in
+	unfinished, err := internal.LoadUnfinishedOperations(cfg.StateDir)
+	if err != nil {
+		fatal("Failed to load unfinished operations", err)
+	}
+	for _, op := range unfinished {
+		slog.Warn("Operation was interrupted by the previous shutdown, reconciling the volume", "operation", op.Kind, "volume", op.Volume, "phase", op.Phase, "started_at", op.StartedAt)
+		if err := internal.ReconcileOperation(context.Background(), cfg, d.ec2, d.host, d.devices, meta.InstanceID, op); err != nil {
+			slog.Error("Failed to reconcile the volume, it may need to be checked", "operation", op.Kind, "volume", op.Volume, "error", err)
 		}
+	}
 
-		log.Printf("Received Unmount Request: %+v", req)
-
-		if req.Name == "" {
-			response := map[string]string{
-				"Err": "Name cannot be empty or null",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	if err := d.leases.Reacquire(context.Background(), cfg, d.mounts); err != nil {
+		slog.Error("Failed to take back the leases of the mounted volumes, other hosts may take them over", "error", err)
+	}
 
-		cmd := exec.Command("umount", filepath.Join("/mnt", req.Name))
-		if err := cmd.Run(); err != nil {
-			response := map[string]string{
-				"Err": err.Error(),
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	server := &http.Server{Handler: internal.TraceHandler(internal.LogHandler(d.routes()))}
 
-		response := map[string]string{
-			"Err": "",
-		}
-		json.NewEncoder(w).Encode(response)
-	})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	mux.HandleFunc("/VolumeDriver.Path", func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, fmt.Sprintf(`{"Err": "Invalid JSON: %s"}`, err), http.StatusBadRequest)
-			return
-		}
+	// Serve only returns on a failure here, the shutdown below happens in either case
+	serveErrors := make(chan error, 1)
+	go func() {
+		slog.Info("Plugin HTTP SOCK server is starting on " + sockPath)
+		serveErrors <- server.Serve(listener)
+	}()
 
-		log.Printf("Received Path Request: %+v", req)
+	var serveErr error
+	select {
+	case sig := <-signals:
+		slog.Info("Shutting down, waiting for running operations to finish...", "signal", sig.String(), "timeout", time.Duration(cfg.ShutdownTimeout).String())
+	case serveErr = <-serveErrors:
+		slog.Error("Failed to serve plugin API, shutting down...", "error", serveErr, "timeout", time.Duration(cfg.ShutdownTimeout).String())
+	}
 
-		if req.Name == "" {
-			response := map[string]string{
-				"Mountpoint": "",
-				"Err":        "Name cannot be empty or null",
-			}
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
 
-		mountpoint := filepath.Join("/mnt", req.Name)
-		if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
-			response := map[string]string{
-				"Mountpoint": "",
-				"Err":        "Volume not found",
-			}
-			json.NewEncoder(w).Encode(response)
-		} else if err != nil {
-			response := map[string]string{
-				"Mountpoint": "",
-				"Err":        err.Error(),
-			}
-			json.NewEncoder(w).Encode(response)
-		} else {
-			response := map[string]string{
-				"Mountpoint": mountpoint,
-				"Err":        "",
-			}
-			json.NewEncoder(w).Encode(response)
+	// Shutdown closes the listener first, so no new request is accepted while the running ones drain
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		pending := d.operations.Pending()
+		slog.Error("Running operations did not finish in time", "error", err, "operations", pending)
+		if err := internal.SaveUnfinishedOperations(cfg.StateDir, pending); err != nil {
+			slog.Error("Failed to record unfinished operations", "error", err)
 		}
-	})
-
-	mux.HandleFunc("/VolumeDriver.List", func(w http.ResponseWriter, r *http.Request) {
-		var req map[string]interface{}
-		json.NewDecoder(r.Body).Decode(&req)
-
-		log.Printf("Received List Volumes Request: %+v", req)
-
-		// os read /mnt dir
-		files, err := os.ReadDir("/mnt")
-		if err != nil {
-			log.Printf("Error reading /mnt directory: %v", err)
-
-			response := map[string]interface{}{
-				"Volumes": []string{},
-				"Err":     err.Error(),
-			}
-
-			json.NewEncoder(w).Encode(response)
-		} else {
-			response := map[string]interface{}{
-				"Volumes": []map[string]string{},
-				"Err":     "",
-			}
+	}
 
-			for _, file := range files {
-				if file.IsDir() {
-					volume := map[string]string{
-						"Name":       file.Name(),
-						"Mountpoint": "/mnt/" + file.Name(),
-					}
-					response["Volumes"] = append(response["Volumes"].([]map[string]string), volume)
-				} else {
-					log.Printf("Skipping non-directory file: %s", file.Name())
-				}
-			}
-			json.NewEncoder(w).Encode(response)
-		}
-	})
+	stopIndex()
+	if err := d.fencer.Close(); err != nil {
+		slog.Error("Failed to close the fencing decisions", "error", err)
+	}
 
-	log.Println("Plugin HTTP SOCK server is starting on", sockPath)
-	if err := http.Serve(listener, mux); err != nil {
-		log.Fatalf("Failed to serve plugin API: %v", err)
+	if err := os.Remove(sockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove socket", "error", err)
+	}
+	if serveErr != nil {
+		// os.Exit skips the deferred calls
+		shutdownTracing(context.Background())
+		logCloser.Close()
+		os.Exit(1)
 	}
+	slog.Info("Plugin stopped")
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// The requests and responses of the Docker VolumeDriver protocol. Every response carries Err, empty on success, and
+// failures of the operation itself are reported there with a 200 status, as Docker expects. Only a request that
+// cannot be decoded gets a 400.
+
+// pluginContentType is the media type of every response of the protocol.
+const pluginContentType = "application/vnd.docker.plugins.v1+json"
+
+// maxRequestSize bounds the body of a request, the largest ones being the options of a Create.
+const maxRequestSize = 1 << 20
+
+// CreateRequest is the body of VolumeDriver.Create.
+type CreateRequest struct {
+	Name string
+	Opts map[string]string
+}
+
+// MountRequest is the body of VolumeDriver.Mount and VolumeDriver.Unmount. Docker sends one Mount and one Unmount per
+// container using the volume, ID is a random ID it generates for the mount and sends again with its Unmount. It
+// names no container.
+type MountRequest struct {
+	Name string
+	ID   string
+}
+
+// NameRequest is the body of VolumeDriver.Remove, VolumeDriver.Get and VolumeDriver.Path.
+type NameRequest struct {
+	Name string
+}
+
+type ErrorResponse struct {
+	Err string
+}
+
+// MountResponse answers VolumeDriver.Mount and VolumeDriver.Path.
+type MountResponse struct {
+	Err        string
+	MountPoint string `json:"Mountpoint"`
+}
+
+type Volume struct {
+	Name       string
+	Mountpoint string
+}
+
+type GetResponse struct {
+	Volume *Volume `json:"Volume,omitempty"`
+	Err    string
+}
+
+type ListResponse struct {
+	Volumes []Volume
+	Err     string
+}
+
+type Capability struct {
+	Scope string
+}
+
+type CapabilitiesResponse struct {
+	Capabilities Capability
+}
+
+type ActivateResponse struct {
+	Implements []string
+}
+
+type HealthResponse struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Commit    string `json:"commit"`
+}
+
+// decodeRequest decodes the body of r into req, answering with a 400 and returning false when it is not a JSON
+// object of the expected shape. An empty body, or null, leaves req empty: Docker sends no arguments to List and
+// Capabilities.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err == nil && len(body) > maxRequestSize {
+		err = fmt.Errorf("request body exceeds %d bytes", maxRequestSize)
+	}
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, req)
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "Received an invalid request", "path", r.URL.Path, "error", err)
+		writeResponse(w, http.StatusBadRequest, ErrorResponse{Err: fmt.Sprintf("Invalid JSON: %v", err)})
+		return false
+	}
+	return true
+}
+
+// writeResponse encodes response as the body of a reply with status.
+func writeResponse(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", pluginContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.Error("Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+// The conformance tests check the handlers against the Docker VolumeDriver protocol, as documented in
+// https://docs.docker.com/engine/extend/plugins_volume/, independently of what the operations do.
+
+// endpoints lists the VolumeDriver endpoints with the keys of their responses.
+var endpoints = []struct {
+	path string
+	// named endpoints refuse a request without a volume name
+	named bool
+	keys  []string
+}{
+	{path: "/VolumeDriver.Create", named: true, keys: []string{"Err"}},
+	{path: "/VolumeDriver.Remove", named: true, keys: []string{"Err"}},
+	{path: "/VolumeDriver.Mount", named: true, keys: []string{"Err", "Mountpoint"}},
+	{path: "/VolumeDriver.Unmount", named: true, keys: []string{"Err"}},
+	{path: "/VolumeDriver.Path", named: true, keys: []string{"Err", "Mountpoint"}},
+	{path: "/VolumeDriver.Get", named: true, keys: []string{"Err"}},
+	{path: "/VolumeDriver.List", keys: []string{"Err", "Volumes"}},
+	{path: "/VolumeDriver.Capabilities", keys: []string{"Capabilities"}},
+}
+
+// post sends body as is to path and checks the parts of the reply every endpoint shares: the status, the content type
+// and a JSON object as body, which it returns.
+func post(t *testing.T, handler http.Handler, path, body string, status int) map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+
+	if rec.Code != status {
+		t.Fatalf("%s with %q: expected status %d, got %d: %s", path, body, status, rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != pluginContentType {
+		t.Fatalf("%s with %q: expected content type %s, got %q", path, body, pluginContentType, contentType)
+	}
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s with %q: expected a JSON object, got %q: %v", path, body, rec.Body.String(), err)
+	}
+	return response
+}
+
+func checkKeys(t *testing.T, path string, response map[string]any, want []string) {
+	t.Helper()
+	if got := slices.Sorted(maps.Keys(response)); !slices.Equal(got, want) {
+		t.Fatalf("%s: expected the keys %v, got %v in %v", path, want, got, response)
+	}
+}
+
+func TestProtocolMalformedRequests(t *testing.T) {
+	handler := newTestDriver(t, fakeaws.NewServer()).routes()
+	bodies := []string{`{`, `{"Name": "vol-1"`, `[]`, `"vol-1"`, `42`, `{"Name": "vol-1"} {}`, `{"Name": "vol-1"} trailing`}
+	for _, endpoint := range endpoints {
+		for _, body := range bodies {
+			response := post(t, handler, endpoint.path, body, http.StatusBadRequest)
+			checkKeys(t, endpoint.path, response, []string{"Err"})
+			if err, _ := response["Err"].(string); !strings.HasPrefix(err, "Invalid JSON") {
+				t.Fatalf("%s with %q: expected an invalid JSON error, got %v", endpoint.path, body, response["Err"])
+			}
+		}
+		if endpoint.named {
+			for _, body := range []string{`{"Name": 42}`, `{"Name": ["vol-1"]}`} {
+				post(t, handler, endpoint.path, body, http.StatusBadRequest)
+			}
+		}
+	}
+
+	post(t, handler, "/VolumeDriver.Create", `{"Name": "vol-1", "Opts": "force-steal"}`, http.StatusBadRequest)
+	large := `{"Name": "vol-1", "Opts": {"x": "` + strings.Repeat("x", maxRequestSize) + `"}}`
+	post(t, handler, "/VolumeDriver.Create", large, http.StatusBadRequest)
+}
+
+func TestProtocolMissingName(t *testing.T) {
+	handler := newTestDriver(t, fakeaws.NewServer()).routes()
+	for _, endpoint := range endpoints {
+		if !endpoint.named {
+			continue
+		}
+		// Docker sends null for no arguments, unknown fields are left for future versions of the protocol
+		for _, body := range []string{``, ` `, `null`, `{}`, `{"Name": ""}`, `{"Name": null}`, `{"ID": "container-1"}`} {
+			response := post(t, handler, endpoint.path, body, http.StatusOK)
+			checkKeys(t, endpoint.path, response, endpoint.keys)
+			if response["Err"] != "Name cannot be empty or null" {
+				t.Fatalf("%s with %q: expected a missing name error, got %v", endpoint.path, body, response["Err"])
+			}
+			if mountpoint, ok := response["Mountpoint"]; ok && mountpoint != "" {
+				t.Fatalf("%s with %q: expected no mountpoint, got %v", endpoint.path, body, mountpoint)
+			}
+		}
+	}
+}
+
+func TestProtocolWithoutArguments(t *testing.T) {
+	handler := newTestDriver(t, fakeaws.NewServer()).routes()
+	for _, endpoint := range endpoints {
+		if endpoint.named {
+			continue
+		}
+		for _, body := range []string{``, `null`, `{}`, `{"Unknown": true}`} {
+			response := post(t, handler, endpoint.path, body, http.StatusOK)
+			checkKeys(t, endpoint.path, response, endpoint.keys)
+		}
+	}
+
+	response := post(t, handler, "/Plugin.Activate", ``, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Implements": []any{"VolumeDriver"}}) {
+		t.Fatalf("unexpected Activate response %v", response)
+	}
+	response = post(t, handler, "/VolumeDriver.Capabilities", `null`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Capabilities": map[string]any{"Scope": "local"}}) {
+		t.Fatalf("unexpected Capabilities response %v", response)
+	}
+}
+
+func TestProtocolResponseShapes(t *testing.T) {
+	fake := fakeaws.NewServer()
+	d := newTestDriver(t, fake)
+	handler := d.routes()
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	d.host.(*internal.FakeHost).AddEBSDevice("vol-1", "")
+	mountpoint := d.cfg.MountPath("vol-1")
+
+	// Unknown volumes fail with the same shapes as known ones succeed
+	for _, endpoint := range endpoints {
+		if !endpoint.named || endpoint.path == "/VolumeDriver.Remove" || endpoint.path == "/VolumeDriver.Unmount" {
+			continue
+		}
+		response := post(t, handler, endpoint.path, `{"Name": "vol-missing"}`, http.StatusOK)
+		checkKeys(t, endpoint.path, response, endpoint.keys)
+		if err, _ := response["Err"].(string); err == "" {
+			t.Fatalf("%s: expected an unknown volume to fail, got %v", endpoint.path, response)
+		}
+	}
+
+	response := post(t, handler, "/VolumeDriver.Create", `{"Name": "vol-1", "Opts": {}}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": ""}) {
+		t.Fatalf("unexpected Create response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.Mount", `{"Name": "vol-1", "ID": "container-1"}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": "", "Mountpoint": mountpoint}) {
+		t.Fatalf("unexpected Mount response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.Path", `{"Name": "vol-1"}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": "", "Mountpoint": mountpoint}) {
+		t.Fatalf("unexpected Path response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.Get", `{"Name": "vol-1"}`, http.StatusOK)
+	want := map[string]any{"Err": "", "Volume": map[string]any{"Name": "vol-1", "Mountpoint": mountpoint}}
+	if !reflect.DeepEqual(response, want) {
+		t.Fatalf("unexpected Get response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.List", `{}`, http.StatusOK)
+	want = map[string]any{"Err": "", "Volumes": []any{map[string]any{"Name": "vol-1", "Mountpoint": mountpoint}}}
+	if !reflect.DeepEqual(response, want) {
+		t.Fatalf("unexpected List response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.Unmount", `{"Name": "vol-1", "ID": "container-1"}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": ""}) {
+		t.Fatalf("unexpected Unmount response %v", response)
+	}
+
+	response = post(t, handler, "/VolumeDriver.Remove", `{"Name": "vol-1"}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": ""}) {
+		t.Fatalf("unexpected Remove response %v", response)
+	}
+
+	// An empty list is an array, and so is the one that comes with an error
+	response = post(t, handler, "/VolumeDriver.List", `{}`, http.StatusOK)
+	if !reflect.DeepEqual(response, map[string]any{"Err": "", "Volumes": []any{}}) {
+		t.Fatalf("unexpected empty List response %v", response)
+	}
+	if err := os.RemoveAll(d.cfg.MountRoot); err != nil {
+		t.Fatal(err)
+	}
+	response = post(t, handler, "/VolumeDriver.List", `{}`, http.StatusOK)
+	if volumes, ok := response["Volumes"].([]any); !ok || len(volumes) != 0 || response["Err"] == "" {
+		t.Fatalf("expected an error with an empty list, got %v", response)
+	}
+}
+
+func TestProtocolRoutes(t *testing.T) {
+	handler := newTestDriver(t, fakeaws.NewServer()).routes()
+	for _, endpoint := range endpoints {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, endpoint.path, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("GET %s: expected status %d, got %d", endpoint.path, http.StatusMethodNotAllowed, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/VolumeDriver.Unknown", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown endpoint to be not found, got %d", rec.Code)
+	}
+}
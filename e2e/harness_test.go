@@ -0,0 +1,379 @@
+//go:build e2e && linux
+
+// Package e2e runs the plugin binary the way Docker does, over its unix socket, against loop devices standing in for
+// EBS volumes and internal/fakeaws standing in for EC2 and ECS. It needs root and the tools the plugin runs, so it
+// only builds with the e2e tag: make test-e2e.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+const (
+	testRegion   = "eu-west-1"
+	testAZ       = "eu-west-1a"
+	testInstance = "i-0123456789abcdef0"
+	// filesystem is the one the plugin creates on empty volumes.
+	filesystem = "xfs"
+	// ebsModel is the NVMe model of EBS volumes the plugin looks for.
+	ebsModel = "Amazon Elastic Block Store"
+	// pluginMediaType is what Docker accepts from volume plugins.
+	pluginMediaType = "application/vnd.docker.plugins.v1.2+json"
+)
+
+var (
+	buildOnce sync.Once
+	binary    string
+	buildErr  error
+)
+
+// buildPlugin builds the plugin binary once for the whole suite.
+func buildPlugin(t *testing.T) string {
+	t.Helper()
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "ebs-plugin-e2e")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		binary = filepath.Join(dir, "polarity-ecs-ebs-plugin")
+		cmd := exec.Command("go", "build", "-o", binary, "./cmd/plugin")
+		cmd.Dir = ".."
+		if output, err := cmd.CombinedOutput(); err != nil {
+			buildErr = fmt.Errorf("go build failed: %v\n%s", err, output)
+		}
+	})
+	if buildErr != nil {
+		t.Fatal(buildErr)
+	}
+	return binary
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if binary != "" {
+		os.RemoveAll(filepath.Dir(binary))
+	}
+	os.Exit(code)
+}
+
+// requireHost skips the test on machines that cannot run the plugin for real.
+func requireHost(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("the end-to-end tests need root to set up loop devices and mount them")
+	}
+	for _, tool := range []string{"losetup", "blkid", "mkfs." + filesystem} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("the end-to-end tests need %s: %v", tool, err)
+		}
+	}
+}
+
+// loopVolume is an EBS volume backed by a file attached to a loop device.
+type loopVolume struct {
+	file string
+	loop string
+}
+
+// harness runs one plugin process. The fake sysfs it is pointed at only lists the volumes attached to the instance,
+// each as an NVMe device whose serial is the volume ID and whose node links to the loop device of the volume.
+type harness struct {
+	t        *testing.T
+	root     string
+	sysBlock string
+	dev      string
+	fake     *fakeaws.Server
+	endpoint string
+	socket   string
+	mkfsLog  string
+	client   *http.Client
+
+	mu       sync.Mutex
+	volumes  map[string]loopVolume
+	names    map[string]string
+	nextNVMe int
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	requireHost(t)
+
+	root := t.TempDir()
+	h := &harness{
+		t:        t,
+		root:     root,
+		sysBlock: filepath.Join(root, "sys", "block"),
+		dev:      filepath.Join(root, "dev"),
+		fake:     fakeaws.NewServer(),
+		socket:   filepath.Join(root, "pl-ebs.sock"),
+		mkfsLog:  filepath.Join(root, "mkfs.log"),
+		volumes:  make(map[string]loopVolume),
+		names:    make(map[string]string),
+		// Far from the names of real disks, which are never considered once they hold the root filesystem
+		nextNVMe: 100,
+	}
+	for _, dir := range []string{h.sysBlock, h.dev, filepath.Join(root, "by-id"), filepath.Join(root, "bin")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h.fake.AttachDelay = 200 * time.Millisecond
+	h.fake.DetachDelay = 200 * time.Millisecond
+	h.fake.OnAttached = h.attached
+	h.fake.OnDetached = h.detached
+	h.fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	server := h.fake.Start()
+	t.Cleanup(server.Close)
+	h.endpoint = server.URL
+
+	h.client = &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", h.socket)
+			},
+		},
+	}
+	return h
+}
+
+// addVolume creates an available EBS volume of sizeMB backed by a sparse file on a loop device.
+func (h *harness) addVolume(volumeID string, sizeMB int) {
+	h.t.Helper()
+	file := filepath.Join(h.root, volumeID+".img")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		h.t.Fatal(err)
+	}
+	if err := os.Truncate(file, int64(sizeMB)<<20); err != nil {
+		h.t.Fatal(err)
+	}
+	output, err := exec.Command("losetup", "--find", "--show", file).CombinedOutput()
+	if err != nil {
+		h.t.Fatalf("failed to set up a loop device for %s: %v: %s", file, err, output)
+	}
+	loop := strings.TrimSpace(string(output))
+	h.t.Cleanup(func() {
+		if output, err := exec.Command("losetup", "--detach", loop).CombinedOutput(); err != nil {
+			h.t.Errorf("failed to detach %s: %v: %s", loop, err, output)
+		}
+	})
+
+	h.mu.Lock()
+	h.volumes[volumeID] = loopVolume{file: file, loop: loop}
+	h.mu.Unlock()
+	h.fake.AddVolume(fakeaws.EBSVolume{ID: volumeID, AvailabilityZone: testAZ, Size: int32((sizeMB + 1023) >> 10)})
+}
+
+// attached makes the NVMe device of volumeID show up in the fake sysfs, as EC2 does once the attachment completes.
+func (h *harness) attached(volumeID string, attachment fakeaws.VolumeAttachment) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	volume, ok := h.volumes[volumeID]
+	if !ok || attachment.InstanceID != testInstance {
+		return
+	}
+	name := fmt.Sprintf("nvme%dn1", h.nextNVMe)
+	h.nextNVMe++
+
+	device := filepath.Join(h.sysBlock, name, "device")
+	err := os.MkdirAll(device, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(device, "model"), []byte(ebsModel+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(device, "serial"), []byte(strings.Replace(volumeID, "-", "", 1)+"\n"), 0644)
+	}
+	if err == nil {
+		err = os.Symlink(volume.loop, filepath.Join(h.dev, name))
+	}
+	if err != nil {
+		h.t.Errorf("failed to expose %s as %s: %v", volumeID, name, err)
+		return
+	}
+	h.names[volumeID] = name
+}
+
+// detached makes the device of volumeID go away from the fake sysfs.
+func (h *harness) detached(volumeID string, attachment fakeaws.VolumeAttachment) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name, ok := h.names[volumeID]
+	if !ok || attachment.InstanceID != testInstance {
+		return
+	}
+	delete(h.names, volumeID)
+	if err := os.RemoveAll(filepath.Join(h.sysBlock, name)); err != nil {
+		h.t.Errorf("failed to remove %s: %v", name, err)
+	}
+	if err := os.Remove(filepath.Join(h.dev, name)); err != nil {
+		h.t.Errorf("failed to remove %s: %v", name, err)
+	}
+}
+
+// start runs the plugin with the environment of make dev, pointed at the fake sysfs and the fake AWS endpoint, and
+// waits for its socket. mkfs is wrapped so that every format is recorded.
+func (h *harness) start() {
+	h.t.Helper()
+	mkfs, err := exec.LookPath("mkfs." + filesystem)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	wrapper := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %q\nexec %q \"$@\"\n", h.mkfsLog, mkfs)
+	if err := os.WriteFile(filepath.Join(h.root, "bin", "mkfs."+filesystem), []byte(wrapper), 0755); err != nil {
+		h.t.Fatal(err)
+	}
+
+	logFile, err := os.Create(filepath.Join(h.root, "plugin.log"))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	cmd := exec.Command(buildPlugin(h.t))
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.Env = append(os.Environ(),
+		"PATH="+filepath.Join(h.root, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"SOCK_PATH="+h.socket,
+		"STATE_DIR="+filepath.Join(h.root, "state"),
+		"TRACES_FILE="+filepath.Join(h.root, "traces.json"),
+		"MOUNT_ROOT="+filepath.Join(h.root, "mnt"),
+		"REGION="+testRegion,
+		"AVAILABILITY_ZONE="+testAZ,
+		"INSTANCE_ID="+testInstance,
+		"LOG_LEVEL=debug",
+		"AWS_ENDPOINT="+h.endpoint,
+		"AWS_ACCESS_KEY_ID=test",
+		"AWS_SECRET_ACCESS_KEY=test",
+		"AWS_EC2_METADATA_DISABLED=true",
+		"DEVICE_SYS_BLOCK="+h.sysBlock,
+		"DEVICE_BY_ID_DIR="+filepath.Join(h.root, "by-id"),
+		"DEVICE_DEV_DIR="+h.dev,
+		"DEVICE_RESCAN_INTERVAL=100ms",
+		"VOLUME_POLL_INTERVAL=100ms",
+		"ECS_AGENT_ENDPOINT=http://127.0.0.1:1",
+		"DOCKER_SOCKET="+filepath.Join(h.root, "docker.sock"),
+	)
+	if err := cmd.Start(); err != nil {
+		h.t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	h.t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(30 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+			h.t.Error("the plugin did not stop on SIGTERM")
+		}
+		logFile.Close()
+		if h.t.Failed() {
+			if output, err := os.ReadFile(logFile.Name()); err == nil {
+				h.t.Logf("plugin output:\n%s", output)
+			}
+		}
+	})
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var res struct{ Implements []string }
+		err := h.call("/Plugin.Activate", struct{}{}, &res)
+		if err == nil {
+			return
+		}
+		select {
+		case err := <-exited:
+			h.t.Fatalf("the plugin exited before serving: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			h.t.Fatalf("the plugin did not start serving on %s: %v", h.socket, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// call posts req to the plugin like Docker does and decodes its response into res.
+func (h *harness) call(path string, req, res any) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, "http://plugin"+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Accept", pluginMediaType)
+	httpReq.Header.Set("Content-Type", pluginMediaType)
+	httpRes, err := h.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, httpRes.Status)
+	}
+	return json.NewDecoder(httpRes.Body).Decode(res)
+}
+
+// volumeCall calls a VolumeDriver endpoint and fails the test when it reports an error.
+func (h *harness) volumeCall(path string, req any) volumeResponse {
+	h.t.Helper()
+	var res volumeResponse
+	if err := h.call(path, req, &res); err != nil {
+		h.t.Fatal(err)
+	}
+	if res.Err != "" {
+		h.t.Fatalf("%s failed: %s", path, res.Err)
+	}
+	return res
+}
+
+type volumeResponse struct {
+	Err        string
+	Mountpoint string
+}
+
+// formats returns the arguments of every mkfs the plugin ran.
+func (h *harness) formats() []string {
+	h.t.Helper()
+	data, err := os.ReadFile(h.mkfsLog)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		h.t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// filesystemUUID returns the UUID of the filesystem on the loop device of volumeID, which changes with every format.
+func (h *harness) filesystemUUID(volumeID string) string {
+	h.t.Helper()
+	h.mu.Lock()
+	loop := h.volumes[volumeID].loop
+	h.mu.Unlock()
+	output, err := exec.Command("blkid", "-p", "-o", "value", "-s", "UUID", loop).Output()
+	if err != nil {
+		h.t.Fatalf("failed to probe %s: %v", loop, err)
+	}
+	return strings.TrimSpace(string(output))
+}
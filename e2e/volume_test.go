@@ -0,0 +1,57 @@
+//go:build e2e && linux
+
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVolumeLifecycle(t *testing.T) {
+	h := newHarness(t)
+	const volumeID = "vol-0e2e0000000000001"
+	// The smallest volume mkfs.xfs accepts
+	h.addVolume(volumeID, 512)
+	h.start()
+
+	h.volumeCall("/VolumeDriver.Create", map[string]any{"Name": volumeID, "Opts": map[string]string{}})
+
+	mountpoint := h.volumeCall("/VolumeDriver.Mount", map[string]string{"Name": volumeID, "ID": "container-1"}).Mountpoint
+	if mountpoint == "" {
+		t.Fatal("Mount returned no mountpoint")
+	}
+	data := filepath.Join(mountpoint, "data")
+	if err := os.WriteFile(data, []byte("kept across mounts"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uuid := h.filesystemUUID(volumeID)
+	if uuid == "" {
+		t.Fatal("expected the volume to hold a filesystem after the first Mount")
+	}
+
+	h.volumeCall("/VolumeDriver.Unmount", map[string]string{"Name": volumeID, "ID": "container-1"})
+	if _, err := os.Stat(data); !os.IsNotExist(err) {
+		t.Fatalf("expected the data to be gone from %s once unmounted, got %v", mountpoint, err)
+	}
+
+	if again := h.volumeCall("/VolumeDriver.Mount", map[string]string{"Name": volumeID, "ID": "container-2"}).Mountpoint; again != mountpoint {
+		t.Fatalf("expected the volume to be mounted on %s again, got %s", mountpoint, again)
+	}
+	if content, err := os.ReadFile(data); err != nil || string(content) != "kept across mounts" {
+		t.Fatalf("expected the data to persist, got %q, %v", content, err)
+	}
+	if got := h.filesystemUUID(volumeID); got != uuid {
+		t.Fatalf("expected the filesystem %s to be kept, got %s", uuid, got)
+	}
+
+	h.volumeCall("/VolumeDriver.Unmount", map[string]string{"Name": volumeID, "ID": "container-2"})
+	h.volumeCall("/VolumeDriver.Remove", map[string]string{"Name": volumeID})
+	if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+		t.Fatalf("expected Remove to delete %s, got %v", mountpoint, err)
+	}
+
+	if formats := h.formats(); len(formats) != 1 {
+		t.Fatalf("expected the volume to be formatted exactly once, got %q", formats)
+	}
+}
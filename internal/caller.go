@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ecsTaskArnLabel is the label the ECS agent puts on the containers it creates.
+const ecsTaskArnLabel = "com.amazonaws.ecs.task-arn"
+
+// CallerResolver finds the ECS task that is mounting a volume, so that the in-use check does not count it as a
+// conflicting user. The ID Docker sends with Mount is random and names no container, so the resolver asks the Docker
+// Engine which container being created uses the volume, and falls back to the ECS agent introspection API when
+// Docker cannot be asked.
+type CallerResolver struct {
+	docker *http.Client
+	agent  *http.Client
+	cfg    *Config
+}
+
+func NewCallerResolver(cfg *Config) *CallerResolver {
+	return &CallerResolver{
+		docker: &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", cfg.ECS.DockerSocket)
+				},
+			},
+		},
+		agent: &http.Client{Timeout: 5 * time.Second},
+		cfg:   cfg,
+	}
+}
+
+// CallingTasks returns the ARNs of the tasks mounting volume: those of the containers being created with it when
+// Docker can tell, otherwise the one task the ECS agent is starting on this instance. A caller that is not an ECS
+// task gives none. When neither can tell, the error says why and no task is left out of the in-use check.
+func (r *CallerResolver) CallingTasks(ctx context.Context, volume string) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "CallingTasks")
+	defer func() { endSpan(span, err) }()
+
+	tasks, dockerErr := r.dockerCallers(ctx, volume)
+	if dockerErr == nil {
+		span.SetAttributes(attribute.String("caller.source", "docker"), attribute.StringSlice("caller.tasks", tasks))
+		slog.DebugContext(ctx, "Resolved the calling task from Docker", "tasks", tasks)
+		return tasks, nil
+	}
+
+	tasks, agentErr := r.agentCaller(ctx)
+	if agentErr == nil {
+		span.SetAttributes(attribute.String("caller.source", "ecs-agent"), attribute.StringSlice("caller.tasks", tasks))
+		slog.DebugContext(ctx, "Resolved the calling task from the ECS agent", "tasks", tasks, "docker_error", dockerErr)
+		return tasks, nil
+	}
+
+	return nil, fmt.Errorf("cannot identify the task mounting the volume: %w", errors.Join(dockerErr, agentErr))
+}
+
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	State  string
+	Labels map[string]string
+}
+
+// dockerCallers returns the tasks of the containers being created with volume. Docker asks for the mount while
+// starting the container, before it leaves the created state.
+func (r *CallerResolver) dockerCallers(ctx context.Context, volume string) ([]string, error) {
+	filters, err := json.Marshal(map[string][]string{"volume": {volume}, "status": {"created"}})
+	if err != nil {
+		return nil, err
+	}
+	var containers []dockerContainer
+	if err := getJSON(ctx, r.docker, "http://docker/containers/json?all=true&filters="+url.QueryEscape(string(filters)), &containers); err != nil {
+		return nil, fmt.Errorf("docker: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var tasks []string
+	for _, c := range containers {
+		if arn := c.Labels[ecsTaskArnLabel]; arn != "" && !seen[arn] {
+			seen[arn] = true
+			tasks = append(tasks, arn)
+		}
+	}
+	return tasks, nil
+}
+
+type agentTask struct {
+	Arn           string
+	DesiredStatus string
+	KnownStatus   string
+}
+
+// agentCaller returns the task the ECS agent is starting on this instance. The agent does not say which volumes a
+// task mounts, so the caller is only told apart when a single task is starting: of several, any could be a
+// conflicting user.
+func (r *CallerResolver) agentCaller(ctx context.Context) ([]string, error) {
+	var response struct {
+		Tasks []agentTask
+	}
+	if err := getJSON(ctx, r.agent, r.cfg.ECS.AgentEndpoint+"/v1/tasks", &response); err != nil {
+		return nil, fmt.Errorf("ecs agent: %w", err)
+	}
+
+	var starting []string
+	for _, task := range response.Tasks {
+		if task.DesiredStatus == "RUNNING" && task.KnownStatus != "RUNNING" && task.KnownStatus != "STOPPED" {
+			starting = append(starting, task.Arn)
+		}
+	}
+	if len(starting) > 1 {
+		return nil, fmt.Errorf("ecs agent: %d tasks are starting on the instance, the one mounting the volume cannot be told apart", len(starting))
+	}
+	return starting, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
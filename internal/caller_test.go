@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newTestDocker lists containers on a Docker socket and returns its path. containers maps the volumes to the labels
+// of the containers being created with them, only the volume and status filters of Mount are supported.
+func newTestDocker(t *testing.T, containers map[string][]map[string]string) string {
+	t.Helper()
+	// Unix socket paths are limited to around a hundred bytes, shorter than some temporary directories
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if r.URL.Path != "/containers/json" || json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters) != nil {
+			http.Error(w, `{"message":"page not found"}`, http.StatusNotFound)
+			return
+		}
+		if !slices.Equal(filters["status"], []string{"created"}) || len(filters["volume"]) != 1 {
+			http.Error(w, `{"message":"unexpected filters"}`, http.StatusBadRequest)
+			return
+		}
+		listed := []map[string]any{}
+		for i, labels := range containers[filters["volume"][0]] {
+			listed = append(listed, map[string]any{"Id": strings.Repeat(string(rune('a'+i)), 64), "State": "created", "Labels": labels})
+		}
+		json.NewEncoder(w).Encode(listed)
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socket
+}
+
+// newTestAgent serves the tasks of the ECS agent introspection API, as {Arn, DesiredStatus, KnownStatus}.
+func newTestAgent(t *testing.T, tasks []agentTask) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/tasks" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Tasks": tasks})
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestCallingTasks(t *testing.T) {
+	const (
+		taskArn  = "arn:aws:ecs:eu-west-1:123456789012:task/apps/0123456789abcdef"
+		otherArn = "arn:aws:ecs:eu-west-1:123456789012:task/apps/fedcba9876543210"
+	)
+	docker := newTestDocker(t, map[string][]map[string]string{
+		// Every container of the task is created with the volume
+		"vol-1": {{ecsTaskArnLabel: taskArn, "com.amazonaws.ecs.container-name": "db"}, {ecsTaskArnLabel: taskArn, "com.amazonaws.ecs.container-name": "backup"}},
+		"vol-2": {{"maintainer": "someone"}},
+	})
+	noDocker := filepath.Join(t.TempDir(), "missing.sock")
+	oneStarting := newTestAgent(t, []agentTask{
+		{Arn: taskArn, DesiredStatus: "RUNNING", KnownStatus: "PENDING"},
+		{Arn: otherArn, DesiredStatus: "RUNNING", KnownStatus: "RUNNING"},
+	})
+	twoStarting := newTestAgent(t, []agentTask{
+		{Arn: taskArn, DesiredStatus: "RUNNING", KnownStatus: "PENDING"},
+		{Arn: otherArn, DesiredStatus: "RUNNING", KnownStatus: "PULLED"},
+	})
+
+	tests := []struct {
+		name    string
+		docker  string
+		agent   string
+		volume  string
+		want    []string
+		wantErr string
+	}{
+		{name: "docker", docker: docker, agent: "http://127.0.0.1:1", volume: "vol-1", want: []string{taskArn}},
+		{name: "docker, not a task", docker: docker, agent: oneStarting, volume: "vol-2"},
+		{name: "docker, no container", docker: docker, agent: oneStarting, volume: "vol-3"},
+		{name: "agent, one starting task", docker: noDocker, agent: oneStarting, volume: "vol-1", want: []string{taskArn}},
+		{name: "agent, several starting tasks", docker: noDocker, agent: twoStarting, volume: "vol-1", wantErr: "cannot be told apart"},
+		{name: "neither", docker: noDocker, agent: "http://127.0.0.1:1", volume: "vol-1", wantErr: "cannot identify the task"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ECS.DockerSocket = tt.docker
+			cfg.ECS.AgentEndpoint = tt.agent
+			tasks, err := NewCallerResolver(cfg).CallingTasks(context.Background(), tt.volume)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error with %q, got %v", tt.wantErr, err)
+				}
+				if tasks != nil {
+					t.Fatalf("expected no task to be left out of the check, got %v", tasks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(tasks, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, tasks)
+			}
+		})
+	}
+}
@@ -2,15 +2,22 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Status int
@@ -21,187 +28,603 @@ const (
 	VolumeInUseError
 )
 
-// Check single cluster
-func checkCluster(ctx context.Context, cfg aws.Config, clusterArn, targetAZ string, volumeFound *int, mu *sync.Mutex, wg *sync.WaitGroup, volumeToCheck string) {
-	defer wg.Done()
+// indexedTask is a task that may hold volumes, as seen by the last refresh of the index.
+type indexedTask struct {
+	Cluster              string
+	TaskArn              string
+	TaskDefinitionArn    string
+	LastStatus           string
+	LaunchType           string
+	ContainerInstanceArn string
+	// Ambiguity tells why the scan could not make sure the task runs in the availability zone, it is kept all the same
+	Ambiguity string
+}
+
+// ciPlacement is where a container instance runs, as far as the scan could tell.
+type ciPlacement struct {
+	// external is an ECS Anywhere instance, outside of EC2
+	external bool
+	// az is empty when unknown
+	az string
+}
+
+// containerInstanceAZ returns the availability zone the ECS agent reports for ci, if any.
+func containerInstanceAZ(ci ecstypes.ContainerInstance) string {
+	for _, attr := range ci.Attributes {
+		if aws.ToString(attr.Name) == "ecs.availability-zone" {
+			return aws.ToString(attr.Value)
+		}
+	}
+	return ""
+}
+
+// placeTask tells whether task may run in the availability zone of the index, and if so whether that is only a
+// possibility. Only tasks of the EC2 launch type can use the volumes of the plugin: Fargate tasks cannot use Docker
+// volume plugins and external ones run outside of EC2.
+func (idx *TaskIndex) placeTask(task ecstypes.Task, placements map[string]ciPlacement) (ambiguity string, inAZ bool) {
+	switch capacityProvider := aws.ToString(task.CapacityProviderName); {
+	case task.LaunchType == ecstypes.LaunchTypeFargate, capacityProvider == "FARGATE", capacityProvider == "FARGATE_SPOT":
+		return "", false
+	case task.LaunchType == ecstypes.LaunchTypeExternal:
+		return "", false
+	case task.LaunchType != ecstypes.LaunchTypeEc2 && task.LaunchType != "":
+		return fmt.Sprintf("unknown launch type %s", task.LaunchType), true
+	}
 
-	ecsClient := ecs.NewFromConfig(cfg)
-	ec2Client := ec2.NewFromConfig(cfg)
-	clusterName := *aws.String(clusterArn[strings.LastIndex(clusterArn, "/")+1:])
+	ciArn := aws.ToString(task.ContainerInstanceArn)
+	placement, known := placements[ciArn]
+	switch {
+	case known && placement.external:
+		return "", false
+	case known && placement.az != "":
+		return "", placement.az == idx.az
+	case task.AvailabilityZone != nil:
+		// ECS reports where the task was placed, which is as good when the instance is not known
+		return "", *task.AvailabilityZone == idx.az
+	case ciArn == "":
+		return "the task has no container instance", true
+	case !known:
+		return fmt.Sprintf("container instance %s is not registered to the cluster", ciArn), true
+	default:
+		return fmt.Sprintf("availability zone of container instance %s is unknown", ciArn), true
+	}
+}
+
+// TaskIndex knows which ECS tasks in the availability zone of the instance are running, and through their task
+// definitions which volumes they use. It is refreshed in the background by Run, and on demand when an answer has
+// to be fresher than that.
+type TaskIndex struct {
+	cfg       *Config
+	az        string
+	ecsClient ECSAPI
+	ec2Client EC2API
+	agent     *http.Client
+
+	// callSlots bounds the AWS calls in flight during a scan
+	callSlots chan struct{}
+
+	// Task definitions never change once registered, so they are kept forever
+	defsMu       sync.Mutex
+	taskDefs     map[string]*ecstypes.TaskDefinition
+	defsInFlight map[string]*taskDefinitionFetch
+
+	mu          sync.Mutex
+	last        indexScan
+	refreshedAt time.Time
+	refreshing  *indexRefresh
+}
+
+// Policies for the clusters the index could not scan, see ECSConfig.ScanFailurePolicy.
+const (
+	ScanFailClosed = "fail-closed"
+	ScanFailOpen   = "fail-open"
+)
+
+// indexScan is what a refresh of the index found.
+type indexScan struct {
+	tasks []indexedTask
+	// unverified are the clusters that could not be scanned, with the reason
+	unverified map[string]error
+}
+
+// UnverifiedClustersError is returned when some clusters could not be scanned, so tasks there may be using the
+// volume without the index knowing.
+type UnverifiedClustersError struct {
+	// Clusters maps the ARN of each cluster to the reason it could not be scanned.
+	Clusters map[string]error
+}
+
+func (e *UnverifiedClustersError) Error() string {
+	clusters := slices.Sorted(maps.Keys(e.Clusters))
+	for i, cluster := range clusters {
+		clusters[i] = fmt.Sprintf("%s (%v)", cluster, e.Clusters[cluster])
+	}
+	return "cannot verify clusters " + strings.Join(clusters, ", ")
+}
+
+func (e *UnverifiedClustersError) Unwrap() []error {
+	return slices.Collect(maps.Values(e.Clusters))
+}
+
+// taskDefinitionFetch is a describe of a task definition in progress, shared by everyone who needs it.
+type taskDefinitionFetch struct {
+	done chan struct{}
+	def  *ecstypes.TaskDefinition
+	err  error
+}
+
+// indexRefresh is a refresh in progress, shared by everyone who needs it.
+type indexRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func NewTaskIndex(cfg *Config, ecsClient ECSAPI, ec2Client EC2API, availabilityZone string) *TaskIndex {
+	return &TaskIndex{
+		cfg:          cfg,
+		az:           availabilityZone,
+		ecsClient:    ecsClient,
+		ec2Client:    ec2Client,
+		agent:        &http.Client{Timeout: 5 * time.Second},
+		callSlots:    make(chan struct{}, cfg.ECS.DescribeConcurrency),
+		taskDefs:     make(map[string]*ecstypes.TaskDefinition),
+		defsInFlight: make(map[string]*taskDefinitionFetch),
+	}
+}
+
+// Run refreshes the index every cfg.ECS.IndexRefreshInterval until ctx is done.
+func (idx *TaskIndex) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(idx.cfg.ECS.IndexRefreshInterval))
+	defer ticker.Stop()
+
+	for {
+		if err := idx.refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Failed to refresh the ECS task index", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot returns the last scan of the index, refreshing it first when it is older than maxAge.
+func (idx *TaskIndex) snapshot(ctx context.Context, maxAge time.Duration) (indexScan, error) {
+	idx.mu.Lock()
+	fresh := !idx.refreshedAt.IsZero() && time.Since(idx.refreshedAt) <= maxAge
+	last := idx.last
+	idx.mu.Unlock()
+	if fresh {
+		return last, nil
+	}
+
+	if err := idx.refresh(ctx); err != nil {
+		return indexScan{}, err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.last, nil
+}
+
+// refresh rescans the clusters, or waits for the rescan already in progress.
+func (idx *TaskIndex) refresh(ctx context.Context) error {
+	idx.mu.Lock()
+	current := idx.refreshing
+	if current == nil {
+		current = &indexRefresh{done: make(chan struct{})}
+		idx.refreshing = current
+		// The scan is shared, so it must not stop when the caller that started it goes away
+		go idx.scan(context.WithoutCancel(ctx), current)
+	}
+	idx.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-current.done:
+		return current.err
+	}
+}
+
+func (idx *TaskIndex) scan(ctx context.Context, current *indexRefresh) {
+	started := time.Now()
+	scan, err := idx.scanClusters(ctx)
+
+	idx.mu.Lock()
+	if err == nil {
+		idx.last = scan
+		idx.refreshedAt = started
+	}
+	idx.refreshing = nil
+	idx.mu.Unlock()
+
+	current.err = err
+	close(current.done)
+}
+
+func (idx *TaskIndex) scanClusters(ctx context.Context) (_ indexScan, err error) {
+	ctx, span := startSpan(ctx, "ScanClusters")
+	defer func() { endSpan(span, err) }()
+
+	clusterArns, unverified, err := idx.clusters(ctx)
+	if err != nil {
+		return indexScan{}, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	scan := indexScan{unverified: make(map[string]error)}
+	maps.Copy(scan.unverified, unverified)
+
+	// Check each cluster concurrently, a cluster that fails is reported rather than taken as having no tasks
+	for _, clusterArn := range clusterArns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := idx.checkCluster(ctx, clusterArn)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				scan.unverified[clusterArn] = err
+				return
+			}
+			scan.tasks = append(scan.tasks, found...)
+		}()
+	}
+	wg.Wait()
+
+	span.SetAttributes(attribute.Int("index.unverified_clusters", len(scan.unverified)))
+	slog.DebugContext(ctx, "Refreshed the ECS task index", "clusters", len(clusterArns), "tasks", len(scan.tasks), "unverified_clusters", len(scan.unverified))
+	return scan, nil
+}
+
+// checkCluster returns the tasks of a single cluster that run on instances in the availability zone of the index.
+func (idx *TaskIndex) checkCluster(ctx context.Context, clusterArn string) (_ []indexedTask, err error) {
+	ctx, span := startSpan(ctx, "checkCluster", attribute.String("ecs.cluster", clusterArn))
+	defer func() { endSpan(span, err) }()
+
+	clusterName := clusterArn[strings.LastIndex(clusterArn, "/")+1:]
+	ctx = WithLogAttrs(ctx, slog.String("cluster", clusterName))
 
 	// 1. List all container instances in cluster
-	log.Printf("Checking cluster %s for volume %s in AZ %s", clusterName, volumeToCheck, targetAZ)
-	ciPaginator := ecs.NewListContainerInstancesPaginator(ecsClient, &ecs.ListContainerInstancesInput{Cluster: &clusterName})
+	slog.DebugContext(ctx, "Scanning cluster", "availability_zone", idx.az)
+	ciPaginator := ecs.NewListContainerInstancesPaginator(idx.ecsClient, &ecs.ListContainerInstancesInput{Cluster: &clusterName})
 	var ciArns []string
 	for ciPaginator.HasMorePages() {
-		output, err := ciPaginator.NextPage(ctx)
+		output, err := withCallSlot(ctx, idx, func() (*ecs.ListContainerInstancesOutput, error) { return ciPaginator.NextPage(ctx) })
 		if err != nil {
-			log.Printf("error listing instances for %s: %v", clusterName, err)
-			return
+			return nil, fmt.Errorf("error listing container instances: %w", err)
 		}
 		ciArns = append(ciArns, output.ContainerInstanceArns...)
 	}
 	if len(ciArns) == 0 {
-		return
+		return nil, nil
 	}
 
-	// 2. Describe container instances to get EC2 IDsq
-	describedCIs, err := ecsClient.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: &clusterName, ContainerInstances: ciArns})
+	// 2. Describe container instances to get EC2 IDs
+	describedCIs, err := describeInBatches(ctx, idx, ciArns, func(ctx context.Context, batch []string) ([]ecstypes.ContainerInstance, error) {
+		output, err := idx.ecsClient.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: &clusterName, ContainerInstances: batch})
+		if err != nil {
+			return nil, err
+		}
+		return output.ContainerInstances, nil
+	})
 	if err != nil {
-		log.Printf("error describing instances for %s: %v", clusterName, err)
-		return
+		return nil, fmt.Errorf("error describing container instances: %w", err)
 	}
 
+	placements := make(map[string]ciPlacement)
 	ec2IdToCiArn := make(map[string]string)
 	var ec2Ids []string
-	for _, ci := range describedCIs.ContainerInstances {
-		ec2IdToCiArn[*ci.Ec2InstanceId] = *ci.ContainerInstanceArn
-		ec2Ids = append(ec2Ids, *ci.Ec2InstanceId)
+	for _, ci := range describedCIs {
+		ciArn := aws.ToString(ci.ContainerInstanceArn)
+		id := aws.ToString(ci.Ec2InstanceId)
+		switch {
+		case id == "" || strings.HasPrefix(id, "mi-"):
+			// ECS Anywhere instances are managed by SSM, EBS volumes cannot be attached to them
+			placements[ciArn] = ciPlacement{external: true}
+		case containerInstanceAZ(ci) != "":
+			placements[ciArn] = ciPlacement{az: containerInstanceAZ(ci)}
+		default:
+			placements[ciArn] = ciPlacement{}
+			ec2IdToCiArn[id] = ciArn
+			ec2Ids = append(ec2Ids, id)
+		}
 	}
 
-	// 3. Describe EC2 instances to filter by AZ
-	describedEc2s, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: ec2Ids})
+	// 3. Describe the EC2 instances whose container instance does not tell its AZ
+	describedEc2s, err := describeInBatches(ctx, idx, ec2Ids, func(ctx context.Context, batch []string) ([]ec2types.Instance, error) {
+		// A filter, unlike InstanceIds, does not fail the whole call when an instance is already gone
+		output, err := idx.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{{Name: aws.String("instance-id"), Values: batch}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var instances []ec2types.Instance
+		for _, res := range output.Reservations {
+			instances = append(instances, res.Instances...)
+		}
+		return instances, nil
+	})
 	if err != nil {
-		log.Printf("error describing EC2 for %s: %v", clusterName, err)
-		return
+		return nil, fmt.Errorf("error describing EC2 instances: %w", err)
+	}
+	for _, inst := range describedEc2s {
+		if inst.Placement != nil && inst.Placement.AvailabilityZone != nil {
+			placements[ec2IdToCiArn[aws.ToString(inst.InstanceId)]] = ciPlacement{az: *inst.Placement.AvailabilityZone}
+		}
 	}
 
-	ciArnsInAZ := make(map[string]bool)
-	for _, res := range describedEc2s.Reservations {
-		for _, inst := range res.Instances {
-			if *inst.Placement.AvailabilityZone == targetAZ {
-				ciArnsInAZ[ec2IdToCiArn[*inst.InstanceId]] = true
-			}
+	// Tasks of the EC2 launch type run on container instances, if none can be in the AZ no task of the cluster can
+	// hold the volume
+	candidates := false
+	for _, p := range placements {
+		if !p.external && (p.az == idx.az || p.az == "") {
+			candidates = true
+			break
 		}
 	}
-	if len(ciArnsInAZ) == 0 {
-		return
+	if !candidates {
+		return nil, nil
 	}
 
 	// 4. List and inspect tasks only on instances in the correct AZ
-	taskPaginator := ecs.NewListTasksPaginator(ecsClient, &ecs.ListTasksInput{Cluster: &clusterName})
+	taskPaginator := ecs.NewListTasksPaginator(idx.ecsClient, &ecs.ListTasksInput{Cluster: &clusterName})
 	var taskArns []string
 	for taskPaginator.HasMorePages() {
-		tasksOutput, err := taskPaginator.NextPage(ctx)
+		tasksOutput, err := withCallSlot(ctx, idx, func() (*ecs.ListTasksOutput, error) { return taskPaginator.NextPage(ctx) })
 		if err != nil {
-			log.Printf("error listing tasks for %s: %v", clusterName, err)
-			return
+			return nil, fmt.Errorf("error listing tasks: %w", err)
 		}
 		taskArns = append(taskArns, tasksOutput.TaskArns...)
 	}
 
 	if len(taskArns) == 0 {
-		return
+		return nil, nil
 	}
 
-	describedTasks, err := ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: &clusterName, Tasks: taskArns})
+	describedTasks, err := describeInBatches(ctx, idx, taskArns, func(ctx context.Context, batch []string) ([]ecstypes.Task, error) {
+		output, err := idx.ecsClient.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: &clusterName, Tasks: batch})
+		if err != nil {
+			return nil, err
+		}
+		return output.Tasks, nil
+	})
 	if err != nil {
-		log.Printf("error describing tasks for %s: %v", clusterName, err)
-		return
+		return nil, fmt.Errorf("error describing tasks: %w", err)
 	}
 
-	taskDefsToInspect := make(map[string]bool)
-	for _, task := range describedTasks.Tasks {
-		if _, ok := ciArnsInAZ[*task.ContainerInstanceArn]; ok {
-			taskDefsToInspect[*task.TaskDefinitionArn] = true
-		}
+	stillRunningTaskState := make(map[string]struct{}, len(idx.cfg.ECS.RunningTaskStates))
+	for _, state := range idx.cfg.ECS.RunningTaskStates {
+		stillRunningTaskState[state] = struct{}{}
 	}
 
-	var taskDefArnsToCheck []string
-
-	for taskDefArn := range taskDefsToInspect {
-		defOutput, err := ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: &taskDefArn})
-		if err != nil {
-			log.Printf("error describing task def %s: %v", taskDefArn, err)
+	var tasks []indexedTask
+	ambiguous := 0
+	for _, task := range describedTasks {
+		// If the task is still in one of the running states, it may hold its volumes
+		if _, ok := stillRunningTaskState[aws.ToString(task.LastStatus)]; !ok {
 			continue
 		}
+		ambiguity, inAZ := idx.placeTask(task, placements)
+		if !inAZ {
+			continue
+		}
+		if ambiguity != "" {
+			ambiguous++
+			slog.DebugContext(ctx, "Cannot tell where the task runs", "task", aws.ToString(task.TaskArn), "reason", ambiguity)
+		}
+		tasks = append(tasks, indexedTask{
+			Cluster:              clusterArn,
+			TaskArn:              aws.ToString(task.TaskArn),
+			TaskDefinitionArn:    aws.ToString(task.TaskDefinitionArn),
+			LastStatus:           aws.ToString(task.LastStatus),
+			LaunchType:           string(task.LaunchType),
+			ContainerInstanceArn: aws.ToString(task.ContainerInstanceArn),
+			Ambiguity:            ambiguity,
+		})
+	}
+	if ambiguous > 0 {
+		slog.WarnContext(ctx, "Cannot tell whether some tasks run in the availability zone, they count as using their volumes", "tasks", ambiguous)
+	}
+
+	// 5. Make sure the task definitions are known, they are what tells which volumes the tasks use
+	var defArns []string
+	for _, task := range tasks {
+		if !slices.Contains(defArns, task.TaskDefinitionArn) {
+			defArns = append(defArns, task.TaskDefinitionArn)
+		}
+	}
+	errs := make([]error, len(defArns))
+	var wg sync.WaitGroup
+	for i, arn := range defArns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := idx.taskDefinition(ctx, arn); err != nil {
+				errs[i] = fmt.Errorf("error describing task definition %s: %w", arn, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// describeBatch is the most items the ECS describe calls accept at once, EC2 instances are described by as many.
+const describeBatch = 100
 
-		for _, vol := range defOutput.TaskDefinition.Volumes {
-			if *vol.Name == volumeToCheck {
-				log.Printf("Found volume '%s' in use by task def %s", volumeToCheck, taskDefArn)
-				taskDefArnsToCheck = append(taskDefArnsToCheck, taskDefArn)
+// describeInBatches calls describe on items split in batches of describeBatch, concurrently within the call slots
+// of the index, and returns every result. It fails as soon as one of the batches does.
+func describeInBatches[T any](ctx context.Context, idx *TaskIndex, items []string, describe func(context.Context, []string) ([]T, error)) ([]T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := slices.Collect(slices.Chunk(items, describeBatch))
+	results := make([][]T, len(batches))
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = withCallSlot(ctx, idx, func() ([]T, error) { return describe(ctx, batch) })
+			if errs[i] != nil {
+				cancel()
 			}
+		}()
+	}
+	wg.Wait()
+
+	// The first error caused the cancellation of the others
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
 		}
 	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return slices.Concat(results...), nil
+}
 
-	if len(taskDefArnsToCheck) == 0 {
-		log.Printf("No tasks using volume '%s' found in cluster %s", volumeToCheck, clusterName)
-		return
+// withCallSlot runs call once fewer than cfg.ECS.DescribeConcurrency AWS calls of the index are in flight, across
+// every cluster being scanned.
+func withCallSlot[T any](ctx context.Context, idx *TaskIndex, call func() (T, error)) (T, error) {
+	select {
+	case idx.callSlots <- struct{}{}:
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
 	}
+	defer func() { <-idx.callSlots }()
+	return call()
+}
 
-	// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-lifecycle-explanation.html
-	stillRunningTaskState := map[string]struct{}{
-		"RUNNING":   {},
-		"PENDING":   {},
-		"PROVISIONING":   {},
-		"ACTIVATING":   {},
-		"DEACTIVATING":   {},
-		"STOPPING":   {},
-		// "DEPROVISIONING":   {}, // I think this can be ignored
+// taskDefinition returns the task definition arn, describing it only the first time. Concurrent calls for the same
+// arn share one describe.
+func (idx *TaskIndex) taskDefinition(ctx context.Context, arn string) (*ecstypes.TaskDefinition, error) {
+	idx.defsMu.Lock()
+	if def, ok := idx.taskDefs[arn]; ok {
+		idx.defsMu.Unlock()
+		return def, nil
+	}
+	fetch, ok := idx.defsInFlight[arn]
+	if !ok {
+		fetch = &taskDefinitionFetch{done: make(chan struct{})}
+		idx.defsInFlight[arn] = fetch
 	}
+	idx.defsMu.Unlock()
 
-	for _, taskDefArn := range taskDefArnsToCheck {
-		// At the start of each iteration, check if a task that uses the volume was already found
-		mu.Lock()
-		if *volumeFound > 1 {
-			mu.Unlock()
-			return
+	if ok {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-fetch.done:
+			return fetch.def, fetch.err
+		}
+	}
+
+	defOutput, err := withCallSlot(ctx, idx, func() (*ecs.DescribeTaskDefinitionOutput, error) {
+		return idx.ecsClient.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{TaskDefinition: &arn})
+	})
+
+	idx.defsMu.Lock()
+	if err == nil {
+		fetch.def = defOutput.TaskDefinition
+		idx.taskDefs[arn] = defOutput.TaskDefinition
+	}
+	fetch.err = err
+	delete(idx.defsInFlight, arn)
+	idx.defsMu.Unlock()
+	close(fetch.done)
+	return fetch.def, err
+}
+
+// tasksUsingVolume returns the tasks whose task definition declares volumeToCheck, see volumeMatches.
+func (idx *TaskIndex) tasksUsingVolume(tasks []indexedTask, volumeToCheck string) []indexedTask {
+	idx.defsMu.Lock()
+	defer idx.defsMu.Unlock()
+
+	var users []indexedTask
+	for _, task := range tasks {
+		def, ok := idx.taskDefs[task.TaskDefinitionArn]
+		if !ok {
+			continue
 		}
-		mu.Unlock()
-		for _, task := range describedTasks.Tasks {
-			if *task.TaskDefinitionArn == taskDefArn {
-				if _, ok := stillRunningTaskState[*task.LastStatus]; ok {
-					// If the task is still in one of the state above, we can consider the volume in use
-					mu.Lock()
-					*volumeFound += 1
-					log.Printf("Volume '%s' is in use by task %s in cluster %s", volumeToCheck, *task.TaskArn, clusterName)
-					if *volumeFound > 1 {
-						mu.Unlock()
-						return
-					}
-					mu.Unlock()
-				}
+		for _, vol := range def.Volumes {
+			if volumeMatches(&idx.cfg.ECS, vol, volumeToCheck) {
+				users = append(users, task)
+				break
 			}
 		}
 	}
+	return users
 }
 
-func CheckForTasksWithVolumeInUse(volumeToCheck string, region string, availabilityZone string) (Status, error) {
-	log.Println("Starting check for tasks using volume: ", volumeToCheck)
-
-	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
-	if err != nil {
-		return ProcessingError, fmt.Errorf("error while creating AWS configuration: %v", err)
+// conflictingTasks returns the tasks using volumeToCheck other than callers, the tasks that are mounting it.
+func (idx *TaskIndex) conflictingTasks(tasks []indexedTask, volumeToCheck string, callers []string) []indexedTask {
+	var conflicts []indexedTask
+	for _, task := range idx.tasksUsingVolume(tasks, volumeToCheck) {
+		if !slices.Contains(callers, task.TaskArn) {
+			conflicts = append(conflicts, task)
+		}
 	}
+	return conflicts
+}
+
+// CheckForTasksWithVolumeInUse tells whether ECS tasks other than callers, the tasks mounting the volume, are
+// using volumeToCheck. The index answers from what it knows if that is recent enough; requireFresh rescans first,
+// for when a wrong answer would let the volume be taken from under a running task. Clusters that could not be
+// scanned fail the check with an *UnverifiedClustersError, unless cfg.ECS.ScanFailurePolicy is fail-open.
+func (idx *TaskIndex) CheckForTasksWithVolumeInUse(ctx context.Context, volumeToCheck string, callers []string, requireFresh bool) (_ Status, err error) {
+	ctx, span := startSpan(ctx, "CheckForTasksWithVolumeInUse", attribute.String("volume.id", volumeToCheck), attribute.Bool("index.require_fresh", requireFresh))
+	defer func() { endSpan(span, err) }()
 
-	ecsClient := ecs.NewFromConfig(cfg)
+	slog.InfoContext(ctx, "Starting check for tasks using volume", "callers", callers)
 
-	log.Println("List all clusters in AZ...")
-	clustersOutput, err := ecsClient.ListClusters(ctx, &ecs.ListClustersInput{})
+	maxAge := time.Duration(idx.cfg.ECS.IndexMaxStaleness)
+	if requireFresh {
+		maxAge = 0
+	}
+	scan, err := idx.snapshot(ctx, maxAge)
 	if err != nil {
-		return ProcessingError, fmt.Errorf("cannot list clusters: %v", err)
+		return ProcessingError, err
 	}
 
-	if len(clustersOutput.ClusterArns) == 0 {
-		log.Println("No clusters found in this AZ.")
-		return OK, nil
+	conflicts := idx.conflictingTasks(scan.tasks, volumeToCheck, callers)
+	if (len(conflicts) > 0 || len(scan.unverified) > 0) && !requireFresh {
+		// Refusing the mount matters as much, the tasks may have stopped or the clusters recovered since
+		slog.DebugContext(ctx, "Index reports the volume in use or clusters it could not scan, confirming with a refresh")
+		if scan, err = idx.snapshot(ctx, 0); err != nil {
+			return ProcessingError, err
+		}
+		conflicts = idx.conflictingTasks(scan.tasks, volumeToCheck, callers)
 	}
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	volumeFound := 0
-
-	// Check each cluster concurrently
-	for _, clusterArn := range clustersOutput.ClusterArns {
-		wg.Add(1)
-		go checkCluster(ctx, cfg, clusterArn, availabilityZone, &volumeFound, &mu, &wg, volumeToCheck)
+	if len(conflicts) > 0 {
+		users := make([]string, len(conflicts))
+		for i, task := range conflicts {
+			slog.InfoContext(ctx, "Volume is in use by task", "task", task.TaskArn, "cluster", task.Cluster, "ambiguity", task.Ambiguity)
+			users[i] = fmt.Sprintf("task %s in cluster %s", task.TaskArn, task.Cluster)
+			if task.Ambiguity != "" {
+				users[i] += fmt.Sprintf(" (which may run elsewhere, %s)", task.Ambiguity)
+			}
+		}
+		return VolumeInUseError, fmt.Errorf("volume '%s' is in use by %s", volumeToCheck, strings.Join(users, ", "))
 	}
 
-	wg.Wait() // Wait for all checks to finish
-
-	if volumeFound > 1 {
-		return VolumeInUseError, fmt.Errorf("volume '%s' is currently in use by task", volumeToCheck)
+	if len(scan.unverified) > 0 {
+		unverified := &UnverifiedClustersError{Clusters: scan.unverified}
+		if idx.cfg.ECS.ScanFailurePolicy == ScanFailOpen {
+			slog.WarnContext(ctx, "Ignoring clusters that could not be scanned, as the scan failure policy is fail-open", "error", unverified)
+			return OK, nil
+		}
+		return ProcessingError, unverified
 	}
 
 	return OK, nil
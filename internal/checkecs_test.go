@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+const testAZ = "eu-west-1a"
+
+func newTestTaskIndex(t *testing.T, fake *fakeaws.Server, cfg *Config) *TaskIndex {
+	t.Helper()
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	awsCfg := fakeaws.Config(server.URL)
+	return NewTaskIndex(cfg, ecs.NewFromConfig(awsCfg), ec2.NewFromConfig(awsCfg), testAZ)
+}
+
+// clusterFixture describes a cluster to populate a fake with.
+type clusterFixture struct {
+	name      string
+	tags      map[string]string
+	instances int
+	// tasksPerInstance run on every instance, using the task definitions in turn
+	tasksPerInstance int
+	taskDefs         []string
+}
+
+// add populates fake with the cluster and returns the ARNs of its tasks the index should report: those running on
+// instances in testAZ. Even instances are in testAZ, odd ones in eu-west-1b, and every fifth task is stopped.
+func (c clusterFixture) add(fake *fakeaws.Server) []string {
+	fake.AddCluster(c.name, c.tags)
+	var expected []string
+	n := 0
+	for i := range c.instances {
+		id := fmt.Sprintf("i-%s-%05d", c.name, i)
+		az := testAZ
+		if i%2 == 1 {
+			az = "eu-west-1b"
+		}
+		fake.AddInstance(fakeaws.Instance{ID: id, AvailabilityZone: az})
+		ciArn := fake.AddContainerInstance(c.name, fakeaws.ContainerInstance{EC2InstanceID: id, AgentConnected: true})
+		for range c.tasksPerInstance {
+			status := "RUNNING"
+			if n%5 == 4 {
+				status = "STOPPED"
+			}
+			arn := fake.AddTask(c.name, fakeaws.Task{
+				TaskDefinitionArn:    c.taskDefs[n%len(c.taskDefs)],
+				LastStatus:           status,
+				ContainerInstanceArn: ciArn,
+			})
+			if az == testAZ && status == "RUNNING" {
+				expected = append(expected, arn)
+			}
+			n++
+		}
+	}
+	return expected
+}
+
+func addTaskDefinitions(fake *fakeaws.Server, n int) []string {
+	var arns []string
+	for i := range n {
+		arns = append(arns, fake.AddTaskDefinition(fakeaws.TaskDefinition{
+			Family:  fmt.Sprintf("app-%d", i),
+			Volumes: []fakeaws.Volume{{Name: fmt.Sprintf("vol-%d", i), Driver: "polarity-ecs-ebs-plugin"}},
+		}))
+	}
+	return arns
+}
+
+// usedTaskDefinitions returns how many task definitions tasks run.
+func usedTaskDefinitions(tasks []indexedTask) int {
+	used := make(map[string]bool)
+	for _, task := range tasks {
+		used[task.TaskDefinitionArn] = true
+	}
+	return len(used)
+}
+
+func indexedArns(tasks []indexedTask) []string {
+	arns := make([]string, len(tasks))
+	for i, task := range tasks {
+		arns[i] = task.TaskArn
+	}
+	slices.Sort(arns)
+	return arns
+}
+
+func TestTaskIndexLargeCluster(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.Latency = 2 * time.Millisecond
+	defs := addTaskDefinitions(fake, 40)
+	expected := clusterFixture{name: "big", instances: 250, tasksPerInstance: 16, taskDefs: defs}.add(fake)
+
+	cfg := DefaultConfig()
+	cfg.ECS.DescribeConcurrency = 4
+	idx := newTestTaskIndex(t, fake, cfg)
+
+	scan, err := idx.snapshot(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(expected)
+	if got := indexedArns(scan.tasks); !slices.Equal(got, expected) {
+		t.Fatalf("expected %d tasks in the index, got %d", len(expected), len(got))
+	}
+
+	// 250 container instances and 4000 tasks, 100 per describe
+	for operation, calls := range map[string]int{
+		"DescribeContainerInstances": 3,
+		"DescribeInstances":          3,
+		"ListTasks":                  40,
+		"DescribeTasks":              40,
+		"DescribeTaskDefinition":     usedTaskDefinitions(scan.tasks),
+	} {
+		if got := fake.Calls(operation); got != calls {
+			t.Errorf("expected %d %s calls, got %d", calls, operation, got)
+		}
+	}
+	if inFlight := fake.MaxInFlight(); inFlight > cfg.ECS.DescribeConcurrency || inFlight < 2 {
+		t.Errorf("expected between 2 and %d calls in flight, got %d", cfg.ECS.DescribeConcurrency, inFlight)
+	}
+}
+
+func TestTaskIndexManyClusters(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 3)
+	var expected []string
+	for i := range 250 {
+		expected = append(expected, clusterFixture{name: fmt.Sprintf("cluster-%d", i), instances: 2, tasksPerInstance: 3, taskDefs: defs}.add(fake)...)
+	}
+
+	idx := newTestTaskIndex(t, fake, DefaultConfig())
+	scan, err := idx.snapshot(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(expected)
+	if got := indexedArns(scan.tasks); !slices.Equal(got, expected) {
+		t.Fatalf("expected %d tasks in the index, got %d", len(expected), len(got))
+	}
+	if calls := fake.Calls("ListClusters"); calls != 3 {
+		t.Errorf("expected 250 clusters to be listed in 3 pages, got %d calls", calls)
+	}
+	// Every cluster uses the same task definitions, they are described once for all of them
+	if calls, used := fake.Calls("DescribeTaskDefinition"), usedTaskDefinitions(scan.tasks); calls != used {
+		t.Errorf("expected %d DescribeTaskDefinition calls, got %d", used, calls)
+	}
+}
+
+func TestTaskIndexKeepsTaskDefinitions(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 5)
+	clusterFixture{name: "app", instances: 4, tasksPerInstance: 5, taskDefs: defs}.add(fake)
+
+	idx := newTestTaskIndex(t, fake, DefaultConfig())
+	var scan indexScan
+	for range 3 {
+		var err error
+		if scan, err = idx.snapshot(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := fake.Calls("DescribeTasks"); calls != 3 {
+		t.Errorf("expected every refresh to describe the tasks, got %d calls", calls)
+	}
+	if calls, used := fake.Calls("DescribeTaskDefinition"), usedTaskDefinitions(scan.tasks); calls != used {
+		t.Errorf("expected the %d task definitions to be described once, got %d calls", used, calls)
+	}
+}
+
+func TestTaskIndexClusterScope(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 1)
+	web := clusterFixture{name: "web", tags: map[string]string{"team": "web"}, instances: 2, tasksPerInstance: 2, taskDefs: defs}.add(fake)
+	data := clusterFixture{name: "data", tags: map[string]string{"team": "data"}, instances: 2, tasksPerInstance: 2, taskDefs: defs}.add(fake)
+	staging := clusterFixture{name: "staging", tags: map[string]string{"team": "data", "env": "staging"}, instances: 2, tasksPerInstance: 2, taskDefs: defs}.add(fake)
+
+	for _, tc := range []struct {
+		name     string
+		scope    string
+		clusters []string
+		tags     []string
+		expected []string
+	}{
+		{name: "all", scope: ClusterScopeAll, expected: slices.Concat(web, data, staging)},
+		{name: "list", scope: ClusterScopeList, clusters: []string{"data"}, expected: data},
+		{name: "tag value", scope: ClusterScopeAll, tags: []string{"team=data"}, expected: slices.Concat(data, staging)},
+		{name: "tag key", scope: ClusterScopeAll, tags: []string{"env"}, expected: staging},
+		{name: "list and tags", scope: ClusterScopeList, clusters: []string{"web", "data"}, tags: []string{"team=data"}, expected: data},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.ResetCalls()
+			cfg := DefaultConfig()
+			cfg.ECS.ClusterScope = tc.scope
+			cfg.ECS.Clusters = tc.clusters
+			cfg.ECS.ClusterTags = tc.tags
+			idx := newTestTaskIndex(t, fake, cfg)
+
+			scan, err := idx.snapshot(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(tc.expected)
+			if got := indexedArns(scan.tasks); !slices.Equal(got, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			if tc.scope == ClusterScopeList && fake.Calls("ListClusters") != 0 {
+				t.Error("the list scope should not list the clusters of the region")
+			}
+		})
+	}
+}
+
+func TestCheckForTasksWithVolumeInUse(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 2)
+	tasks := clusterFixture{name: "app", instances: 2, tasksPerInstance: 2, taskDefs: defs}.add(fake)
+	idx := newTestTaskIndex(t, fake, DefaultConfig())
+	ctx := context.Background()
+
+	// The tasks on the instance in testAZ alternate between the two task definitions, vol-0 is used by tasks[0]
+	status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-0", nil, false)
+	if status != VolumeInUseError {
+		t.Fatalf("expected vol-0 to be in use, got %v: %v", status, err)
+	}
+	if status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-0", tasks[:1], false); status != OK {
+		t.Fatalf("the calling task should not count as a user, got %v: %v", status, err)
+	}
+	if status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-9", nil, true); status != OK {
+		t.Fatalf("expected an unused volume to be free, got %v: %v", status, err)
+	}
+}
+
+func TestCheckForTasksWithVolumeInUseUnverifiedClusters(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 1)
+	clusterFixture{name: "healthy", instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+	clusterFixture{name: "broken", instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+	clusterFixture{name: "throttled", instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+	fake.Fail("DescribeTasks", "broken")
+	fake.Fail("ListContainerInstances", "throttled")
+	ctx := context.Background()
+
+	idx := newTestTaskIndex(t, fake, DefaultConfig())
+	status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-unused", nil, false)
+	var unverified *UnverifiedClustersError
+	if status != ProcessingError || !errors.As(err, &unverified) {
+		t.Fatalf("expected the check to fail closed, got %v: %v", status, err)
+	}
+	if got := slices.Sorted(maps.Keys(unverified.Clusters)); !slices.Equal(got, []string{ecsClusterArn("broken"), ecsClusterArn("throttled")}) {
+		t.Fatalf("expected the broken and throttled clusters to be unverified, got %v", got)
+	}
+	for _, name := range []string{"broken", "throttled"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected the error to name cluster %s: %v", name, err)
+		}
+	}
+
+	// A task using the volume in a cluster that could be scanned is reported as such
+	if status, _ := idx.CheckForTasksWithVolumeInUse(ctx, "vol-0", nil, false); status != VolumeInUseError {
+		t.Fatalf("expected vol-0 to be in use, got %v", status)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ECS.ScanFailurePolicy = ScanFailOpen
+	idx = newTestTaskIndex(t, fake, cfg)
+	if status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-unused", nil, false); status != OK {
+		t.Fatalf("expected the check to fail open, got %v: %v", status, err)
+	}
+
+	// Clusters that recover are verified again on the next refresh
+	fake.ClearFailures()
+	idx = newTestTaskIndex(t, fake, DefaultConfig())
+	if status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-unused", nil, false); status != OK {
+		t.Fatalf("expected the check to pass once every cluster is scanned, got %v: %v", status, err)
+	}
+}
+
+func ecsClusterArn(name string) string {
+	return "arn:aws:ecs:eu-west-1:123456789012:cluster/" + name
+}
+
+func TestTaskIndexMixedLaunchTypes(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 4)
+	fake.AddCluster("mixed", nil)
+	fake.AddCluster("serverless", nil)
+
+	containerInstance := func(id, az string) string {
+		return fake.AddContainerInstance("mixed", fakeaws.ContainerInstance{EC2InstanceID: id, AvailabilityZone: az, AgentConnected: true})
+	}
+	fake.AddInstance(fakeaws.Instance{ID: "i-a1", AvailabilityZone: testAZ})
+	fake.AddInstance(fakeaws.Instance{ID: "i-a2", AvailabilityZone: testAZ})
+	fake.AddInstance(fakeaws.Instance{ID: "i-b1", AvailabilityZone: "eu-west-1b"})
+	a1 := containerInstance("i-a1", testAZ)
+	// Older agents do not report the availability zone, it comes from EC2
+	a2 := containerInstance("i-a2", "")
+	b1 := containerInstance("i-b1", "")
+	// Instances already gone from EC2
+	gone := containerInstance("i-gone", "")
+	goneB := containerInstance("i-goneb", "")
+	anywhere := containerInstance("mi-0123456789abcdef0", "")
+
+	running := func(def int, task fakeaws.Task) string {
+		task.TaskDefinitionArn = defs[def]
+		task.LastStatus = "RUNNING"
+		return fake.AddTask("mixed", task)
+	}
+	onA1 := running(0, fakeaws.Task{ContainerInstanceArn: a1})
+	onA2 := running(1, fakeaws.Task{ContainerInstanceArn: a2})
+	running(0, fakeaws.Task{ContainerInstanceArn: b1})
+	onGone := running(2, fakeaws.Task{ContainerInstanceArn: gone})
+	running(2, fakeaws.Task{ContainerInstanceArn: goneB, AvailabilityZone: "eu-west-1b"})
+	running(0, fakeaws.Task{ContainerInstanceArn: anywhere, LaunchType: "EXTERNAL"})
+	running(0, fakeaws.Task{LaunchType: "FARGATE", AvailabilityZone: testAZ})
+	running(0, fakeaws.Task{CapacityProviderName: "FARGATE_SPOT", AvailabilityZone: testAZ})
+	orphan := running(3, fakeaws.Task{})
+	fake.AddTask("serverless", fakeaws.Task{TaskDefinitionArn: defs[0], LastStatus: "RUNNING", LaunchType: "FARGATE", AvailabilityZone: testAZ})
+
+	idx := newTestTaskIndex(t, fake, DefaultConfig())
+	scan, err := idx.snapshot(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.unverified) > 0 {
+		t.Fatalf("expected every cluster to be scanned, got %v", scan.unverified)
+	}
+
+	expected := []string{onA1, onA2, onGone, orphan}
+	slices.Sort(expected)
+	if got := indexedArns(scan.tasks); !slices.Equal(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for _, task := range scan.tasks {
+		ambiguous := task.TaskArn == onGone || task.TaskArn == orphan
+		if (task.Ambiguity != "") != ambiguous {
+			t.Errorf("task %s: expected ambiguous %v, got %q", task.TaskArn, ambiguous, task.Ambiguity)
+		}
+	}
+
+	ctx := context.Background()
+	status, err := idx.CheckForTasksWithVolumeInUse(ctx, "vol-0", nil, false)
+	if status != VolumeInUseError || strings.Count(err.Error(), "task ") != 1 || !strings.Contains(err.Error(), onA1) {
+		t.Fatalf("expected vol-0 to be used by %s only, got %v: %v", onA1, status, err)
+	}
+	status, err = idx.CheckForTasksWithVolumeInUse(ctx, "vol-2", nil, false)
+	if status != VolumeInUseError || !strings.Contains(err.Error(), "may run elsewhere") {
+		t.Fatalf("expected vol-2 to be reported as possibly used by %s, got %v: %v", onGone, status, err)
+	}
+}
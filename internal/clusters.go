@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Cluster scopes of the in-use check, see ECSConfig.ClusterScope.
+const (
+	ClusterScopeAll  = "all"
+	ClusterScopeList = "list"
+	ClusterScopeAuto = "auto"
+)
+
+// describeClustersBatch is the most clusters DescribeClusters accepts at once.
+const describeClustersBatch = 100
+
+// clusters returns the clusters the index scans: every cluster of the region, the configured ones or the one the
+// local ECS agent is registered to, narrowed down to those carrying cfg.ECS.ClusterTags. The clusters whose tags
+// cannot be read are returned apart, with the reason: they may be in scope.
+func (idx *TaskIndex) clusters(ctx context.Context) (_ []string, unverified map[string]error, err error) {
+	ctx, span := startSpan(ctx, "ListScopedClusters", attribute.String("ecs.cluster_scope", idx.cfg.ECS.ClusterScope))
+	defer func() { endSpan(span, err) }()
+
+	var clusters []string
+	switch idx.cfg.ECS.ClusterScope {
+	case ClusterScopeAll:
+		slog.DebugContext(ctx, "Listing all clusters")
+		paginator := ecs.NewListClustersPaginator(idx.ecsClient, &ecs.ListClustersInput{})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot list clusters: %v", err)
+			}
+			clusters = append(clusters, output.ClusterArns...)
+		}
+	case ClusterScopeList:
+		clusters = idx.cfg.ECS.Clusters
+	case ClusterScopeAuto:
+		cluster, err := idx.agentCluster(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		clusters = []string{cluster}
+	default:
+		return nil, nil, fmt.Errorf("unknown cluster scope %q", idx.cfg.ECS.ClusterScope)
+	}
+
+	if len(idx.cfg.ECS.ClusterTags) > 0 {
+		if clusters, unverified, err = idx.clustersWithTags(ctx, clusters); err != nil {
+			return nil, nil, err
+		}
+	}
+	span.SetAttributes(attribute.Int("ecs.clusters", len(clusters)))
+	return clusters, unverified, nil
+}
+
+// agentCluster asks the local ECS agent which cluster the instance is registered to.
+func (idx *TaskIndex) agentCluster(ctx context.Context) (string, error) {
+	var metadata struct {
+		Cluster string
+	}
+	if err := getJSON(ctx, idx.agent, idx.cfg.ECS.AgentEndpoint+"/v1/metadata", &metadata); err != nil {
+		return "", fmt.Errorf("cannot read the cluster of the instance from the ECS agent: %w", err)
+	}
+	if metadata.Cluster == "" {
+		return "", errors.New("the ECS agent is not registered to a cluster yet")
+	}
+	return metadata.Cluster, nil
+}
+
+// clustersWithTags returns the ARNs of the clusters that have every tag of cfg.ECS.ClusterTags, and the clusters
+// DescribeClusters failed for, which cannot be told out of scope.
+func (idx *TaskIndex) clustersWithTags(ctx context.Context, clusters []string) ([]string, map[string]error, error) {
+	var matching []string
+	unverified := make(map[string]error)
+	for batch := range slices.Chunk(clusters, describeClustersBatch) {
+		output, err := idx.ecsClient.DescribeClusters(ctx, &ecs.DescribeClustersInput{
+			Clusters: batch,
+			Include:  []ecstypes.ClusterField{ecstypes.ClusterFieldTags},
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot describe clusters: %v", err)
+		}
+		for _, failure := range output.Failures {
+			slog.WarnContext(ctx, "Cannot describe cluster", "cluster", aws.ToString(failure.Arn), "reason", aws.ToString(failure.Reason))
+			unverified[aws.ToString(failure.Arn)] = fmt.Errorf("cannot read the cluster tags: %s", aws.ToString(failure.Reason))
+		}
+		for _, cluster := range output.Clusters {
+			if hasClusterTags(cluster.Tags, idx.cfg.ECS.ClusterTags) {
+				matching = append(matching, aws.ToString(cluster.ClusterArn))
+			}
+		}
+	}
+	slog.DebugContext(ctx, "Filtered clusters by tags", "tags", idx.cfg.ECS.ClusterTags, "clusters", len(clusters), "matching", len(matching), "unverified", len(unverified))
+	return matching, unverified, nil
+}
+
+// hasClusterTags tells whether tags satisfy every filter, either "key=value" or "key" for any value.
+func hasClusterTags(tags []ecstypes.Tag, filters []string) bool {
+	for _, filter := range filters {
+		key, value, withValue := strings.Cut(filter, "=")
+		found := false
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == key && (!withValue || aws.ToString(tag.Value) == value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+func TestHasClusterTags(t *testing.T) {
+	tags := []ecstypes.Tag{
+		{Key: aws.String("team"), Value: aws.String("data")},
+		{Key: aws.String("env"), Value: aws.String("")},
+		{Key: aws.String("owner"), Value: aws.String("a=b")},
+	}
+	tests := []struct {
+		filters []string
+		want    bool
+	}{
+		{filters: nil, want: true},
+		{filters: []string{"team=data"}, want: true},
+		{filters: []string{"team"}, want: true},
+		{filters: []string{"team=web"}, want: false},
+		{filters: []string{"missing"}, want: false},
+		{filters: []string{"env"}, want: true},
+		{filters: []string{"env="}, want: true},
+		{filters: []string{"team=data", "env"}, want: true},
+		{filters: []string{"team=data", "missing"}, want: false},
+		// Only the first = separates the key from the value
+		{filters: []string{"owner=a=b"}, want: true},
+		{filters: []string{"Team=data"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := hasClusterTags(tags, tt.filters); got != tt.want {
+			t.Errorf("%v: expected %v, got %v", tt.filters, tt.want, got)
+		}
+	}
+	if hasClusterTags(nil, []string{"team"}) {
+		t.Error("expected a cluster without tags not to match a filter")
+	}
+}
+
+func TestTaskIndexAutoScope(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 1)
+	clusterFixture{name: "web", instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+	data := clusterFixture{name: "data", instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+
+	tests := []struct {
+		name     string
+		metadata string
+		status   int
+		expected []string
+		wantErr  string
+	}{
+		{name: "registered", metadata: `{"Cluster":"data","ContainerInstanceArn":"arn","Version":"Amazon ECS Agent - v1.80.0"}`, status: http.StatusOK, expected: data},
+		{name: "not registered yet", metadata: `{"Cluster":""}`, status: http.StatusOK, wantErr: "not registered to a cluster yet"},
+		{name: "agent failing", metadata: `{}`, status: http.StatusInternalServerError, wantErr: "cannot read the cluster of the instance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/metadata" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.metadata))
+			}))
+			t.Cleanup(agent.Close)
+			fake.ResetCalls()
+			cfg := DefaultConfig()
+			cfg.ECS.ClusterScope = ClusterScopeAuto
+			cfg.ECS.AgentEndpoint = agent.URL
+			idx := newTestTaskIndex(t, fake, cfg)
+
+			scan, err := idx.snapshot(context.Background(), 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(tt.expected)
+			if got := indexedArns(scan.tasks); !slices.Equal(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+			if fake.Calls("ListClusters") != 0 {
+				t.Error("the auto scope should not list the clusters of the region")
+			}
+		})
+	}
+}
+
+func TestTaskIndexClusterTagsFailures(t *testing.T) {
+	fake := fakeaws.NewServer()
+	defs := addTaskDefinitions(fake, 1)
+	data := clusterFixture{name: "data", tags: map[string]string{"team": "data"}, instances: 2, tasksPerInstance: 1, taskDefs: defs}.add(fake)
+	cfg := DefaultConfig()
+	cfg.ECS.ClusterScope = ClusterScopeList
+	cfg.ECS.Clusters = []string{"data", "gone"}
+	cfg.ECS.ClusterTags = []string{"team=data"}
+	idx := newTestTaskIndex(t, fake, cfg)
+
+	scan, err := idx.snapshot(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(data)
+	if got := indexedArns(scan.tasks); !slices.Equal(got, data) {
+		t.Fatalf("expected %v, got %v", data, got)
+	}
+	// A cluster whose tags cannot be read may be in scope, it is not dropped silently
+	if got := slices.Collect(maps.Keys(scan.unverified)); len(got) != 1 || !strings.HasSuffix(got[0], "gone") {
+		t.Fatalf("expected the gone cluster to be unverified, got %v", got)
+	}
+
+	status, err := idx.CheckForTasksWithVolumeInUse(context.Background(), "vol-unused", nil, false)
+	var unverified *UnverifiedClustersError
+	if status != ProcessingError || !errors.As(err, &unverified) || !strings.Contains(err.Error(), "cannot read the cluster tags") {
+		t.Fatalf("expected the check to fail closed on the gone cluster, got %v: %v", status, err)
+	}
+}
@@ -0,0 +1,610 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a Go duration string ("1s", "500ms") in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type LogConfig struct {
+	Level          string `json:"level"`
+	File           string `json:"file"`
+	FileMaxSizeMB  int    `json:"fileMaxSizeMB"`
+	FileMaxAgeDays int    `json:"fileMaxAgeDays"`
+	FileMaxBackups int    `json:"fileMaxBackups"`
+}
+
+type TraceConfig struct {
+	// Exporter is "otlp", "file" or "none". When empty, "otlp" is used if an OTLP endpoint is set and "none"
+	// otherwise.
+	Exporter string `json:"exporter"`
+	File     string `json:"file"`
+}
+
+type DeviceConfig struct {
+	// Pool lists the device names handed to AttachVolume, in order of preference.
+	Pool []string `json:"pool"`
+	// RescanInterval is how often /sys/block is scanned while waiting for the block device of a volume. The wait
+	// is driven by the kernel device events, the scan only catches the ones that were missed.
+	RescanInterval Duration `json:"rescanInterval"`
+	// SysBlock, DiskByIDDir and Dev are where the block devices, their udev links by ID and their nodes are looked
+	// up. They only change to point the plugin at a fake sysfs, as the end-to-end tests do.
+	SysBlock    string `json:"sysBlock"`
+	DiskByIDDir string `json:"diskByIdDir"`
+	Dev         string `json:"dev"`
+}
+
+// DockerMountTimeout is how long Docker waits for the answer to a Mount before it gives up on the plugin.
+const DockerMountTimeout = 2 * time.Minute
+
+// MountTimeout is the deadline of a Mount as a whole, every phase and the rollback of a failed attach included. It
+// leaves Docker the time to read the answer. The waits a Mount may go through, LockTimeout and the TimeoutConfig
+// ones with the detach counted twice for the rollback, must add up to less.
+const MountTimeout = DockerMountTimeout - 5*time.Second
+
+type TimeoutConfig struct {
+	// Available bounds the wait for a volume that is being created or detached by someone else.
+	Available Duration `json:"available"`
+	// Detach bounds the wait for a detach to complete, forced or not.
+	Detach Duration `json:"detach"`
+	// ForceDetachAfter is how long a detach may stay pending before it is forced. Zero never forces it.
+	ForceDetachAfter Duration `json:"forceDetachAfter"`
+	// Attach bounds the wait for an attachment to complete and its block device to show up, before it is rolled back.
+	Attach Duration `json:"attach"`
+}
+
+type FencingConfig struct {
+	// GracePeriod is how long the instance holding a volume must have been unreachable before the volume is
+	// taken from it.
+	GracePeriod Duration `json:"gracePeriod"`
+}
+
+type LeaseConfig struct {
+	// Backend keeps the ownership leases of the volumes: "none", "tags" or "dynamodb".
+	Backend string `json:"backend"`
+	// TTL is how long a lease lasts without being renewed. It is renewed every third of that while mounted.
+	TTL Duration `json:"ttl"`
+	// Table is the DynamoDB table of the dynamodb backend, keyed by the string VolumeId.
+	Table string `json:"table"`
+	// DynamoDBEndpoint overrides the DynamoDB endpoint, for a local stand-in.
+	DynamoDBEndpoint string `json:"dynamoDBEndpoint"`
+	// TagSettle is how long the tags backend waits before checking that its lease write won.
+	TagSettle Duration `json:"tagSettle"`
+}
+
+// AWSConfig tunes the AWS clients shared by the whole plugin.
+type AWSConfig struct {
+	// RetryMode is "adaptive", which also slows the calls down while AWS throttles them, or "standard".
+	RetryMode string `json:"retryMode"`
+	// MaxAttempts is how many times an AWS call is tried before its error is returned.
+	MaxAttempts int `json:"maxAttempts"`
+	// MaxBackoff caps the wait between two attempts.
+	MaxBackoff Duration `json:"maxBackoff"`
+	// ConnectTimeout bounds connecting to AWS, TLS handshake included.
+	ConnectTimeout Duration `json:"connectTimeout"`
+	// RequestTimeout bounds each attempt of an AWS call.
+	RequestTimeout Duration `json:"requestTimeout"`
+	// Endpoint overrides the endpoint of every AWS service, for a stand-in such as the fake of internal/fakeaws.
+	// lease.dynamoDBEndpoint still wins for DynamoDB.
+	Endpoint string `json:"endpoint"`
+}
+
+type IMDSConfig struct {
+	// Endpoint overrides the address of the instance metadata service, for a stand-in.
+	Endpoint string `json:"endpoint"`
+	// EndpointMode picks the address of the service when Endpoint is empty: "ipv4" for 169.254.169.254, or "ipv6"
+	// for fd00:ec2::254 on instances that only have IPv6.
+	EndpointMode string `json:"endpointMode"`
+	// AllowV1 falls back to IMDSv1 requests, without a session token, when no token can be obtained. IMDSv1 can be
+	// reached by anything that tricks the host into sending a GET, so it stays off unless the instance needs it.
+	AllowV1 bool `json:"allowV1"`
+	// Timeout bounds each attempt of a request to the service.
+	Timeout Duration `json:"timeout"`
+	// MaxAttempts is how many times a request is tried before its error is returned.
+	MaxAttempts int `json:"maxAttempts"`
+}
+
+type ECSConfig struct {
+	// RunningTaskStates are the task states in which a task is considered to hold its volumes.
+	RunningTaskStates []string `json:"runningTaskStates"`
+	// ClusterScope is which clusters the in-use check scans: "all" the clusters of the region, the "list" of
+	// Clusters, or "auto" for the cluster the local ECS agent is registered to.
+	ClusterScope string `json:"clusterScope"`
+	// Clusters are the names or ARNs of the clusters scanned by the list scope.
+	Clusters []string `json:"clusters"`
+	// ClusterTags keeps only the clusters that have all of these tags, given as "key=value" or "key" for any value.
+	ClusterTags []string `json:"clusterTags"`
+	// AgentEndpoint is the introspection API of the local ECS agent.
+	AgentEndpoint string `json:"agentEndpoint"`
+	// DockerSocket is the Docker Engine API socket, used to find the task a container being mounted belongs to.
+	DockerSocket string `json:"dockerSocket"`
+	// VolumeDrivers are the names task definitions give this plugin as the driver of their Docker volumes. Volumes
+	// of other drivers are never taken as using a volume of the plugin. Empty accepts any driver, which can only be
+	// set in the config file since an empty ECS_VOLUME_DRIVERS keeps the default.
+	VolumeDrivers []string `json:"volumeDrivers"`
+	// VolumeMatchKeys are where a Docker volume of a task definition may carry the id of the EBS volume: "name" for
+	// the name of the volume, "driverOpts.<option>" and "labels.<label>" for its driver options and labels.
+	VolumeMatchKeys []string `json:"volumeMatchKeys"`
+	// ScanFailurePolicy is what Mount does when some clusters could not be scanned: "fail-closed" refuses the
+	// volume, "fail-open" goes on as if they had no task using it.
+	ScanFailurePolicy string `json:"scanFailurePolicy"`
+	// DescribeConcurrency is how many ECS and EC2 calls the index makes at once while scanning the clusters.
+	DescribeConcurrency int `json:"describeConcurrency"`
+	// IndexRefreshInterval is how often the index of the tasks that use volumes is refreshed in the background.
+	IndexRefreshInterval Duration `json:"indexRefreshInterval"`
+	// IndexMaxStaleness is how old the index may be when Mount asks it about a volume. Older answers are refreshed
+	// first, and so is any answer that would let Mount take a volume from another instance.
+	IndexMaxStaleness Duration `json:"indexMaxStaleness"`
+}
+
+// Config holds every setting of the plugin. It is built by LoadConfig from the defaults, an optional JSON file and
+// environment variables, which is also how Docker plugin settings reach the plugin.
+type Config struct {
+	SockPath string `json:"sockPath"`
+	// StateDir holds the files the plugin keeps across restarts. It must be on a host mount, such as the
+	// propagatedMount, since the plugin rootfs is replaced on every upgrade.
+	StateDir string `json:"stateDir"`
+	// ShutdownTimeout is how long running operations are given to finish once the plugin is asked to stop.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// LockTimeout is how long an operation waits for the ones already running on the same volume.
+	LockTimeout Duration `json:"lockTimeout"`
+	// MountRoot is where volumes are mounted. It must be inside the propagatedMount of the plugin config.json.
+	MountRoot string `json:"mountRoot"`
+
+	// Region, AvailabilityZone and InstanceID override the values read from the instance metadata service, which is
+	// not called at all when the three are set.
+	Region           string `json:"region"`
+	AvailabilityZone string `json:"availabilityZone"`
+	InstanceID       string `json:"instanceId"`
+
+	// VolumePollInterval is how often the state of a volume is polled while waiting for it to change.
+	VolumePollInterval Duration `json:"volumePollInterval"`
+
+	Timeouts TimeoutConfig `json:"timeouts"`
+	Device   DeviceConfig  `json:"device"`
+	Fencing  FencingConfig `json:"fencing"`
+	Lease    LeaseConfig   `json:"lease"`
+	AWS      AWSConfig     `json:"aws"`
+	IMDS     IMDSConfig    `json:"imds"`
+	ECS      ECSConfig     `json:"ecs"`
+	Log      LogConfig     `json:"log"`
+	Trace    TraceConfig   `json:"trace"`
+}
+
+// DefaultConfig returns the settings used when nothing is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		SockPath:           "/run/docker/plugins/pl-ebs.sock",
+		StateDir:           "/mnt/.state",
+		ShutdownTimeout:    Duration(30 * time.Second),
+		LockTimeout:        Duration(10 * time.Second),
+		MountRoot:          "/mnt",
+		VolumePollInterval: Duration(time.Second),
+		Timeouts: TimeoutConfig{
+			Available:        Duration(20 * time.Second),
+			Detach:           Duration(30 * time.Second),
+			ForceDetachAfter: Duration(15 * time.Second),
+			Attach:           Duration(20 * time.Second),
+		},
+		Device: DeviceConfig{
+			Pool:           defaultDevicePool(),
+			RescanInterval: Duration(2 * time.Second),
+			SysBlock:       "/sys/block",
+			DiskByIDDir:    "/dev/disk/by-id",
+			Dev:            "/dev",
+		},
+		Fencing: FencingConfig{
+			GracePeriod: Duration(5 * time.Minute),
+		},
+		Lease: LeaseConfig{
+			Backend:   "none",
+			TTL:       Duration(time.Minute),
+			TagSettle: Duration(2 * time.Second),
+		},
+		AWS: AWSConfig{
+			RetryMode:      "adaptive",
+			MaxAttempts:    5,
+			MaxBackoff:     Duration(20 * time.Second),
+			ConnectTimeout: Duration(5 * time.Second),
+			RequestTimeout: Duration(30 * time.Second),
+		},
+		IMDS: IMDSConfig{
+			EndpointMode: IMDSEndpointModeIPv4,
+			Timeout:      Duration(2 * time.Second),
+			MaxAttempts:  3,
+		},
+		ECS: ECSConfig{
+			// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-lifecycle-explanation.html
+			// DEPROVISIONING is left out: the containers are already stopped at that point
+			RunningTaskStates:    []string{"RUNNING", "PENDING", "PROVISIONING", "ACTIVATING", "DEACTIVATING", "STOPPING"},
+			ClusterScope:         ClusterScopeAll,
+			AgentEndpoint:        "http://localhost:51678",
+			DockerSocket:         "/var/run/docker.sock",
+			VolumeDrivers:        []string{"polarity-ecs-ebs-plugin"},
+			VolumeMatchKeys:      []string{"name", "driverOpts.volumeId", "labels.Name"},
+			ScanFailurePolicy:    ScanFailClosed,
+			DescribeConcurrency:  8,
+			IndexRefreshInterval: Duration(30 * time.Second),
+			IndexMaxStaleness:    Duration(time.Minute),
+		},
+		Log: LogConfig{
+			Level:          "info",
+			FileMaxSizeMB:  10,
+			FileMaxAgeDays: 7,
+			FileMaxBackups: 5,
+		},
+		Trace: TraceConfig{
+			File: "/logging/polarity-ecs-ebs-traces.json",
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, then the JSON file named by CONFIG_FILE (if any), then the
+// environment variables, and validates the result.
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path := strings.TrimSpace(os.Getenv("CONFIG_FILE")); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadEnv() error {
+	envString("SOCK_PATH", &cfg.SockPath)
+	envString("STATE_DIR", &cfg.StateDir)
+	envString("MOUNT_ROOT", &cfg.MountRoot)
+	envString("REGION", &cfg.Region)
+	envString("AVAILABILITY_ZONE", &cfg.AvailabilityZone)
+	envString("INSTANCE_ID", &cfg.InstanceID)
+	envList("DEVICE_POOL", &cfg.Device.Pool)
+	envString("DEVICE_SYS_BLOCK", &cfg.Device.SysBlock)
+	envString("DEVICE_BY_ID_DIR", &cfg.Device.DiskByIDDir)
+	envString("DEVICE_DEV_DIR", &cfg.Device.Dev)
+	envList("RUNNING_TASK_STATES", &cfg.ECS.RunningTaskStates)
+	envString("LOG_LEVEL", &cfg.Log.Level)
+	envString("LOG_FILE", &cfg.Log.File)
+	envString("TRACES_EXPORTER", &cfg.Trace.Exporter)
+	envString("TRACES_FILE", &cfg.Trace.File)
+	envString("AWS_RETRY_MODE", &cfg.AWS.RetryMode)
+	envString("AWS_ENDPOINT", &cfg.AWS.Endpoint)
+	envString("IMDS_ENDPOINT", &cfg.IMDS.Endpoint)
+	envString("IMDS_ENDPOINT_MODE", &cfg.IMDS.EndpointMode)
+	envString("ECS_CLUSTER_SCOPE", &cfg.ECS.ClusterScope)
+	envList("ECS_CLUSTERS", &cfg.ECS.Clusters)
+	envList("ECS_CLUSTER_TAGS", &cfg.ECS.ClusterTags)
+	envList("ECS_VOLUME_DRIVERS", &cfg.ECS.VolumeDrivers)
+	envList("ECS_VOLUME_MATCH_KEYS", &cfg.ECS.VolumeMatchKeys)
+	envString("ECS_SCAN_FAILURE_POLICY", &cfg.ECS.ScanFailurePolicy)
+	envString("ECS_AGENT_ENDPOINT", &cfg.ECS.AgentEndpoint)
+	envString("DOCKER_SOCKET", &cfg.ECS.DockerSocket)
+	envString("LEASE_BACKEND", &cfg.Lease.Backend)
+	envString("LEASE_TABLE", &cfg.Lease.Table)
+	envString("LEASE_DYNAMODB_ENDPOINT", &cfg.Lease.DynamoDBEndpoint)
+
+	return errors.Join(
+		envDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout),
+		envDuration("LOCK_TIMEOUT", &cfg.LockTimeout),
+		envDuration("VOLUME_POLL_INTERVAL", &cfg.VolumePollInterval),
+		envDuration("AVAILABLE_TIMEOUT", &cfg.Timeouts.Available),
+		envDuration("DETACH_TIMEOUT", &cfg.Timeouts.Detach),
+		envDuration("FORCE_DETACH_AFTER", &cfg.Timeouts.ForceDetachAfter),
+		envDuration("ATTACH_TIMEOUT", &cfg.Timeouts.Attach),
+		envDuration("DEVICE_RESCAN_INTERVAL", &cfg.Device.RescanInterval),
+		envDuration("FENCE_GRACE_PERIOD", &cfg.Fencing.GracePeriod),
+		envDuration("LEASE_TTL", &cfg.Lease.TTL),
+		envDuration("ECS_INDEX_REFRESH_INTERVAL", &cfg.ECS.IndexRefreshInterval),
+		envDuration("ECS_INDEX_MAX_STALENESS", &cfg.ECS.IndexMaxStaleness),
+		envDuration("LEASE_TAG_SETTLE", &cfg.Lease.TagSettle),
+		envInt("AWS_MAX_ATTEMPTS", &cfg.AWS.MaxAttempts),
+		envDuration("AWS_MAX_BACKOFF", &cfg.AWS.MaxBackoff),
+		envDuration("AWS_CONNECT_TIMEOUT", &cfg.AWS.ConnectTimeout),
+		envDuration("AWS_REQUEST_TIMEOUT", &cfg.AWS.RequestTimeout),
+		envBool("IMDS_ALLOW_V1", &cfg.IMDS.AllowV1),
+		envDuration("IMDS_TIMEOUT", &cfg.IMDS.Timeout),
+		envInt("IMDS_MAX_ATTEMPTS", &cfg.IMDS.MaxAttempts),
+		envInt("ECS_DESCRIBE_CONCURRENCY", &cfg.ECS.DescribeConcurrency),
+		envInt("LOG_FILE_MAX_SIZE_MB", &cfg.Log.FileMaxSizeMB),
+		envInt("LOG_FILE_MAX_AGE_DAYS", &cfg.Log.FileMaxAgeDays),
+		envInt("LOG_FILE_MAX_BACKUPS", &cfg.Log.FileMaxBackups),
+	)
+}
+
+// defaultDevicePool lists /dev/sdf to /dev/sdz, the names AWS recommends for EBS volumes, followed by /dev/xvdaa to
+// /dev/xvdaz for instances that take more volumes than that.
+func defaultDevicePool() []string {
+	var pool []string
+	for c := 'f'; c <= 'z'; c++ {
+		pool = append(pool, "/dev/sd"+string(c))
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		pool = append(pool, "/dev/xvda"+string(c))
+	}
+	return pool
+}
+
+// Validate reports every setting that has an unusable value.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.SockPath == "" {
+		errs = append(errs, errors.New("sockPath cannot be empty"))
+	}
+	if cfg.StateDir == "" {
+		errs = append(errs, errors.New("stateDir cannot be empty"))
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdownTimeout cannot be negative"))
+	}
+	if cfg.LockTimeout < 0 {
+		errs = append(errs, errors.New("lockTimeout cannot be negative"))
+	}
+	if !filepath.IsAbs(cfg.MountRoot) {
+		errs = append(errs, fmt.Errorf("mountRoot must be an absolute path, got %q", cfg.MountRoot))
+	}
+	if cfg.VolumePollInterval <= 0 {
+		errs = append(errs, errors.New("volumePollInterval must be positive"))
+	}
+
+	if cfg.Timeouts.Available <= 0 || cfg.Timeouts.Detach <= 0 || cfg.Timeouts.Attach <= 0 {
+		errs = append(errs, errors.New("timeouts.available, timeouts.detach and timeouts.attach must be positive"))
+	}
+	if cfg.Timeouts.ForceDetachAfter < 0 {
+		errs = append(errs, errors.New("timeouts.forceDetachAfter cannot be negative"))
+	}
+	// the detach counts twice, once from the holder and once more for the rollback of an attach that did not complete
+	if total := cfg.LockTimeout + cfg.Timeouts.Available + 2*cfg.Timeouts.Detach + cfg.Timeouts.Attach; time.Duration(total) >= MountTimeout {
+		errs = append(errs, fmt.Errorf("lockTimeout, timeouts.available, twice timeouts.detach and timeouts.attach add up to %s, a Mount must fit in %s", time.Duration(total), MountTimeout))
+	}
+
+	if len(cfg.Device.Pool) == 0 {
+		errs = append(errs, errors.New("device.pool cannot be empty"))
+	}
+	seen := make(map[string]bool)
+	for _, device := range cfg.Device.Pool {
+		if !strings.HasPrefix(device, "/dev/") {
+			errs = append(errs, fmt.Errorf("device.pool entry %q must start with /dev/", device))
+		}
+		if seen[device] {
+			errs = append(errs, fmt.Errorf("device.pool entry %q is listed more than once", device))
+		}
+		seen[device] = true
+	}
+	if cfg.Device.RescanInterval <= 0 {
+		errs = append(errs, errors.New("device.rescanInterval must be positive"))
+	}
+	if cfg.Device.SysBlock == "" || cfg.Device.DiskByIDDir == "" || cfg.Device.Dev == "" {
+		errs = append(errs, errors.New("device.sysBlock, device.diskByIdDir and device.dev cannot be empty"))
+	}
+
+	if cfg.Fencing.GracePeriod < 0 {
+		errs = append(errs, errors.New("fencing.gracePeriod cannot be negative"))
+	}
+
+	switch cfg.Lease.Backend {
+	case "none", "tags":
+	case "dynamodb":
+		if cfg.Lease.Table == "" {
+			errs = append(errs, errors.New("lease.table is required by the dynamodb lease backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("lease.backend must be none, tags or dynamodb, got %q", cfg.Lease.Backend))
+	}
+	if cfg.Lease.TTL < Duration(3*time.Second) {
+		errs = append(errs, errors.New("lease.ttl must be at least 3s"))
+	}
+	if cfg.Lease.TagSettle < 0 {
+		errs = append(errs, errors.New("lease.tagSettle cannot be negative"))
+	}
+
+	if cfg.AWS.RetryMode != "adaptive" && cfg.AWS.RetryMode != "standard" {
+		errs = append(errs, fmt.Errorf("aws.retryMode must be adaptive or standard, got %q", cfg.AWS.RetryMode))
+	}
+	if cfg.AWS.MaxAttempts < 1 {
+		errs = append(errs, errors.New("aws.maxAttempts must be at least 1"))
+	}
+	if cfg.AWS.MaxBackoff <= 0 {
+		errs = append(errs, errors.New("aws.maxBackoff must be positive"))
+	}
+	if cfg.AWS.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("aws.connectTimeout must be positive"))
+	}
+	if cfg.AWS.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("aws.requestTimeout must be positive"))
+	}
+	if cfg.AWS.Endpoint != "" {
+		if u, err := url.Parse(cfg.AWS.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("aws.endpoint must be an http or https URL, got %q", cfg.AWS.Endpoint))
+		}
+	}
+
+	if cfg.IMDS.Endpoint != "" {
+		if u, err := url.Parse(cfg.IMDS.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("imds.endpoint must be an http or https URL, got %q", cfg.IMDS.Endpoint))
+		}
+	}
+	if cfg.IMDS.EndpointMode != IMDSEndpointModeIPv4 && cfg.IMDS.EndpointMode != IMDSEndpointModeIPv6 {
+		errs = append(errs, fmt.Errorf("imds.endpointMode must be ipv4 or ipv6, got %q", cfg.IMDS.EndpointMode))
+	}
+	if cfg.IMDS.Timeout <= 0 {
+		errs = append(errs, errors.New("imds.timeout must be positive"))
+	}
+	if cfg.IMDS.MaxAttempts < 1 {
+		errs = append(errs, errors.New("imds.maxAttempts must be at least 1"))
+	}
+
+	if len(cfg.ECS.RunningTaskStates) == 0 {
+		errs = append(errs, errors.New("ecs.runningTaskStates cannot be empty"))
+	}
+	switch cfg.ECS.ClusterScope {
+	case ClusterScopeAll, ClusterScopeAuto:
+	case ClusterScopeList:
+		if len(cfg.ECS.Clusters) == 0 {
+			errs = append(errs, errors.New("ecs.clusters is required by the list cluster scope"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("ecs.clusterScope must be all, list or auto, got %q", cfg.ECS.ClusterScope))
+	}
+	for _, filter := range cfg.ECS.ClusterTags {
+		if key, _, _ := strings.Cut(filter, "="); key == "" {
+			errs = append(errs, fmt.Errorf("ecs.clusterTags entry %q has no tag key", filter))
+		}
+	}
+	if u, err := url.Parse(cfg.ECS.AgentEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("ecs.agentEndpoint must be an http or https URL, got %q", cfg.ECS.AgentEndpoint))
+	}
+	if cfg.ECS.DockerSocket == "" {
+		errs = append(errs, errors.New("ecs.dockerSocket cannot be empty"))
+	}
+	if len(cfg.ECS.VolumeMatchKeys) == 0 {
+		errs = append(errs, errors.New("ecs.volumeMatchKeys cannot be empty"))
+	}
+	for _, key := range cfg.ECS.VolumeMatchKeys {
+		if err := validateVolumeMatchKey(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.ECS.ScanFailurePolicy != ScanFailClosed && cfg.ECS.ScanFailurePolicy != ScanFailOpen {
+		errs = append(errs, fmt.Errorf("ecs.scanFailurePolicy must be fail-closed or fail-open, got %q", cfg.ECS.ScanFailurePolicy))
+	}
+	if cfg.ECS.DescribeConcurrency < 1 {
+		errs = append(errs, errors.New("ecs.describeConcurrency must be at least 1"))
+	}
+	if cfg.ECS.IndexRefreshInterval <= 0 {
+		errs = append(errs, errors.New("ecs.indexRefreshInterval must be positive"))
+	}
+	if cfg.ECS.IndexMaxStaleness < 0 {
+		errs = append(errs, errors.New("ecs.indexMaxStaleness cannot be negative"))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if cfg.Log.FileMaxSizeMB < 1 {
+		errs = append(errs, errors.New("log.fileMaxSizeMB must be at least 1"))
+	}
+	if cfg.Log.FileMaxAgeDays < 0 || cfg.Log.FileMaxBackups < 0 {
+		errs = append(errs, errors.New("log.fileMaxAgeDays and log.fileMaxBackups cannot be negative"))
+	}
+
+	switch cfg.Trace.Exporter {
+	case "", "otlp", "file", "none":
+	default:
+		errs = append(errs, fmt.Errorf("trace.exporter must be otlp, file or none, got %q", cfg.Trace.Exporter))
+	}
+	if cfg.Trace.Exporter == "file" && cfg.Trace.File == "" {
+		errs = append(errs, errors.New("trace.file cannot be empty with the file exporter"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// MountPath returns the directory where volume is mounted.
+func (cfg *Config) MountPath(volume string) string {
+	return filepath.Join(cfg.MountRoot, volume)
+}
+
+func envString(name string, target *string) {
+	if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+		*target = value
+	}
+}
+
+// envList sets target to the comma separated items of the variable name. An empty variable leaves target as it is,
+// like for the other settings: Docker passes every variable declared in the plugin config.json, with an empty value
+// for those that were never set, so an empty list can only be given in the config file.
+func envList(name string, target *[]string) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return
+	}
+	var list []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*target = list
+}
+
+func envBool(name string, target *bool) error {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	*target = b
+	return nil
+}
+
+func envInt(name string, target *int) error {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	*target = n
+	return nil
+}
+
+func envDuration(name string, target *Duration) error {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	*target = Duration(d)
+	return nil
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig runs LoadConfig with file as the config file, when not empty, and env set on top of the
+// environment of the test.
+func loadTestConfig(t *testing.T, file string, env map[string]string) (*Config, error) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	return LoadConfig()
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		// want changes the defaults into the expected configuration
+		want func(cfg *Config)
+	}{
+		{name: "defaults", want: func(*Config) {}},
+		{
+			name: "file",
+			file: `{"sockPath": "/run/file.sock", "lockTimeout": "12s", "device": {"pool": ["/dev/sdx"]}, "aws": {"maxAttempts": 7}, "imds": {"allowV1": true}}`,
+			want: func(cfg *Config) {
+				cfg.SockPath = "/run/file.sock"
+				cfg.LockTimeout = Duration(12 * time.Second)
+				cfg.Device.Pool = []string{"/dev/sdx"}
+				cfg.AWS.MaxAttempts = 7
+				cfg.IMDS.AllowV1 = true
+			},
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"SOCK_PATH": "/run/env.sock", "LOCK_TIMEOUT": "5s", "DEVICE_POOL": "/dev/sdy, /dev/sdz", "AWS_MAX_ATTEMPTS": "9", "IMDS_ALLOW_V1": "true"},
+			want: func(cfg *Config) {
+				cfg.SockPath = "/run/env.sock"
+				cfg.LockTimeout = Duration(5 * time.Second)
+				cfg.Device.Pool = []string{"/dev/sdy", "/dev/sdz"}
+				cfg.AWS.MaxAttempts = 9
+				cfg.IMDS.AllowV1 = true
+			},
+		},
+		{
+			name: "environment over file",
+			file: `{"sockPath": "/run/file.sock", "lockTimeout": "12s", "device": {"pool": ["/dev/sdx"]}, "aws": {"maxAttempts": 7}, "imds": {"allowV1": true}}`,
+			env:  map[string]string{"SOCK_PATH": "/run/env.sock", "LOCK_TIMEOUT": "5s", "DEVICE_POOL": "/dev/sdy", "AWS_MAX_ATTEMPTS": "9", "IMDS_ALLOW_V1": "false"},
+			want: func(cfg *Config) {
+				cfg.SockPath = "/run/env.sock"
+				cfg.LockTimeout = Duration(5 * time.Second)
+				cfg.Device.Pool = []string{"/dev/sdy"}
+				cfg.AWS.MaxAttempts = 9
+			},
+		},
+		{
+			// Docker passes every variable of the plugin, the ones never set are empty
+			name: "empty environment keeps the file",
+			file: `{"sockPath": "/run/file.sock", "lockTimeout": "12s", "ecs": {"volumeDrivers": []}}`,
+			env:  map[string]string{"SOCK_PATH": "", "LOCK_TIMEOUT": " ", "ECS_VOLUME_DRIVERS": "", "DEVICE_POOL": ""},
+			want: func(cfg *Config) {
+				cfg.SockPath = "/run/file.sock"
+				cfg.LockTimeout = Duration(12 * time.Second)
+				cfg.ECS.VolumeDrivers = []string{}
+			},
+		},
+		{
+			name: "list items are trimmed",
+			env:  map[string]string{"ECS_CLUSTERS": " a,, b ,", "ECS_CLUSTER_SCOPE": "list"},
+			want: func(cfg *Config) {
+				cfg.ECS.Clusters = []string{"a", "b"}
+				cfg.ECS.ClusterScope = ClusterScopeList
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.file, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := DefaultConfig()
+			tt.want(want)
+			if !reflect.DeepEqual(cfg, want) {
+				t.Fatalf("expected\n%+v\ngot\n%+v", want, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalidValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "duration without unit", env: map[string]string{"LOCK_TIMEOUT": "10"}, wantErr: "invalid LOCK_TIMEOUT"},
+		{name: "not a duration", env: map[string]string{"DETACH_TIMEOUT": "soon"}, wantErr: "invalid DETACH_TIMEOUT"},
+		{name: "not a number", env: map[string]string{"AWS_MAX_ATTEMPTS": "five"}, wantErr: "invalid AWS_MAX_ATTEMPTS"},
+		{name: "not a boolean", env: map[string]string{"IMDS_ALLOW_V1": "maybe"}, wantErr: "invalid IMDS_ALLOW_V1"},
+		{name: "every bad variable", env: map[string]string{"LEASE_TTL": "1", "IMDS_TIMEOUT": "x"}, wantErr: "invalid IMDS_TIMEOUT"},
+		{name: "list of bad devices", env: map[string]string{"DEVICE_POOL": "sdf,/dev/sdg"}, wantErr: `device.pool entry "sdf" must start with /dev/`},
+		{name: "list with duplicates", env: map[string]string{"DEVICE_POOL": "/dev/sdf, /dev/sdf"}, wantErr: "listed more than once"},
+		{name: "list of commas", env: map[string]string{"ECS_VOLUME_MATCH_KEYS": ",,"}, wantErr: "ecs.volumeMatchKeys cannot be empty"},
+		{name: "duration in the file", file: `{"lockTimeout": "10"}`, wantErr: "failed to parse config file"},
+		{name: "number as duration in the file", file: `{"timeouts": {"attach": 30}}`, wantErr: "duration must be a string"},
+		{name: "string as list in the file", file: `{"device": {"pool": "/dev/sdf"}}`, wantErr: "failed to parse config file"},
+		{name: "malformed file", file: `{`, wantErr: "failed to parse config file"},
+		{name: "invalid from the file", file: `{"lease": {"backend": "etcd"}}`, wantErr: "lease.backend must be"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.file, tt.env)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.json"))
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "failed to read config file") {
+			t.Fatalf("expected a read error, got %v", err)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cfg *Config)
+		wantErr string
+	}{
+		{"sock path", func(cfg *Config) { cfg.SockPath = "" }, "sockPath cannot be empty"},
+		{"state dir", func(cfg *Config) { cfg.StateDir = "" }, "stateDir cannot be empty"},
+		{"shutdown timeout", func(cfg *Config) { cfg.ShutdownTimeout = -1 }, "shutdownTimeout cannot be negative"},
+		{"lock timeout", func(cfg *Config) { cfg.LockTimeout = -1 }, "lockTimeout cannot be negative"},
+		{"relative mount root", func(cfg *Config) { cfg.MountRoot = "mnt" }, "mountRoot must be an absolute path"},
+		{"poll interval", func(cfg *Config) { cfg.VolumePollInterval = 0 }, "volumePollInterval must be positive"},
+		{"attach timeout", func(cfg *Config) { cfg.Timeouts.Attach = 0 }, "timeouts.attach must be positive"},
+		{"force detach", func(cfg *Config) { cfg.Timeouts.ForceDetachAfter = -1 }, "timeouts.forceDetachAfter cannot be negative"},
+		{"mount longer than Docker waits", func(cfg *Config) { cfg.Timeouts.Detach = Duration(time.Minute) }, "add up to 2m50s"},
+		{"lock longer than Docker waits", func(cfg *Config) { cfg.LockTimeout = Duration(10 * time.Minute) }, "a Mount must fit in 1m55s"},
+		{"empty device pool", func(cfg *Config) { cfg.Device.Pool = nil }, "device.pool cannot be empty"},
+		{"device outside /dev", func(cfg *Config) { cfg.Device.Pool = []string{"sdf"} }, `device.pool entry "sdf" must start with /dev/`},
+		{"duplicate device", func(cfg *Config) { cfg.Device.Pool = []string{"/dev/sdf", "/dev/sdf"} }, "is listed more than once"},
+		{"rescan interval", func(cfg *Config) { cfg.Device.RescanInterval = 0 }, "device.rescanInterval must be positive"},
+		{"sysfs", func(cfg *Config) { cfg.Device.SysBlock = "" }, "device.sysBlock, device.diskByIdDir and device.dev cannot be empty"},
+		{"grace period", func(cfg *Config) { cfg.Fencing.GracePeriod = -1 }, "fencing.gracePeriod cannot be negative"},
+		{"dynamodb without table", func(cfg *Config) { cfg.Lease.Backend = "dynamodb" }, "lease.table is required"},
+		{"lease backend", func(cfg *Config) { cfg.Lease.Backend = "etcd" }, "lease.backend must be none, tags or dynamodb"},
+		{"lease ttl", func(cfg *Config) { cfg.Lease.TTL = Duration(time.Second) }, "lease.ttl must be at least 3s"},
+		{"tag settle", func(cfg *Config) { cfg.Lease.TagSettle = -1 }, "lease.tagSettle cannot be negative"},
+		{"retry mode", func(cfg *Config) { cfg.AWS.RetryMode = "legacy" }, "aws.retryMode must be adaptive or standard"},
+		{"aws attempts", func(cfg *Config) { cfg.AWS.MaxAttempts = 0 }, "aws.maxAttempts must be at least 1"},
+		{"aws backoff", func(cfg *Config) { cfg.AWS.MaxBackoff = 0 }, "aws.maxBackoff must be positive"},
+		{"aws connect timeout", func(cfg *Config) { cfg.AWS.ConnectTimeout = 0 }, "aws.connectTimeout must be positive"},
+		{"aws request timeout", func(cfg *Config) { cfg.AWS.RequestTimeout = 0 }, "aws.requestTimeout must be positive"},
+		{"aws endpoint", func(cfg *Config) { cfg.AWS.Endpoint = "localhost:4566" }, "aws.endpoint must be an http or https URL"},
+		{"imds endpoint", func(cfg *Config) { cfg.IMDS.Endpoint = "ftp://169.254.169.254" }, "imds.endpoint must be an http or https URL"},
+		{"imds endpoint mode", func(cfg *Config) { cfg.IMDS.EndpointMode = "dual" }, "imds.endpointMode must be ipv4 or ipv6"},
+		{"imds timeout", func(cfg *Config) { cfg.IMDS.Timeout = 0 }, "imds.timeout must be positive"},
+		{"imds attempts", func(cfg *Config) { cfg.IMDS.MaxAttempts = 0 }, "imds.maxAttempts must be at least 1"},
+		{"running task states", func(cfg *Config) { cfg.ECS.RunningTaskStates = nil }, "ecs.runningTaskStates cannot be empty"},
+		{"list scope without clusters", func(cfg *Config) { cfg.ECS.ClusterScope = ClusterScopeList }, "ecs.clusters is required"},
+		{"cluster scope", func(cfg *Config) { cfg.ECS.ClusterScope = "region" }, "ecs.clusterScope must be all, list or auto"},
+		{"cluster tag without key", func(cfg *Config) { cfg.ECS.ClusterTags = []string{"=prod"} }, `ecs.clusterTags entry "=prod" has no tag key`},
+		{"agent endpoint", func(cfg *Config) { cfg.ECS.AgentEndpoint = "localhost:51678" }, "ecs.agentEndpoint must be an http or https URL"},
+		{"docker socket", func(cfg *Config) { cfg.ECS.DockerSocket = "" }, "ecs.dockerSocket cannot be empty"},
+		{"no match keys", func(cfg *Config) { cfg.ECS.VolumeMatchKeys = nil }, "ecs.volumeMatchKeys cannot be empty"},
+		{"match key", func(cfg *Config) { cfg.ECS.VolumeMatchKeys = []string{"tags.Name"} }, "tags.Name"},
+		{"scan failure policy", func(cfg *Config) { cfg.ECS.ScanFailurePolicy = "retry" }, "ecs.scanFailurePolicy must be fail-closed or fail-open"},
+		{"describe concurrency", func(cfg *Config) { cfg.ECS.DescribeConcurrency = 0 }, "ecs.describeConcurrency must be at least 1"},
+		{"index refresh", func(cfg *Config) { cfg.ECS.IndexRefreshInterval = 0 }, "ecs.indexRefreshInterval must be positive"},
+		{"index staleness", func(cfg *Config) { cfg.ECS.IndexMaxStaleness = -1 }, "ecs.indexMaxStaleness cannot be negative"},
+		{"log level", func(cfg *Config) { cfg.Log.Level = "verbose" }, "log.level"},
+		{"log file size", func(cfg *Config) { cfg.Log.FileMaxSizeMB = 0 }, "log.fileMaxSizeMB must be at least 1"},
+		{"log backups", func(cfg *Config) { cfg.Log.FileMaxBackups = -1 }, "log.fileMaxAgeDays and log.fileMaxBackups cannot be negative"},
+		{"trace exporter", func(cfg *Config) { cfg.Trace.Exporter = "jaeger" }, "trace.exporter must be otlp, file or none"},
+		{"trace file", func(cfg *Config) { cfg.Trace.Exporter = "file"; cfg.Trace.File = "" }, "trace.file cannot be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.change(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	cfg := DefaultConfig()
+	cfg.SockPath = ""
+	cfg.Lease.Backend = "etcd"
+	cfg.Log.Level = "verbose"
+	err := cfg.Validate()
+	for _, want := range []string{"sockPath", "lease.backend", "log.level"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected the error to report %s, got %v", want, err)
+		}
+	}
+}
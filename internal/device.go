@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// deviceStrategy finds the block device of an attached volume on host, or returns "" when it has not shown up (yet).
+// attachDevice is the device name the volume was attached with, such as /dev/sdf.
+type deviceStrategy struct {
+	name string
+	find func(host Host, devices []string, volumeID, attachDevice string) (string, error)
+}
+
+var (
+	// On Nitro instances EBS volumes are NVMe namespaces whose controller identifies itself with the volume ID
+	nvmeStrategy = deviceStrategy{name: "nvme", find: findNVMeDevice}
+	// udev names the NVMe devices after the volume ID, which keeps working where sysfs lacks the serial
+	byIDStrategy = deviceStrategy{name: "by-id", find: findByIDDevice}
+	// On Xen instances the device keeps the attach name, with the sd prefix turned into xvd
+	xenStrategy = deviceStrategy{name: "xen", find: findXenDevice}
+)
+
+// deviceStrategies picks the strategies that apply to the block devices of the host.
+func deviceStrategies(devices []string) []deviceStrategy {
+	var nvme, xen bool
+	for _, name := range devices {
+		switch {
+		case strings.HasPrefix(name, "nvme"):
+			nvme = true
+		case strings.HasPrefix(name, "xvd"):
+			xen = true
+		}
+	}
+
+	var strategies []deviceStrategy
+	if nvme {
+		strategies = append(strategies, nvmeStrategy)
+	}
+	strategies = append(strategies, byIDStrategy)
+	if xen {
+		strategies = append(strategies, xenStrategy)
+	}
+	return strategies
+}
+
+// scanDeviceByVolumeID looks for the block device of volumeID with every strategy that applies to host and returns
+// "" when none finds it.
+func scanDeviceByVolumeID(host Host, volumeID, attachDevice string) (device, strategy string, err error) {
+	devices, err := host.BlockDevices()
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, s := range deviceStrategies(devices) {
+		device, err := s.find(host, devices, volumeID, attachDevice)
+		if err != nil {
+			return "", s.name, err
+		}
+		if device != "" {
+			return device, s.name, nil
+		}
+	}
+	return "", "", nil
+}
+
+// ebsModel is the NVMe model of EBS volumes, instance store disks report "Amazon EC2 NVMe Instance Storage".
+const ebsModel = "Amazon Elastic Block Store"
+
+// NVMeIdentity is what an NVMe controller says about itself.
+type NVMeIdentity struct {
+	Model  string
+	Serial string
+	// VendorDevice is the device name the volume was attached with, only known from the identify data.
+	VendorDevice string
+}
+
+// ebsSerial is the serial of the NVMe controller of volumeID, which drops the dash of the volume ID.
+func ebsSerial(volumeID string) string {
+	return strings.Replace(volumeID, "-", "", 1)
+}
+
+// findNVMeDevice returns the EBS namespace whose serial is exactly volumeID. Instance store and root disks are
+// never considered, and more than one match is reported rather than guessed.
+func findNVMeDevice(host Host, devices []string, volumeID, attachDevice string) (string, error) {
+	serial := ebsSerial(volumeID)
+
+	roots := host.RootDisks()
+	var matches []string
+	var identities []NVMeIdentity
+	for _, name := range devices {
+		if !strings.HasPrefix(name, "nvme") || roots[name] {
+			continue
+		}
+
+		identity, err := host.NVMeIdentity(name)
+		if err != nil || identity.Model != ebsModel || identity.Serial != serial {
+			continue
+		}
+		matches = append(matches, name)
+		identities = append(identities, identity)
+	}
+
+	if len(matches) > 1 && attachDevice != "" {
+		// The attach device name stored by EBS tells the namespaces apart
+		var byName []string
+		for i, identity := range identities {
+			if sameDeviceName(identity.VendorDevice, attachDevice) {
+				byName = append(byName, matches[i])
+			}
+		}
+		if len(byName) > 0 {
+			matches = byName
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", nil
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("volume %s matches several NVMe devices: %s", volumeID, strings.Join(matches, ", "))
+	}
+}
+
+// sameDeviceName compares device names with or without /dev/, such as "sdf" and "/dev/sdf".
+func sameDeviceName(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "/dev/") == strings.TrimPrefix(b, "/dev/")
+}
+
+func findByIDDevice(host Host, devices []string, volumeID, attachDevice string) (string, error) {
+	name, err := host.DiskByID("nvme-Amazon_Elastic_Block_Store_" + ebsSerial(volumeID))
+	if err != nil || name == "" || host.RootDisks()[name] {
+		return "", err
+	}
+	return name, nil
+}
+
+func findXenDevice(host Host, devices []string, volumeID, attachDevice string) (string, error) {
+	if attachDevice == "" {
+		return "", nil
+	}
+	name := filepath.Base(attachDevice)
+	if strings.HasPrefix(name, "sd") {
+		name = "xvd" + strings.TrimPrefix(name, "sd")
+	}
+
+	if !slices.Contains(devices, name) || host.RootDisks()[name] {
+		return "", nil
+	}
+	return name, nil
+}
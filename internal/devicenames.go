@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+)
+
+var errNoDeviceName = errors.New("no available device name found")
+
+// DeviceNames hands out the device names used to attach volumes, so that concurrent attaches never pick the same
+// one. The instance block device mappings are what EC2 knows about, the reservations cover the attaches it has not
+// caught up with yet.
+type DeviceNames struct {
+	mu       sync.Mutex
+	pool     []string
+	reserved map[string]*deviceReservation
+}
+
+type deviceReservation struct {
+	volumeID string
+	// confirmed is set once the name shows up in the block device mappings, after which it going away there means
+	// the volume was detached, possibly by someone else.
+	confirmed bool
+}
+
+// NewDeviceNames returns a reservation layer over pool, in order of preference.
+func NewDeviceNames(pool []string) *DeviceNames {
+	return &DeviceNames{pool: pool, reserved: make(map[string]*deviceReservation)}
+}
+
+// Reserve reserves the first name of the pool for volumeID that is neither mapped on the instance, reserved for
+// another volume nor in skip. mapped holds the block device mappings of the instance, device name to volume ID.
+func (n *DeviceNames) Reserve(volumeID string, mapped map[string]string, skip map[string]bool) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for name, reservation := range n.reserved {
+		mappedVolume, ok := mapped[name]
+		switch {
+		case ok && mappedVolume == reservation.volumeID:
+			reservation.confirmed = true
+		case reservation.confirmed:
+			delete(n.reserved, name)
+		}
+	}
+	n.releaseLocked(volumeID)
+
+	for _, name := range n.pool {
+		if _, ok := mapped[name]; ok || skip[name] || n.reserved[name] != nil {
+			continue
+		}
+		n.reserved[name] = &deviceReservation{volumeID: volumeID}
+		return name, nil
+	}
+	return "", errNoDeviceName
+}
+
+// Release gives back the name reserved for volumeID, if any.
+func (n *DeviceNames) Release(volumeID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.releaseLocked(volumeID)
+}
+
+func (n *DeviceNames) releaseLocked(volumeID string) {
+	for name, reservation := range n.reserved {
+		if reservation.volumeID == volumeID {
+			delete(n.reserved, name)
+		}
+	}
+}
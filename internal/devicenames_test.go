@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+func TestDeviceNamesReserve(t *testing.T) {
+	names := NewDeviceNames([]string{"/dev/sdf", "/dev/sdg", "/dev/sdh"})
+
+	// Mapped names and skipped ones are passed over
+	device, err := names.Reserve("vol-1", map[string]string{"/dev/sdf": "vol-root"}, map[string]bool{"/dev/sdg": true})
+	if err != nil || device != "/dev/sdh" {
+		t.Fatalf("expected /dev/sdh, got %q, %v", device, err)
+	}
+	// So are the names reserved for other volumes
+	device, err = names.Reserve("vol-2", nil, nil)
+	if err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected /dev/sdf, got %q, %v", device, err)
+	}
+	device, err = names.Reserve("vol-3", map[string]string{"/dev/sdg": "vol-root"}, nil)
+	if !errors.Is(err, errNoDeviceName) {
+		t.Fatalf("expected the pool to be exhausted, got %q, %v", device, err)
+	}
+
+	// A volume holds one name at a time, reserving again gives back the previous one
+	device, err = names.Reserve("vol-2", map[string]string{"/dev/sdf": "vol-root"}, nil)
+	if err != nil || device != "/dev/sdg" {
+		t.Fatalf("expected /dev/sdg, got %q, %v", device, err)
+	}
+	device, err = names.Reserve("vol-3", nil, nil)
+	if err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected the name given back by vol-2, got %q, %v", device, err)
+	}
+
+	names.Release("vol-1")
+	names.Release("vol-unknown")
+	device, err = names.Reserve("vol-4", nil, nil)
+	if err != nil || device != "/dev/sdh" {
+		t.Fatalf("expected the released /dev/sdh, got %q, %v", device, err)
+	}
+}
+
+func TestDeviceNamesConfirmedReservations(t *testing.T) {
+	names := NewDeviceNames([]string{"/dev/sdf", "/dev/sdg"})
+	if _, err := names.Reserve("vol-1", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not mapped yet: EC2 has not caught up with the attach, the name stays reserved
+	if device, err := names.Reserve("vol-2", nil, nil); err != nil || device != "/dev/sdg" {
+		t.Fatalf("expected /dev/sdg, got %q, %v", device, err)
+	}
+	names.Release("vol-2")
+
+	// Mapped to the volume: the reservation is confirmed
+	if device, err := names.Reserve("vol-2", map[string]string{"/dev/sdf": "vol-1"}, nil); err != nil || device != "/dev/sdg" {
+		t.Fatalf("expected /dev/sdg, got %q, %v", device, err)
+	}
+	names.Release("vol-2")
+
+	// Gone from the mappings once confirmed: the volume was detached behind our back, the name is free again
+	if device, err := names.Reserve("vol-2", nil, nil); err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected /dev/sdf to be free again, got %q, %v", device, err)
+	}
+}
+
+func TestDeviceNamesConcurrentReservations(t *testing.T) {
+	pool := DefaultConfig().Device.Pool
+	names := NewDeviceNames(pool)
+
+	var wg sync.WaitGroup
+	devices := make([]string, len(pool))
+	for i := range pool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			device, err := names.Reserve(fmt.Sprintf("vol-%d", i), nil, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			devices[i] = device
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, device := range devices {
+		if seen[device] {
+			t.Fatalf("%s was reserved twice", device)
+		}
+		seen[device] = true
+	}
+}
+
+// staleMappings hides the block device mappings of the instance, as DescribeInstances does for attaches it has not
+// caught up with yet.
+type staleMappings struct {
+	EC2API
+}
+
+func (s staleMappings) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	out, err := s.EC2API.DescribeInstances(ctx, params, optFns...)
+	if err == nil {
+		for _, reservation := range out.Reservations {
+			for i := range reservation.Instances {
+				reservation.Instances[i].BlockDeviceMappings = nil
+			}
+		}
+	}
+	return out, err
+}
+
+func TestAttachVolumeRetriesDeviceInUse(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-f", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-g", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdg"}}})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	client := staleMappings{newTestEC2(t, fake)}
+	names := NewDeviceNames([]string{"/dev/sdf", "/dev/sdg", "/dev/sdh"})
+
+	attached, err := AttachVolume(context.Background(), client, names, "vol-1", testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := *attached.Device; device != "/dev/sdh" {
+		t.Fatalf("expected the names in use to be skipped for /dev/sdh, got %s", device)
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 3 {
+		t.Fatalf("expected two refused attaches before the third one, got %d calls", calls)
+	}
+
+	// The refused names were not kept, the attached one is
+	if device, err := names.Reserve("vol-2", nil, nil); err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected /dev/sdf to be free in the reservations, got %q, %v", device, err)
+	}
+	if device, err := names.Reserve("vol-3", nil, map[string]bool{"/dev/sdg": true}); !errors.Is(err, errNoDeviceName) {
+		t.Fatalf("expected /dev/sdh to stay reserved, got %q, %v", device, err)
+	}
+}
+
+func TestAttachVolumeReleasesOnFailure(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: "eu-west-1c"})
+	client := newTestEC2(t, fake)
+	names := NewDeviceNames([]string{"/dev/sdf"})
+
+	if _, err := AttachVolume(context.Background(), client, names, "vol-1", testInstance); err == nil {
+		t.Fatal("expected an attach across zones to fail")
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 1 {
+		t.Fatalf("expected other errors not to be retried, got %d calls", calls)
+	}
+	if device, err := names.Reserve("vol-2", nil, nil); err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected the name to be released, got %q, %v", device, err)
+	}
+}
+
+func TestDetachVolumeAndWaitReleasesDeviceName(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddInstance(fakeaws.Instance{ID: "i-other", AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-2", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: "i-other", Device: "/dev/sdf"}}})
+	client := newTestEC2(t, fake)
+	cfg := newTestVolumeConfig()
+	names := NewDeviceNames([]string{"/dev/sdf", "/dev/sdg"})
+
+	if _, err := AttachVolume(context.Background(), client, names, "vol-1", testInstance); err != nil {
+		t.Fatal(err)
+	}
+
+	// Taking vol-2 from another instance leaves the names of this one alone
+	if _, err := DetachVolumeAndWait(context.Background(), cfg, client, nil, "vol-2", "i-other"); err != nil {
+		t.Fatal(err)
+	}
+	if device, err := names.Reserve("vol-3", nil, nil); err != nil || device != "/dev/sdg" {
+		t.Fatalf("expected /dev/sdf to stay reserved for vol-1, got %q, %v", device, err)
+	}
+	names.Release("vol-3")
+
+	// Detaching vol-1 from this instance gives its name back
+	if _, err := DetachVolumeAndWait(context.Background(), cfg, client, names, "vol-1", testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if device, err := names.Reserve("vol-3", nil, nil); err != nil || device != "/dev/sdf" {
+		t.Fatalf("expected /dev/sdf to be released, got %q, %v", device, err)
+	}
+}
@@ -1,11 +1,34 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// Addresses of the instance metadata service, see IMDSConfig.EndpointMode.
+const (
+	IMDSEndpointModeIPv4 = "ipv4"
+	IMDSEndpointModeIPv6 = "ipv6"
+
+	imdsIPv4Endpoint = "http://169.254.169.254"
+	imdsIPv6Endpoint = "http://[fd00:ec2::254]"
+)
+
+const (
+	// imdsTokenTTL is how long a session token lasts. The metadata is only read while the plugin starts.
+	imdsTokenTTL = 5 * time.Minute
+	// imdsMaxBackoff caps the wait between two attempts of a request.
+	imdsMaxBackoff = 2 * time.Second
+	// imdsMaxResponseSize bounds what is read of an answer, the values the plugin asks for are a few bytes long.
+	imdsMaxResponseSize = 64 << 10
 )
 
 type InstanceMetadata struct {
@@ -14,81 +37,210 @@ type InstanceMetadata struct {
 	InstanceID       string
 }
 
-func GetInstanceMetadata() (*InstanceMetadata, error) {
-	meta := &InstanceMetadata{
-		Region:           strings.TrimSpace(os.Getenv("REGION")),
-		AvailabilityZone: strings.TrimSpace(os.Getenv("AVAILABILITY_ZONE")),
-		InstanceID:       strings.TrimSpace(os.Getenv("INSTANCE_ID")),
+// IMDSStatusError is an answer of the instance metadata service other than 200 OK.
+type IMDSStatusError struct {
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *IMDSStatusError) Error() string {
+	return fmt.Sprintf("%s answered %d %s: %q", e.Path, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// IMDSClient reads the instance metadata service with IMDSv2 session tokens, or IMDSv1 requests when no token can be
+// obtained and cfg.AllowV1 is set. Throttling, server errors, timeouts and connection failures are retried with
+// backoff, other answers than 200 OK are errors.
+type IMDSClient struct {
+	cfg      IMDSConfig
+	endpoint string
+	http     *http.Client
+	// backoff is the wait before the second attempt of a request, doubled at every further one.
+	backoff time.Duration
+
+	token string
+	// v1 is set once the client fell back to IMDSv1.
+	v1 bool
+}
+
+func NewIMDSClient(cfg IMDSConfig) *IMDSClient {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = imdsIPv4Endpoint
+		if cfg.EndpointMode == IMDSEndpointModeIPv6 {
+			endpoint = imdsIPv6Endpoint
+		}
 	}
+	return &IMDSClient{
+		cfg:      cfg,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		http: &http.Client{
+			Transport: &http.Transport{
+				// The service is link-local, a proxy from the environment would never reach it
+				Proxy:       nil,
+				DialContext: (&net.Dialer{Timeout: time.Duration(cfg.Timeout)}).DialContext,
+			},
+			// A redirect is not something the service does
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		backoff: 200 * time.Millisecond,
+	}
+}
 
-	// Se tutte sono settate, ritorna subito
-	if meta.Region != "" && meta.AvailabilityZone != "" && meta.InstanceID != "" {
-		return meta, nil
+// Get returns the metadata item at path, such as "placement/region". An empty value is an error.
+func (c *IMDSClient) Get(ctx context.Context, path string) (string, error) {
+	if c.token == "" && !c.v1 {
+		if err := c.fetchToken(ctx); err != nil {
+			return "", err
+		}
 	}
 
-	// Altrimenti, prendi il token
-	token, err := getIMDSToken()
+	value, err := c.request(ctx, http.MethodGet, "/latest/meta-data/"+path, c.tokenHeader())
+	var statusErr *IMDSStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized && !c.v1 {
+		// The token expired or was revoked, a new one is worth a try
+		slog.WarnContext(ctx, "Instance metadata service refused the session token, getting a new one", "path", path)
+		if err := c.fetchToken(ctx); err != nil {
+			return "", err
+		}
+		value, err = c.request(ctx, http.MethodGet, "/latest/meta-data/"+path, c.tokenHeader())
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get IMDS token: %w", err)
+		return "", err
 	}
 
-	if meta.Region == "" {
-		meta.Region, err = getMetadata(token, "placement/region")
-		if err != nil {
-			return nil, fmt.Errorf("failed to get region: %w", err)
-		}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("%s is empty", path)
 	}
+	return value, nil
+}
 
-	if meta.AvailabilityZone == "" {
-		meta.AvailabilityZone, err = getMetadata(token, "placement/availability-zone")
-		if err != nil {
-			return nil, fmt.Errorf("failed to get availability zone: %w", err)
-		}
+func (c *IMDSClient) tokenHeader() http.Header {
+	if c.v1 {
+		return nil
 	}
+	return http.Header{"X-Aws-Ec2-Metadata-Token": {c.token}}
+}
 
-	if meta.InstanceID == "" {
-		meta.InstanceID, err = getMetadata(token, "instance-id")
-		if err != nil {
-			return nil, fmt.Errorf("failed to get instance ID: %w", err)
+// fetchToken gets an IMDSv2 session token, or switches to IMDSv1 when that fails and it is allowed.
+func (c *IMDSClient) fetchToken(ctx context.Context) error {
+	header := http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {strconv.Itoa(int(imdsTokenTTL.Seconds()))}}
+	token, err := c.request(ctx, http.MethodPut, "/latest/api/token", header)
+	if err == nil && strings.TrimSpace(token) == "" {
+		err = errors.New("the session token is empty")
+	}
+	if err != nil {
+		if c.cfg.AllowV1 && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Cannot get an IMDSv2 session token, falling back to IMDSv1", "error", err)
+			c.token = ""
+			c.v1 = true
+			return nil
 		}
+		return fmt.Errorf("failed to get IMDS token: %w", err)
 	}
+	c.token = strings.TrimSpace(token)
+	return nil
+}
 
-	return meta, nil
+// request sends method to path up to cfg.MaxAttempts times and returns the body of the first 200 OK.
+func (c *IMDSClient) request(ctx context.Context, method, path string, header http.Header) (string, error) {
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		body, err := c.attempt(ctx, method, path, header)
+		if err == nil || attempt >= c.cfg.MaxAttempts || !imdsRetryable(ctx, err) {
+			return body, err
+		}
+
+		slog.DebugContext(ctx, "Instance metadata request failed, retrying", "path", path, "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%s: %w (after %v)", path, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, imdsMaxBackoff)
+	}
 }
 
-func getIMDSToken() (string, error) {
-	req, err := http.NewRequest("PUT", "http://169.254.169.254/latest/api/token", nil)
+func (c *IMDSClient) attempt(ctx context.Context, method, path string, header http.Header) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(c.cfg.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "3600")
+	for name, values := range header {
+		req.Header[name] = values
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	return string(body), err
+	body, err := io.ReadAll(io.LimitReader(resp.Body, imdsMaxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &IMDSStatusError{Path: path, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return string(body), nil
 }
 
-func getMetadata(token, path string) (string, error) {
-	url := "http://169.254.169.254/latest/meta-data/" + path
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", err
+// imdsRetryable tells whether err may go away on its own: throttling, server errors, and failures to connect or
+// answer in time. Other statuses, such as 403 for a disabled service or 404 for a missing item, stay the same.
+func imdsRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *IMDSStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
 	}
-	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return true
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// GetInstanceMetadata returns where the plugin runs, from the settings of cfg or else the instance metadata service.
+func GetInstanceMetadata(ctx context.Context, cfg *Config) (_ *InstanceMetadata, err error) {
+	meta := &InstanceMetadata{
+		Region:           cfg.Region,
+		AvailabilityZone: cfg.AvailabilityZone,
+		InstanceID:       cfg.InstanceID,
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	return string(body), err
+	// Nothing to ask when everything is configured, as when running outside of EC2
+	if meta.Region != "" && meta.AvailabilityZone != "" && meta.InstanceID != "" {
+		return meta, nil
+	}
+
+	ctx, span := startSpan(ctx, "GetInstanceMetadata")
+	defer func() { endSpan(span, err) }()
+
+	client := NewIMDSClient(cfg.IMDS)
+
+	if meta.Region == "" {
+		meta.Region, err = client.Get(ctx, "placement/region")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get region: %w", err)
+		}
+	}
+
+	if meta.AvailabilityZone == "" {
+		meta.AvailabilityZone, err = client.Get(ctx, "placement/availability-zone")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get availability zone: %w", err)
+		}
+	}
+
+	if meta.InstanceID == "" {
+		meta.InstanceID, err = client.Get(ctx, "instance-id")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instance ID: %w", err)
+		}
+	}
+
+	return meta, nil
 }
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// imdsStandIn answers like the instance metadata service. Failures are queued per path and served before the
+// normal answer, one per request.
+type imdsStandIn struct {
+	mu       sync.Mutex
+	items    map[string]string
+	tokens   map[string]bool
+	failures map[string][]int
+	// tokenStatus, when set, is how every token request is refused, as with IMDSv2 unsupported or disabled.
+	tokenStatus int
+	// requireToken refuses metadata requests without a valid session token, as with IMDSv2 enforced.
+	requireToken bool
+	// delay holds the answer to the first delayed requests of every path for that long.
+	delay   time.Duration
+	delayed map[string]int
+	calls   map[string]int
+	// tokenless counts the metadata requests made without a token.
+	tokenless int
+}
+
+func newIMDSStandIn() *imdsStandIn {
+	return &imdsStandIn{
+		items: map[string]string{
+			"placement/region":            "eu-west-1",
+			"placement/availability-zone": "eu-west-1a",
+			"instance-id":                 testInstance,
+		},
+		tokens:       make(map[string]bool),
+		failures:     make(map[string][]int),
+		requireToken: true,
+		delayed:      make(map[string]int),
+		calls:        make(map[string]int),
+	}
+}
+
+func (s *imdsStandIn) fail(path string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], statuses...)
+}
+
+func (s *imdsStandIn) delayFirst(path string, n int, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+	s.delayed[path] = n
+}
+
+func (s *imdsStandIn) revokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]bool)
+}
+
+func (s *imdsStandIn) refuseTokens(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenStatus = status
+}
+
+func (s *imdsStandIn) tokenlessCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenless
+}
+
+func (s *imdsStandIn) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[path]
+}
+
+func (s *imdsStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	path := r.URL.Path
+	s.calls[path]++
+	var delay time.Duration
+	if s.delayed[path] > 0 {
+		s.delayed[path]--
+		delay = s.delay
+	}
+	var status int
+	if queued := s.failures[path]; len(queued) > 0 {
+		status, s.failures[path] = queued[0], queued[1:]
+	}
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if path == "/latest/api/token" {
+		switch {
+		case s.tokenStatus != 0:
+			http.Error(w, http.StatusText(s.tokenStatus), s.tokenStatus)
+		case r.Method != http.MethodPut:
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		case r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "":
+			http.Error(w, "", http.StatusBadRequest)
+		default:
+			token := "token-" + time.Now().Format(time.RFC3339Nano)
+			s.tokens[token] = true
+			w.Write([]byte(token))
+		}
+		return
+	}
+
+	token := r.Header.Get("X-aws-ec2-metadata-token")
+	if token == "" {
+		s.tokenless++
+		if s.requireToken {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+	} else if !s.tokens[token] {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	value, ok := s.items[strings.TrimPrefix(path, "/latest/meta-data/")]
+	if !ok {
+		http.Error(w, "<html>404 - Not Found</html>", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(value))
+}
+
+// newTestIMDS starts a stand-in and returns a client pointed at it that does not wait long between attempts.
+func newTestIMDS(t *testing.T, standIn *imdsStandIn) (*IMDSClient, *Config) {
+	t.Helper()
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	cfg := DefaultConfig()
+	cfg.IMDS.Endpoint = server.URL
+	cfg.IMDS.Timeout = Duration(200 * time.Millisecond)
+	client := NewIMDSClient(cfg.IMDS)
+	client.backoff = time.Millisecond
+	return client, cfg
+}
+
+func TestGetInstanceMetadata(t *testing.T) {
+	standIn := newIMDSStandIn()
+	_, cfg := newTestIMDS(t, standIn)
+
+	meta, err := GetInstanceMetadata(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := InstanceMetadata{Region: "eu-west-1", AvailabilityZone: "eu-west-1a", InstanceID: testInstance}
+	if *meta != want {
+		t.Fatalf("expected %+v, got %+v", want, *meta)
+	}
+	if calls := standIn.count("/latest/api/token"); calls != 1 {
+		t.Fatalf("expected one session token for every item, got %d", calls)
+	}
+
+	// Configured values are not asked for
+	cfg.Region = "us-east-1"
+	cfg.InstanceID = "i-configured"
+	if meta, err = GetInstanceMetadata(context.Background(), cfg); err != nil || meta.Region != "us-east-1" || meta.AvailabilityZone != "eu-west-1a" || meta.InstanceID != "i-configured" {
+		t.Fatalf("unexpected metadata %+v, %v", meta, err)
+	}
+	if calls := standIn.count("/latest/meta-data/instance-id"); calls != 1 {
+		t.Fatalf("expected the configured instance ID not to be asked for, got %d calls", calls)
+	}
+
+	// Nothing is asked when everything is configured
+	cfg.AvailabilityZone = "us-east-1a"
+	cfg.IMDS.Endpoint = "http://127.0.0.1:1"
+	if _, err := GetInstanceMetadata(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIMDSRetries(t *testing.T) {
+	standIn := newIMDSStandIn()
+	client, _ := newTestIMDS(t, standIn)
+	standIn.fail("/latest/api/token", http.StatusInternalServerError, http.StatusServiceUnavailable)
+	standIn.fail("/latest/meta-data/placement/region", http.StatusTooManyRequests)
+
+	region, err := client.Get(context.Background(), "placement/region")
+	if err != nil || region != "eu-west-1" {
+		t.Fatalf("expected eu-west-1, got %q, %v", region, err)
+	}
+	if tokens, gets := standIn.count("/latest/api/token"), standIn.count("/latest/meta-data/placement/region"); tokens != 3 || gets != 2 {
+		t.Fatalf("expected 3 token and 2 region requests, got %d and %d", tokens, gets)
+	}
+
+	// Attempts run out
+	standIn.fail("/latest/meta-data/instance-id", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	_, err = client.Get(context.Background(), "instance-id")
+	var statusErr *IMDSStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the last 500 once the attempts ran out, got %v", err)
+	}
+	if calls := standIn.count("/latest/meta-data/instance-id"); calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestIMDSStatusValidation(t *testing.T) {
+	standIn := newIMDSStandIn()
+	delete(standIn.items, "placement/region")
+	standIn.items["instance-id"] = " \n"
+	client, _ := newTestIMDS(t, standIn)
+
+	// The body of an error is never taken for the value
+	region, err := client.Get(context.Background(), "placement/region")
+	var statusErr *IMDSStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound || region != "" {
+		t.Fatalf("expected a 404, got %q, %v", region, err)
+	}
+	if calls := standIn.count("/latest/meta-data/placement/region"); calls != 1 {
+		t.Fatalf("expected a 404 not to be retried, got %d calls", calls)
+	}
+
+	if id, err := client.Get(context.Background(), "instance-id"); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Fatalf("expected an empty value to be refused, got %q, %v", id, err)
+	}
+
+	// A disabled service is not retried either
+	standIn.refuseTokens(http.StatusForbidden)
+	client.token = ""
+	if _, err := client.Get(context.Background(), "placement/availability-zone"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a 403, got %v", err)
+	}
+	if calls := standIn.count("/latest/api/token"); calls != 2 {
+		t.Fatalf("expected a 403 not to be retried, got %d token requests", calls)
+	}
+}
+
+func TestIMDSFallbackToV1(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed} {
+		standIn := newIMDSStandIn()
+		standIn.tokenStatus = status
+		standIn.requireToken = false
+		client, cfg := newTestIMDS(t, standIn)
+
+		if _, err := client.Get(context.Background(), "placement/region"); err == nil {
+			t.Fatalf("token refused with %d: expected IMDSv1 not to be used unless allowed", status)
+		}
+		if standIn.tokenlessCount() != 0 {
+			t.Fatalf("token refused with %d: expected no IMDSv1 request, got %d", status, standIn.tokenlessCount())
+		}
+
+		cfg.IMDS.AllowV1 = true
+		meta, err := GetInstanceMetadata(context.Background(), cfg)
+		if err != nil || meta.InstanceID != testInstance {
+			t.Fatalf("token refused with %d: expected the IMDSv1 fallback to work, got %+v, %v", status, meta, err)
+		}
+		if standIn.tokenlessCount() != 3 {
+			t.Fatalf("token refused with %d: expected 3 IMDSv1 requests, got %d", status, standIn.tokenlessCount())
+		}
+	}
+}
+
+func TestIMDSTimeout(t *testing.T) {
+	standIn := newIMDSStandIn()
+	client, _ := newTestIMDS(t, standIn)
+	standIn.delayFirst("/latest/meta-data/instance-id", 1, time.Second)
+
+	start := time.Now()
+	id, err := client.Get(context.Background(), "instance-id")
+	if err != nil || id != testInstance {
+		t.Fatalf("expected a slow answer to be retried, got %q, %v", id, err)
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Fatalf("expected the slow attempt to be cut at the timeout, took %v", elapsed)
+	}
+
+	standIn.delayFirst("/latest/meta-data/placement/region", 3, time.Second)
+	if _, err := client.Get(context.Background(), "placement/region"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected every attempt to time out, got %v", err)
+	}
+
+	// The caller giving up stops the retries at once
+	standIn.delayFirst("/latest/meta-data/placement/availability-zone", 3, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, "placement/availability-zone"); err == nil {
+		t.Fatal("expected the request to fail with its context")
+	}
+	if calls := standIn.count("/latest/meta-data/placement/availability-zone"); calls != 1 {
+		t.Fatalf("expected no retry once the context is done, got %d calls", calls)
+	}
+}
+
+func TestIMDSExpiredToken(t *testing.T) {
+	standIn := newIMDSStandIn()
+	client, _ := newTestIMDS(t, standIn)
+	if _, err := client.Get(context.Background(), "placement/region"); err != nil {
+		t.Fatal(err)
+	}
+
+	standIn.revokeTokens()
+	if id, err := client.Get(context.Background(), "instance-id"); err != nil || id != testInstance {
+		t.Fatalf("expected a new token to be fetched, got %q, %v", id, err)
+	}
+	if calls := standIn.count("/latest/api/token"); calls != 2 {
+		t.Fatalf("expected 2 token requests, got %d", calls)
+	}
+}
+
+func TestIMDSEndpoint(t *testing.T) {
+	cfg := DefaultConfig().IMDS
+	if endpoint := NewIMDSClient(cfg).endpoint; endpoint != "http://169.254.169.254" {
+		t.Fatalf("unexpected IPv4 endpoint %s", endpoint)
+	}
+	cfg.EndpointMode = IMDSEndpointModeIPv6
+	if endpoint := NewIMDSClient(cfg).endpoint; endpoint != "http://[fd00:ec2::254]" {
+		t.Fatalf("unexpected IPv6 endpoint %s", endpoint)
+	}
+	cfg.Endpoint = "http://localhost:1338/"
+	if endpoint := NewIMDSClient(cfg).endpoint; endpoint != "http://localhost:1338" {
+		t.Fatalf("expected the override to win, got %s", endpoint)
+	}
+
+	// A stand-in on an IPv6 address is reached like the real IPv6 endpoint
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	server := httptest.NewUnstartedServer(newIMDSStandIn())
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	cfg.Endpoint = server.URL
+	if !strings.HasPrefix(server.URL, "http://[::1]:") {
+		t.Fatalf("unexpected stand-in URL %s", server.URL)
+	}
+	if region, err := NewIMDSClient(cfg).Get(context.Background(), "placement/region"); err != nil || region != "eu-west-1" {
+		t.Fatalf("expected eu-west-1 over IPv6, got %q, %v", region, err)
+	}
+}
@@ -0,0 +1,199 @@
+package fakeaws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// ec2InstanceIDLimit is the most instance ids DescribeInstances accepts at once.
+	ec2InstanceIDLimit = 1000
+	// ec2FilterValueLimit is the most values a filter accepts.
+	ec2FilterValueLimit = 200
+)
+
+// Instance is an EC2 instance.
+type Instance struct {
+	ID               string
+	AvailabilityZone string
+	// State defaults to running.
+	State string
+	// ImpairedSince makes the instance status check impaired since then, it passes when zero.
+	ImpairedSince time.Time
+}
+
+// AddInstance launches an instance.
+func (s *Server) AddInstance(instance Instance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if instance.State == "" {
+		instance.State = "running"
+	}
+	s.instances[instance.ID] = instance
+}
+
+type ec2BlockDeviceMapping struct {
+	DeviceName string `xml:"deviceName"`
+	VolumeID   string `xml:"ebs>volumeId"`
+	Status     string `xml:"ebs>status"`
+}
+
+type ec2Instance struct {
+	InstanceID         string                  `xml:"instanceId"`
+	AvailabilityZone   string                  `xml:"placement>availabilityZone"`
+	State              string                  `xml:"instanceState>name"`
+	BlockDeviceMapping []ec2BlockDeviceMapping `xml:"blockDeviceMapping>item"`
+}
+
+type ec2Reservation struct {
+	ReservationID string        `xml:"reservationId"`
+	Instances     []ec2Instance `xml:"instancesSet>item"`
+}
+
+type describeInstancesResponse struct {
+	XMLName      xml.Name         `xml:"DescribeInstancesResponse"`
+	RequestID    string           `xml:"requestId"`
+	Reservations []ec2Reservation `xml:"reservationSet>item"`
+}
+
+type ec2ErrorResponse struct {
+	XMLName   xml.Name `xml:"Response"`
+	Code      string   `xml:"Errors>Error>Code"`
+	Message   string   `xml:"Errors>Error>Message"`
+	RequestID string   `xml:"RequestID"`
+}
+
+func (s *Server) serveEC2(w http.ResponseWriter, form url.Values) {
+	operation := form.Get("Action")
+	s.record(operation)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, v := range s.volumes {
+		s.advance(v, now)
+	}
+
+	if s.failing(operation, "") {
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusInternalServerError)
+		xml.NewEncoder(w).Encode(ec2ErrorResponse{Code: "InternalError", Message: "Injected failure.", RequestID: "fake"})
+		return
+	}
+
+	switch operation {
+	case "DescribeInstances":
+		ids := indexedValues(form, "InstanceId")
+		if len(ids) > ec2InstanceIDLimit {
+			ec2Error(w, "InvalidParameterValue", fmt.Sprintf("at most %d instance ids can be described at once", ec2InstanceIDLimit))
+			return
+		}
+		filtered, err := instanceIDFilter(form)
+		if err != nil {
+			ec2Error(w, "InvalidParameterValue", err.Error())
+			return
+		}
+		response := describeInstancesResponse{RequestID: "fake"}
+		var missing []string
+		for _, id := range ids {
+			if _, ok := s.instances[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+		// EC2 fails the whole call when any of the ids does not exist, filters only leave them out
+		if len(missing) > 0 {
+			ec2Error(w, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance IDs '%s' do not exist", strings.Join(missing, ", ")))
+			return
+		}
+		for i, id := range slices.Concat(ids, filtered) {
+			instance, ok := s.instances[id]
+			if !ok {
+				continue
+			}
+			response.Reservations = append(response.Reservations, ec2Reservation{
+				ReservationID: fmt.Sprintf("r-%d", i),
+				Instances: []ec2Instance{{
+					InstanceID:         instance.ID,
+					AvailabilityZone:   instance.AvailabilityZone,
+					State:              instance.State,
+					BlockDeviceMapping: s.blockDeviceMappings(instance.ID),
+				}},
+			})
+		}
+		ec2Reply(w, response)
+
+	case "DescribeInstanceStatus":
+		s.describeInstanceStatus(w, form)
+	case "DescribeVolumes":
+		s.describeVolumes(w, form)
+	case "AttachVolume":
+		s.attachVolume(w, form)
+	case "DetachVolume":
+		s.detachVolume(w, form)
+	case "CreateTags", "DeleteTags":
+		s.changeTags(w, form, operation)
+
+	default:
+		ec2Error(w, "InvalidAction", "unsupported action "+operation)
+	}
+}
+
+// blockDeviceMappings lists the volumes attached to instanceID, sorted by device name.
+func (s *Server) blockDeviceMappings(instanceID string) []ec2BlockDeviceMapping {
+	var mappings []ec2BlockDeviceMapping
+	for _, v := range s.volumes {
+		if a := v.attachment(instanceID); a != nil {
+			mappings = append(mappings, ec2BlockDeviceMapping{DeviceName: a.Device, VolumeID: v.ID, Status: a.State})
+		}
+	}
+	slices.SortFunc(mappings, func(a, b ec2BlockDeviceMapping) int { return strings.Compare(a.DeviceName, b.DeviceName) })
+	return mappings
+}
+
+// instanceIDFilter returns the values of the instance-id filter, the only one the fake supports.
+func instanceIDFilter(form url.Values) ([]string, error) {
+	var ids []string
+	for i := 1; ; i++ {
+		name, ok := form[fmt.Sprintf("Filter.%d.Name", i)]
+		if !ok {
+			return ids, nil
+		}
+		if name[0] != "instance-id" {
+			return nil, fmt.Errorf("unsupported filter %s", name[0])
+		}
+		values := indexedValues(form, fmt.Sprintf("Filter.%d.Value", i))
+		if len(values) > ec2FilterValueLimit {
+			return nil, fmt.Errorf("filters can have at most %d values", ec2FilterValueLimit)
+		}
+		ids = append(ids, values...)
+	}
+}
+
+// indexedValues returns the values of a query protocol list, sent as name.1, name.2 and so on.
+func indexedValues(form url.Values, name string) []string {
+	var values []string
+	for i := 1; ; i++ {
+		value, ok := form[fmt.Sprintf("%s.%d", name, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, value...)
+	}
+}
+
+func ec2Reply(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "text/xml")
+	xml.NewEncoder(w).Encode(body)
+}
+
+func ec2Error(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	xml.NewEncoder(w).Encode(ec2ErrorResponse{Code: code, Message: message, RequestID: "fake"})
+}
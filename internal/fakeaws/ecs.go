@@ -0,0 +1,384 @@
+package fakeaws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ECS limits, https://docs.aws.amazon.com/AmazonECS/latest/APIReference/
+const (
+	ecsListLimit     = 100
+	ecsDescribeLimit = 100
+)
+
+// ContainerInstance is an instance registered to a cluster.
+type ContainerInstance struct {
+	// Arn is generated by AddContainerInstance when empty.
+	Arn string
+	// EC2InstanceID starts with mi- for ECS Anywhere instances.
+	EC2InstanceID  string
+	Status         string
+	AgentConnected bool
+	// AvailabilityZone is reported in the ecs.availability-zone attribute when set.
+	AvailabilityZone string
+}
+
+// Task is a task of a cluster.
+type Task struct {
+	// Arn is generated by AddTask when empty.
+	Arn               string
+	TaskDefinitionArn string
+	LastStatus        string
+	// DesiredStatus defaults to RUNNING.
+	DesiredStatus string
+	// ContainerInstanceArn is empty for tasks that do not run on a container instance, such as Fargate ones.
+	ContainerInstanceArn string
+	// LaunchType defaults to EC2 unless CapacityProviderName is set.
+	LaunchType           string
+	CapacityProviderName string
+	AvailabilityZone     string
+}
+
+// TaskDefinition is a registered task definition.
+type TaskDefinition struct {
+	// Arn is generated from Family by AddTaskDefinition when empty.
+	Arn     string
+	Family  string
+	Volumes []Volume
+}
+
+// Volume is a volume of a task definition, with its Docker volume configuration when Driver is set.
+type Volume struct {
+	Name       string
+	Driver     string
+	DriverOpts map[string]string
+	Labels     map[string]string
+}
+
+type cluster struct {
+	arn                string
+	name               string
+	tags               map[string]string
+	containerInstances []ContainerInstance
+	tasks              []Task
+}
+
+func ecsArn(resource string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:%s", region, accountID, resource)
+}
+
+// AddCluster creates a cluster and returns its ARN.
+func (s *Server) AddCluster(name string, tags map[string]string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &cluster{arn: ecsArn("cluster/" + name), name: name, tags: tags}
+	s.clusters[name] = c
+	s.clusterArns = append(s.clusterArns, c.arn)
+	return c.arn
+}
+
+// AddContainerInstance registers an instance to the named cluster and returns its ARN.
+func (s *Server) AddContainerInstance(clusterName string, ci ContainerInstance) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clusters[clusterName]
+	if ci.Arn == "" {
+		ci.Arn = ecsArn(fmt.Sprintf("container-instance/%s/%032d", clusterName, len(c.containerInstances)))
+	}
+	if ci.Status == "" {
+		ci.Status = "ACTIVE"
+	}
+	c.containerInstances = append(c.containerInstances, ci)
+	return ci.Arn
+}
+
+// AddTask adds a task to the named cluster and returns its ARN.
+func (s *Server) AddTask(clusterName string, task Task) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clusters[clusterName]
+	if task.Arn == "" {
+		task.Arn = ecsArn(fmt.Sprintf("task/%s/%032d", clusterName, len(c.tasks)))
+	}
+	if task.DesiredStatus == "" {
+		task.DesiredStatus = "RUNNING"
+	}
+	if task.LaunchType == "" && task.CapacityProviderName == "" {
+		task.LaunchType = "EC2"
+	}
+	c.tasks = append(c.tasks, task)
+	return task.Arn
+}
+
+// AddTaskDefinition registers a task definition and returns its ARN.
+func (s *Server) AddTaskDefinition(def TaskDefinition) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if def.Arn == "" {
+		def.Arn = ecsArn("task-definition/" + def.Family + ":1")
+	}
+	s.taskDefs[def.Arn] = def
+	return def.Arn
+}
+
+type ecsFailure struct {
+	Arn    string `json:"arn"`
+	Reason string `json:"reason"`
+}
+
+type ecsTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (s *Server) serveECS(w http.ResponseWriter, r *http.Request, operation string) {
+	var req struct {
+		Cluster            string
+		Clusters           []string
+		Include            []string
+		ContainerInstances []string
+		ContainerInstance  string
+		Tasks              []string
+		TaskDefinition     string
+		DesiredStatus      string
+		Filter             string
+		MaxResults         int
+		NextToken          string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		ecsError(w, "SerializationException", err.Error())
+		return
+	}
+	s.record(operation)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failing(operation, req.Cluster) {
+		ecsServerError(w)
+		return
+	}
+
+	var c *cluster
+	switch operation {
+	case "ListContainerInstances", "DescribeContainerInstances", "ListTasks", "DescribeTasks":
+		if c = s.cluster(req.Cluster); c == nil {
+			ecsError(w, "ClusterNotFoundException", "Cluster not found.")
+			return
+		}
+	}
+
+	switch operation {
+	case "ListClusters":
+		arns, next, err := page(s.clusterArns, req.NextToken, req.MaxResults, ecsListLimit)
+		if err != nil {
+			ecsError(w, "InvalidParameterException", err.Error())
+			return
+		}
+		listReply(w, "clusterArns", arns, next)
+
+	case "DescribeClusters":
+		if len(req.Clusters) > ecsDescribeLimit {
+			ecsError(w, "InvalidParameterException", fmt.Sprintf("clusters can have at most %d items", ecsDescribeLimit))
+			return
+		}
+		var clusters []map[string]any
+		var failures []ecsFailure
+		for _, id := range req.Clusters {
+			c := s.cluster(id)
+			if c == nil {
+				failures = append(failures, ecsFailure{Arn: id, Reason: "MISSING"})
+				continue
+			}
+			described := map[string]any{"clusterArn": c.arn, "clusterName": c.name, "status": "ACTIVE"}
+			if slices.Contains(req.Include, "TAGS") {
+				var tags []ecsTag
+				for key, value := range c.tags {
+					tags = append(tags, ecsTag{Key: key, Value: value})
+				}
+				described["tags"] = tags
+			}
+			clusters = append(clusters, described)
+		}
+		ecsReply(w, map[string]any{"clusters": clusters, "failures": failures})
+
+	case "ListContainerInstances":
+		var arns []string
+		for _, ci := range c.containerInstances {
+			if id, ok := strings.CutPrefix(req.Filter, "ec2InstanceId == "); ok && ci.EC2InstanceID != strings.TrimSpace(id) {
+				continue
+			}
+			arns = append(arns, ci.Arn)
+		}
+		arns, next, err := page(arns, req.NextToken, req.MaxResults, ecsListLimit)
+		if err != nil {
+			ecsError(w, "InvalidParameterException", err.Error())
+			return
+		}
+		listReply(w, "containerInstanceArns", arns, next)
+
+	case "DescribeContainerInstances":
+		if len(req.ContainerInstances) > ecsDescribeLimit {
+			ecsError(w, "InvalidParameterException", fmt.Sprintf("containerInstances can have at most %d items", ecsDescribeLimit))
+			return
+		}
+		var described []map[string]any
+		var failures []ecsFailure
+		for _, id := range req.ContainerInstances {
+			i := slices.IndexFunc(c.containerInstances, func(ci ContainerInstance) bool { return matchesArn(ci.Arn, id) })
+			if i < 0 {
+				failures = append(failures, ecsFailure{Arn: id, Reason: "MISSING"})
+				continue
+			}
+			ci := c.containerInstances[i]
+			d := map[string]any{
+				"containerInstanceArn": ci.Arn,
+				"status":               ci.Status,
+				"agentConnected":       ci.AgentConnected,
+			}
+			if ci.EC2InstanceID != "" {
+				d["ec2InstanceId"] = ci.EC2InstanceID
+			}
+			if ci.AvailabilityZone != "" {
+				d["attributes"] = []map[string]string{{"name": "ecs.availability-zone", "value": ci.AvailabilityZone}}
+			}
+			described = append(described, d)
+		}
+		ecsReply(w, map[string]any{"containerInstances": described, "failures": failures})
+
+	case "ListTasks":
+		desired := req.DesiredStatus
+		if desired == "" {
+			desired = "RUNNING"
+		}
+		var arns []string
+		for _, task := range c.tasks {
+			if task.DesiredStatus == desired && (req.ContainerInstance == "" || matchesArn(task.ContainerInstanceArn, req.ContainerInstance)) {
+				arns = append(arns, task.Arn)
+			}
+		}
+		arns, next, err := page(arns, req.NextToken, req.MaxResults, ecsListLimit)
+		if err != nil {
+			ecsError(w, "InvalidParameterException", err.Error())
+			return
+		}
+		listReply(w, "taskArns", arns, next)
+
+	case "DescribeTasks":
+		if len(req.Tasks) > ecsDescribeLimit {
+			ecsError(w, "InvalidParameterException", fmt.Sprintf("tasks can have at most %d items", ecsDescribeLimit))
+			return
+		}
+		var described []map[string]any
+		var failures []ecsFailure
+		for _, id := range req.Tasks {
+			i := slices.IndexFunc(c.tasks, func(task Task) bool { return matchesArn(task.Arn, id) })
+			if i < 0 {
+				failures = append(failures, ecsFailure{Arn: id, Reason: "MISSING"})
+				continue
+			}
+			task := c.tasks[i]
+			t := map[string]any{
+				"taskArn":           task.Arn,
+				"clusterArn":        c.arn,
+				"taskDefinitionArn": task.TaskDefinitionArn,
+				"lastStatus":        task.LastStatus,
+				"desiredStatus":     task.DesiredStatus,
+			}
+			if task.LaunchType != "" {
+				t["launchType"] = task.LaunchType
+			}
+			if task.CapacityProviderName != "" {
+				t["capacityProviderName"] = task.CapacityProviderName
+			}
+			if task.ContainerInstanceArn != "" {
+				t["containerInstanceArn"] = task.ContainerInstanceArn
+			}
+			if task.AvailabilityZone != "" {
+				t["availabilityZone"] = task.AvailabilityZone
+			}
+			described = append(described, t)
+		}
+		ecsReply(w, map[string]any{"tasks": described, "failures": failures})
+
+	case "DescribeTaskDefinition":
+		def, ok := s.taskDefinition(req.TaskDefinition)
+		if !ok {
+			ecsError(w, "ClientException", "Unable to describe task definition.")
+			return
+		}
+		var volumes []map[string]any
+		for _, v := range def.Volumes {
+			volume := map[string]any{"name": v.Name}
+			if v.Driver != "" {
+				volume["dockerVolumeConfiguration"] = map[string]any{
+					"driver":     v.Driver,
+					"driverOpts": v.DriverOpts,
+					"labels":     v.Labels,
+					"scope":      "shared",
+				}
+			}
+			volumes = append(volumes, volume)
+		}
+		ecsReply(w, map[string]any{"taskDefinition": map[string]any{
+			"taskDefinitionArn": def.Arn,
+			"family":            def.Family,
+			"volumes":           volumes,
+		}})
+
+	default:
+		ecsError(w, "UnknownOperationException", "unsupported operation "+operation)
+	}
+}
+
+// cluster finds a cluster by name or ARN.
+func (s *Server) cluster(id string) *cluster {
+	if id == "" {
+		id = "default"
+	}
+	return s.clusters[id[strings.LastIndex(id, "/")+1:]]
+}
+
+// taskDefinition finds a task definition by ARN, family:revision or family.
+func (s *Server) taskDefinition(id string) (TaskDefinition, bool) {
+	for arn, def := range s.taskDefs {
+		if arn == id || strings.HasSuffix(arn, "/"+id) || def.Family == id {
+			return def, true
+		}
+	}
+	return TaskDefinition{}, false
+}
+
+// matchesArn tells whether id is arn or its trailing resource id, the ECS APIs accept both.
+func matchesArn(arn, id string) bool {
+	return arn == id || strings.HasSuffix(arn, "/"+id)
+}
+
+func ecsReply(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(body)
+}
+
+// listReply answers a list call, with a nextToken only when there are more pages.
+func listReply(w http.ResponseWriter, key string, arns []string, next string) {
+	body := map[string]any{key: arns}
+	if next != "" {
+		body["nextToken"] = next
+	}
+	ecsReply(w, body)
+}
+
+func ecsServerError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"__type": "ServerException", "message": "Injected failure."})
+}
+
+func ecsError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
@@ -0,0 +1,178 @@
+// Package fakeaws is an in-memory stand-in for the parts of the ECS and EC2 APIs the plugin calls. It speaks their
+// wire protocols, so the real SDK clients can be pointed at it through their BaseEndpoint, and it enforces the batch
+// and page limits of the real services so that code exceeding them fails the same way. Volumes go through the
+// states of EBS with configurable delays, so that the waits of the plugin are exercised too.
+package fakeaws
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+const (
+	region    = "eu-west-1"
+	accountID = "123456789012"
+	// ecsTargetPrefix prefixes the X-Amz-Target header of every ECS request.
+	ecsTargetPrefix = "AmazonEC2ContainerServiceV20141113."
+)
+
+// Server holds the fake state of both services. The exported methods set it up and inspect the calls it received,
+// they are safe to use while requests are served.
+type Server struct {
+	// Latency delays every response, which makes concurrent calls overlap.
+	Latency time.Duration
+	// AttachDelay and DetachDelay are how long an attachment stays attaching or detaching, CreateDelay how long an
+	// added volume in the creating state takes to turn available.
+	AttachDelay time.Duration
+	DetachDelay time.Duration
+	CreateDelay time.Duration
+	// OnAttached and OnDetached are called when an attachment of volumeID completes or goes away, which is when the
+	// block device of the volume shows up on or leaves the instance. They run with the server locked and must not
+	// call it.
+	OnAttached func(volumeID string, attachment VolumeAttachment)
+	OnDetached func(volumeID string, attachment VolumeAttachment)
+
+	mu          sync.Mutex
+	clusters    map[string]*cluster
+	clusterArns []string
+	taskDefs    map[string]TaskDefinition
+	instances   map[string]Instance
+	volumes     map[string]*volume
+	calls       map[string]int
+	failures    map[string][]string
+	inFlight    int
+	maxInFlight int
+}
+
+// NewServer returns an empty fake.
+func NewServer() *Server {
+	return &Server{
+		clusters:  make(map[string]*cluster),
+		taskDefs:  make(map[string]TaskDefinition),
+		instances: make(map[string]Instance),
+		volumes:   make(map[string]*volume),
+		calls:     make(map[string]int),
+		failures:  make(map[string][]string),
+	}
+}
+
+// Start serves the fake on a local port until the returned server is closed.
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+// Config returns an aws.Config whose clients call the fake at url, with static credentials and no retries so that
+// every failure surfaces at once.
+func Config(url string) aws.Config {
+	return aws.Config{
+		Region:           region,
+		Credentials:      credentials.NewStaticCredentialsProvider("test", "test", ""),
+		BaseEndpoint:     aws.String(url),
+		RetryMaxAttempts: 1,
+	}
+}
+
+// Calls returns how many times operation was called. Forced detaches are also counted as "DetachVolume.Force".
+func (s *Server) Calls(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[operation]
+}
+
+// MaxInFlight returns the most requests that were being served at the same time.
+func (s *Server) MaxInFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxInFlight
+}
+
+// ResetCalls forgets the calls received so far.
+func (s *Server) ResetCalls() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = make(map[string]int)
+	s.maxInFlight = 0
+}
+
+// Fail makes operation fail with a server error for the named cluster, or for every call when clusterName is empty.
+func (s *Server) Fail(operation, clusterName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[operation] = append(s.failures[operation], clusterName)
+}
+
+// ClearFailures makes every operation succeed again.
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = make(map[string][]string)
+}
+
+// failing tells whether Fail was called for operation on clusterID, a cluster name or ARN.
+func (s *Server) failing(operation, clusterID string) bool {
+	for _, name := range s.failures[operation] {
+		if name == "" || (clusterID != "" && matchesArn(ecsArn("cluster/"+name), clusterID)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxInFlight = max(s.maxInFlight, s.inFlight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+	if s.Latency > 0 {
+		time.Sleep(s.Latency)
+	}
+
+	if target := r.Header.Get("X-Amz-Target"); strings.HasPrefix(target, ecsTargetPrefix) {
+		s.serveECS(w, r, strings.TrimPrefix(target, ecsTargetPrefix))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.serveEC2(w, r.Form)
+}
+
+func (s *Server) record(operation string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[operation]++
+}
+
+// page returns the items of a list call starting at nextToken, and the token of the following page.
+func page[T any](items []T, nextToken string, maxResults, limit int) ([]T, string, error) {
+	if maxResults == 0 {
+		maxResults = limit
+	}
+	if maxResults < 1 || maxResults > limit {
+		return nil, "", fmt.Errorf("maxResults must be between 1 and %d", limit)
+	}
+	start := 0
+	if nextToken != "" {
+		if _, err := fmt.Sscanf(nextToken, "offset-%d", &start); err != nil || start > len(items) {
+			return nil, "", fmt.Errorf("invalid nextToken %q", nextToken)
+		}
+	}
+	end := min(start+maxResults, len(items))
+	if end == len(items) {
+		return items[start:end], "", nil
+	}
+	return items[start:end], fmt.Sprintf("offset-%d", end), nil
+}
@@ -0,0 +1,360 @@
+package fakeaws
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// EBSVolume is an EBS volume.
+type EBSVolume struct {
+	ID               string
+	AvailabilityZone string
+	// Size is in GiB and defaults to 1.
+	Size int32
+	// State is creating, available or in-use. AddVolume derives it from Attachments when empty, a creating volume
+	// turns available after CreateDelay.
+	State       string
+	Tags        map[string]string
+	Attachments []VolumeAttachment
+	// StuckDetaching keeps a detach pending until it is forced, like a volume the instance does not let go of.
+	StuckDetaching bool
+}
+
+// VolumeAttachment is the attachment of a volume to an instance.
+type VolumeAttachment struct {
+	InstanceID string
+	Device     string
+	// State is attaching, attached or detaching. It defaults to attached in AddVolume.
+	State string
+}
+
+type volume struct {
+	EBSVolume
+	// readyAt is when a creating volume turns available.
+	readyAt time.Time
+	// pending holds when the attachment to an instance finishes attaching or detaching. An attachment missing from
+	// it stays in its state.
+	pending map[string]time.Time
+}
+
+// AddVolume creates a volume, replacing any volume with the same ID.
+func (s *Server) AddVolume(v EBSVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v.Size == 0 {
+		v.Size = 1
+	}
+	v.Tags = maps.Clone(v.Tags)
+	if v.Tags == nil {
+		v.Tags = make(map[string]string)
+	}
+	v.Attachments = slices.Clone(v.Attachments)
+	for i := range v.Attachments {
+		if v.Attachments[i].State == "" {
+			v.Attachments[i].State = "attached"
+		}
+	}
+	stored := &volume{EBSVolume: v, pending: make(map[string]time.Time)}
+	if v.State == "creating" {
+		stored.readyAt = time.Now().Add(s.CreateDelay)
+	} else {
+		stored.State = volumeState(stored)
+	}
+	s.volumes[v.ID] = stored
+}
+
+// Volume returns the current state of a volume.
+func (s *Server) Volume(id string) (EBSVolume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.volumes[id]
+	if !ok {
+		return EBSVolume{}, false
+	}
+	s.advance(v, time.Now())
+	snapshot := v.EBSVolume
+	snapshot.Tags = maps.Clone(v.Tags)
+	snapshot.Attachments = slices.Clone(v.Attachments)
+	return snapshot, true
+}
+
+func volumeState(v *volume) string {
+	if len(v.Attachments) > 0 {
+		return "in-use"
+	}
+	return "available"
+}
+
+// advance applies the transitions of v that are due at now.
+func (s *Server) advance(v *volume, now time.Time) {
+	if v.State == "creating" {
+		if now.Before(v.readyAt) {
+			return
+		}
+		v.State = "available"
+	}
+	v.Attachments = slices.DeleteFunc(v.Attachments, func(a VolumeAttachment) bool {
+		at, ok := v.pending[a.InstanceID]
+		if !ok || now.Before(at) || a.State != "detaching" {
+			return false
+		}
+		if s.OnDetached != nil {
+			s.OnDetached(v.ID, a)
+		}
+		return true
+	})
+	for i, a := range v.Attachments {
+		if at, ok := v.pending[a.InstanceID]; ok && !now.Before(at) && a.State == "attaching" {
+			v.Attachments[i].State = "attached"
+			if s.OnAttached != nil {
+				s.OnAttached(v.ID, v.Attachments[i])
+			}
+		}
+	}
+	maps.DeleteFunc(v.pending, func(instanceID string, at time.Time) bool { return !now.Before(at) })
+	v.State = volumeState(v)
+}
+
+func (v *volume) attachment(instanceID string) *VolumeAttachment {
+	for i := range v.Attachments {
+		if v.Attachments[i].InstanceID == instanceID {
+			return &v.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// deviceInUse tells whether device is taken on instanceID by an attachment of any volume.
+func (s *Server) deviceInUse(instanceID, device string) bool {
+	for _, v := range s.volumes {
+		if a := v.attachment(instanceID); a != nil && a.Device == device {
+			return true
+		}
+	}
+	return false
+}
+
+type ec2Tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+type ec2VolumeAttachment struct {
+	VolumeID   string `xml:"volumeId"`
+	InstanceID string `xml:"instanceId"`
+	Device     string `xml:"device"`
+	Status     string `xml:"status"`
+}
+
+type ec2Volume struct {
+	VolumeID         string                `xml:"volumeId"`
+	Size             int32                 `xml:"size"`
+	AvailabilityZone string                `xml:"availabilityZone"`
+	Status           string                `xml:"status"`
+	VolumeType       string                `xml:"volumeType"`
+	Attachments      []ec2VolumeAttachment `xml:"attachmentSet>item"`
+	Tags             []ec2Tag              `xml:"tagSet>item"`
+}
+
+type describeVolumesResponse struct {
+	XMLName   xml.Name    `xml:"DescribeVolumesResponse"`
+	RequestID string      `xml:"requestId"`
+	Volumes   []ec2Volume `xml:"volumeSet>item"`
+}
+
+type attachmentResponse struct {
+	XMLName xml.Name
+	ec2VolumeAttachment
+	RequestID string `xml:"requestId"`
+}
+
+type ec2StatusDetail struct {
+	Name          string `xml:"name"`
+	Status        string `xml:"status"`
+	ImpairedSince string `xml:"impairedSince,omitempty"`
+}
+
+type ec2StatusSummary struct {
+	Status  string            `xml:"status"`
+	Details []ec2StatusDetail `xml:"details>item"`
+}
+
+type ec2InstanceStatus struct {
+	InstanceID       string           `xml:"instanceId"`
+	AvailabilityZone string           `xml:"availabilityZone"`
+	State            string           `xml:"instanceState>name"`
+	InstanceStatus   ec2StatusSummary `xml:"instanceStatus"`
+	SystemStatus     ec2StatusSummary `xml:"systemStatus"`
+}
+
+type describeInstanceStatusResponse struct {
+	XMLName   xml.Name            `xml:"DescribeInstanceStatusResponse"`
+	RequestID string              `xml:"requestId"`
+	Statuses  []ec2InstanceStatus `xml:"instanceStatusSet>item"`
+}
+
+type tagsResponse struct {
+	XMLName   xml.Name
+	RequestID string `xml:"requestId"`
+	Return    bool   `xml:"return"`
+}
+
+func (s *Server) describeVolumes(w http.ResponseWriter, form url.Values) {
+	ids := indexedValues(form, "VolumeId")
+	if len(ids) == 0 {
+		ids = slices.Sorted(maps.Keys(s.volumes))
+	}
+	response := describeVolumesResponse{RequestID: "fake"}
+	var missing []string
+	for _, id := range ids {
+		v, ok := s.volumes[id]
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		item := ec2Volume{VolumeID: v.ID, Size: v.Size, AvailabilityZone: v.AvailabilityZone, Status: v.State, VolumeType: "gp3"}
+		for _, a := range v.Attachments {
+			item.Attachments = append(item.Attachments, ec2VolumeAttachment{VolumeID: v.ID, InstanceID: a.InstanceID, Device: a.Device, Status: a.State})
+		}
+		for _, key := range slices.Sorted(maps.Keys(v.Tags)) {
+			item.Tags = append(item.Tags, ec2Tag{Key: key, Value: v.Tags[key]})
+		}
+		response.Volumes = append(response.Volumes, item)
+	}
+	if len(missing) > 0 {
+		ec2Error(w, "InvalidVolume.NotFound", fmt.Sprintf("The volume '%s' does not exist.", missing[0]))
+		return
+	}
+	ec2Reply(w, response)
+}
+
+func (s *Server) attachVolume(w http.ResponseWriter, form url.Values) {
+	volumeID, instanceID, device := form.Get("VolumeId"), form.Get("InstanceId"), form.Get("Device")
+	v, ok := s.volumes[volumeID]
+	if !ok {
+		ec2Error(w, "InvalidVolume.NotFound", fmt.Sprintf("The volume '%s' does not exist.", volumeID))
+		return
+	}
+	instance, ok := s.instances[instanceID]
+	if !ok {
+		ec2Error(w, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", instanceID))
+		return
+	}
+	if instance.AvailabilityZone != v.AvailabilityZone {
+		ec2Error(w, "InvalidVolume.ZoneMismatch", fmt.Sprintf("The volume '%s' is not in the same availability zone as instance '%s'", volumeID, instanceID))
+		return
+	}
+	if v.State != "available" {
+		ec2Error(w, "IncorrectState", fmt.Sprintf("%s is not 'available'.", volumeID))
+		return
+	}
+	if s.deviceInUse(instanceID, device) {
+		ec2Error(w, "InvalidParameterValue", fmt.Sprintf("Invalid value '%s' for unixDevice. Attachment point %s is already in use", device, device))
+		return
+	}
+
+	v.Attachments = append(v.Attachments, VolumeAttachment{InstanceID: instanceID, Device: device, State: "attaching"})
+	v.pending[instanceID] = time.Now().Add(s.AttachDelay)
+	v.State = volumeState(v)
+	ec2Reply(w, attachmentResponse{
+		XMLName:             xml.Name{Local: "AttachVolumeResponse"},
+		ec2VolumeAttachment: ec2VolumeAttachment{VolumeID: volumeID, InstanceID: instanceID, Device: device, Status: "attaching"},
+		RequestID:           "fake",
+	})
+}
+
+func (s *Server) detachVolume(w http.ResponseWriter, form url.Values) {
+	volumeID, instanceID, force := form.Get("VolumeId"), form.Get("InstanceId"), form.Get("Force") == "true"
+	if force {
+		s.calls["DetachVolume.Force"]++
+	}
+	v, ok := s.volumes[volumeID]
+	if !ok {
+		ec2Error(w, "InvalidVolume.NotFound", fmt.Sprintf("The volume '%s' does not exist.", volumeID))
+		return
+	}
+	a := v.attachment(instanceID)
+	if a == nil {
+		ec2Error(w, "IncorrectState", fmt.Sprintf("Volume '%s' is in the 'available' state.", volumeID))
+		return
+	}
+
+	_, pending := v.pending[instanceID]
+	if a.State != "detaching" || force || !pending {
+		a.State = "detaching"
+		delete(v.pending, instanceID)
+		if force || !v.StuckDetaching {
+			v.pending[instanceID] = time.Now().Add(s.DetachDelay)
+		}
+	}
+	ec2Reply(w, attachmentResponse{
+		XMLName:             xml.Name{Local: "DetachVolumeResponse"},
+		ec2VolumeAttachment: ec2VolumeAttachment{VolumeID: volumeID, InstanceID: instanceID, Device: a.Device, Status: "detaching"},
+		RequestID:           "fake",
+	})
+}
+
+func (s *Server) describeInstanceStatus(w http.ResponseWriter, form url.Values) {
+	response := describeInstanceStatusResponse{RequestID: "fake"}
+	for _, id := range indexedValues(form, "InstanceId") {
+		instance, ok := s.instances[id]
+		if !ok {
+			ec2Error(w, "InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", id))
+			return
+		}
+		// Only running instances have status checks, the others are listed with IncludeAllInstances
+		if instance.State != "running" && form.Get("IncludeAllInstances") != "true" {
+			continue
+		}
+		status := ec2InstanceStatus{
+			InstanceID:       instance.ID,
+			AvailabilityZone: instance.AvailabilityZone,
+			State:            instance.State,
+			InstanceStatus:   ec2StatusSummary{Status: "ok", Details: []ec2StatusDetail{{Name: "reachability", Status: "passed"}}},
+			SystemStatus:     ec2StatusSummary{Status: "ok", Details: []ec2StatusDetail{{Name: "reachability", Status: "passed"}}},
+		}
+		if instance.State != "running" {
+			status.InstanceStatus = ec2StatusSummary{Status: "not-applicable"}
+			status.SystemStatus = ec2StatusSummary{Status: "not-applicable"}
+		} else if !instance.ImpairedSince.IsZero() {
+			status.InstanceStatus = ec2StatusSummary{Status: "impaired", Details: []ec2StatusDetail{{
+				Name: "reachability", Status: "failed", ImpairedSince: instance.ImpairedSince.UTC().Format(time.RFC3339),
+			}}}
+		}
+		response.Statuses = append(response.Statuses, status)
+	}
+	ec2Reply(w, response)
+}
+
+// changeTags serves CreateTags and DeleteTags, on volumes only.
+func (s *Server) changeTags(w http.ResponseWriter, form url.Values, operation string) {
+	resources := indexedValues(form, "ResourceId")
+	for _, id := range resources {
+		if _, ok := s.volumes[id]; !ok {
+			ec2Error(w, "InvalidID", fmt.Sprintf("The ID '%s' is not valid", id))
+			return
+		}
+	}
+	for _, id := range resources {
+		tags := s.volumes[id].Tags
+		for i := 1; ; i++ {
+			key, ok := form[fmt.Sprintf("Tag.%d.Key", i)]
+			if !ok {
+				break
+			}
+			value, hasValue := form[fmt.Sprintf("Tag.%d.Value", i)]
+			switch {
+			case operation == "CreateTags":
+				tags[key[0]] = form.Get(fmt.Sprintf("Tag.%d.Value", i))
+			case !hasValue || tags[key[0]] == value[0]:
+				delete(tags, key[0])
+			}
+		}
+	}
+	ec2Reply(w, tagsResponse{XMLName: xml.Name{Local: operation + "Response"}, RequestID: "fake", Return: true})
+}
@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// FakeHost is a Host kept in memory, for tests. Block devices show up with AddDevice, filesystems and mounts are
+// only recorded, and every method can be made to fail with Fail.
+type FakeHost struct {
+	mu       sync.Mutex
+	devices  map[string]*FakeDevice
+	mounts   map[string]string
+	failures map[string]error
+	calls    map[string]int
+	watchers []chan struct{}
+	nextNVMe int
+}
+
+// FakeDevice is a block device of a FakeHost.
+type FakeDevice struct {
+	Name     string
+	Identity NVMeIdentity
+	// ByID is the name of the link to the device in /dev/disk/by-id, if any.
+	ByID       string
+	Filesystem string
+	Root       bool
+}
+
+var _ Host = (*FakeHost)(nil)
+
+// NewFakeHost returns a host with a root disk and nothing mounted.
+func NewFakeHost() *FakeHost {
+	h := &FakeHost{
+		devices:  make(map[string]*FakeDevice),
+		mounts:   make(map[string]string),
+		failures: make(map[string]error),
+		calls:    make(map[string]int),
+		nextNVMe: 1,
+	}
+	h.devices["nvme0n1"] = &FakeDevice{Name: "nvme0n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "volroot"}, Filesystem: "xfs", Root: true}
+	return h
+}
+
+// AddDevice makes device show up, replacing any device of the same name.
+func (h *FakeHost) AddDevice(device FakeDevice) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.devices[device.Name] = &device
+	for _, watcher := range h.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// AddEBSDevice makes the NVMe device of the EBS volume volumeID show up, without a filesystem, and returns its name.
+func (h *FakeHost) AddEBSDevice(volumeID, attachDevice string) string {
+	h.mu.Lock()
+	name := fmt.Sprintf("nvme%dn1", h.nextNVMe)
+	h.nextNVMe++
+	h.mu.Unlock()
+	h.AddDevice(FakeDevice{Name: name, Identity: NVMeIdentity{Model: ebsModel, Serial: ebsSerial(volumeID), VendorDevice: attachDevice}})
+	return name
+}
+
+// RemoveDevice makes the device name go away, as when its volume is detached. Its mounts stay, like stale ones.
+func (h *FakeHost) RemoveDevice(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.devices, name)
+}
+
+// Device returns the current state of the device name.
+func (h *FakeHost) Device(name string) (FakeDevice, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	device, ok := h.devices[name]
+	if !ok {
+		return FakeDevice{}, false
+	}
+	return *device, true
+}
+
+// Mounts returns the mounted devices by mountpoint.
+func (h *FakeHost) Mounts() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return maps.Clone(h.mounts)
+}
+
+// Fail makes method, such as "Format" or "Mount", fail with err until ClearFailures.
+func (h *FakeHost) Fail(method string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[method] = err
+}
+
+// ClearFailures makes every method succeed again.
+func (h *FakeHost) ClearFailures() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures = make(map[string]error)
+}
+
+// Calls returns how many times method was called.
+func (h *FakeHost) Calls(method string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[method]
+}
+
+// call records a call to method and returns the failure injected for it. h.mu must be held.
+func (h *FakeHost) call(method string) error {
+	h.calls[method]++
+	if err := h.failures[method]; err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return nil
+}
+
+func (h *FakeHost) device(name string) (*FakeDevice, error) {
+	device, ok := h.devices[name]
+	if !ok {
+		return nil, fmt.Errorf("no such device %s", name)
+	}
+	return device, nil
+}
+
+func (h *FakeHost) BlockDevices() ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("BlockDevices"); err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(h.devices)), nil
+}
+
+func (h *FakeHost) NVMeIdentity(name string) (NVMeIdentity, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("NVMeIdentity"); err != nil {
+		return NVMeIdentity{}, err
+	}
+	device, err := h.device(name)
+	if err != nil {
+		return NVMeIdentity{}, err
+	}
+	return device.Identity, nil
+}
+
+func (h *FakeHost) DiskByID(id string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("DiskByID"); err != nil {
+		return "", err
+	}
+	for _, device := range h.devices {
+		if device.ByID == id {
+			return device.Name, nil
+		}
+	}
+	return "", nil
+}
+
+func (h *FakeHost) RootDisks() map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	roots := make(map[string]bool)
+	for _, device := range h.devices {
+		if device.Root {
+			roots[device.Name] = true
+		}
+	}
+	return roots
+}
+
+func (h *FakeHost) WatchBlockDevices(ctx context.Context) (<-chan struct{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("WatchBlockDevices"); err != nil {
+		return nil, err
+	}
+	watcher := make(chan struct{}, 1)
+	h.watchers = append(h.watchers, watcher)
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.watchers = slices.DeleteFunc(h.watchers, func(w chan struct{}) bool { return w == watcher })
+	}()
+	return watcher, nil
+}
+
+func (h *FakeHost) Filesystem(ctx context.Context, device string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("Filesystem"); err != nil {
+		return "", err
+	}
+	d, err := h.device(device)
+	if err != nil {
+		return "", err
+	}
+	return d.Filesystem, nil
+}
+
+func (h *FakeHost) Format(ctx context.Context, device, fsType string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("Format"); err != nil {
+		return err
+	}
+	d, err := h.device(device)
+	if err != nil {
+		return err
+	}
+	if h.mountpoint(device) != "" {
+		return fmt.Errorf("%s is mounted", device)
+	}
+	d.Filesystem = fsType
+	return nil
+}
+
+// mountpoint returns where device is mounted. h.mu must be held.
+func (h *FakeHost) mountpoint(device string) string {
+	for _, target := range slices.Sorted(maps.Keys(h.mounts)) {
+		if h.mounts[target] == device {
+			return target
+		}
+	}
+	return ""
+}
+
+func (h *FakeHost) Mountpoint(ctx context.Context, device string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("Mountpoint"); err != nil {
+		return "", err
+	}
+	if _, err := h.device(device); err != nil {
+		return "", err
+	}
+	return h.mountpoint(device), nil
+}
+
+// Mount checks what the kernel would: the device exists and has a filesystem of that type, and target is a
+// directory nothing is mounted on yet.
+func (h *FakeHost) Mount(ctx context.Context, device, target, fsType string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("Mount"); err != nil {
+		return err
+	}
+	d, err := h.device(device)
+	if err != nil {
+		return err
+	}
+	if d.Filesystem != fsType {
+		return fmt.Errorf("%s has no %s filesystem", device, fsType)
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		return fmt.Errorf("mountpoint %s is not a directory", target)
+	}
+	if mounted, ok := h.mounts[target]; ok {
+		return fmt.Errorf("%s is already mounted on %s", mounted, target)
+	}
+	h.mounts[target] = device
+	return nil
+}
+
+func (h *FakeHost) Unmount(ctx context.Context, target string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.call("Unmount"); err != nil {
+		return err
+	}
+	if _, ok := h.mounts[target]; !ok {
+		return fmt.Errorf("%s: %w", target, ErrNotMounted)
+	}
+	delete(h.mounts, target)
+	return nil
+}
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	// ForceStealTag is the volume tag, and the Create option, that lets a volume be taken from a holder that
+	// fencing would otherwise protect.
+	ForceStealTag = "force-steal"
+
+	fenceDecisionsFile = "fencing-decisions.jsonl"
+)
+
+// FenceDecision is the outcome of fencing the instance that holds a volume, before detaching it from there.
+type FenceDecision struct {
+	Time    time.Time `json:"time"`
+	Volume  string    `json:"volume"`
+	Holder  string    `json:"holder"`
+	Allowed bool      `json:"allowed"`
+	Reasons []string  `json:"reasons"`
+}
+
+// Fencer decides whether a volume can be detached from the instance holding it. The holder must be stopped,
+// terminated or unreachable for longer than the grace period, so that nothing there can still be writing to it.
+type Fencer struct {
+	mu          sync.Mutex
+	unreachable map[string]time.Time
+	cfg         *Config
+	ec2Client   EC2API
+	// index resolves the clusters the holder is looked for in, the same ones the in-use check scans
+	index *TaskIndex
+	// decisions is the fencing decisions file of the state directory, rotated like the log file
+	decisions *lumberjack.Logger
+}
+
+func NewFencer(cfg *Config, ec2Client EC2API, index *TaskIndex) *Fencer {
+	decisions := &lumberjack.Logger{
+		Filename:   filepath.Join(cfg.StateDir, fenceDecisionsFile),
+		MaxSize:    cfg.Log.FileMaxSizeMB,
+		MaxAge:     cfg.Log.FileMaxAgeDays,
+		MaxBackups: cfg.Log.FileMaxBackups,
+	}
+	return &Fencer{unreachable: make(map[string]time.Time), cfg: cfg, ec2Client: ec2Client, index: index, decisions: decisions}
+}
+
+// Close closes the fencing decisions file.
+func (f *Fencer) Close() error {
+	return f.decisions.Close()
+}
+
+// Check fences holder, the instance volume is attached to, and records the decision. forceSteal, or the
+// force-steal tag on the volume, allows the detach whatever the holder looks like.
+func (f *Fencer) Check(ctx context.Context, volume *ec2types.Volume, holder string, forceSteal bool) FenceDecision {
+	volumeID := aws.ToString(volume.VolumeId)
+	ctx, span := startSpan(ctx, "FenceHolder", attribute.String("volume.id", volumeID), attribute.String("instance.id", holder))
+	defer span.End()
+
+	decision := FenceDecision{Time: time.Now(), Volume: volumeID, Holder: holder}
+	decision.Allowed, decision.Reasons = f.evaluate(ctx, holder)
+
+	if !decision.Allowed {
+		if forceSteal {
+			decision.Allowed = true
+			decision.Reasons = append(decision.Reasons, "force-steal was requested when the volume was created")
+		} else if hasForceStealTag(volume) {
+			decision.Allowed = true
+			decision.Reasons = append(decision.Reasons, "the volume is tagged "+ForceStealTag)
+		}
+	}
+
+	span.SetAttributes(attribute.Bool("fence.allowed", decision.Allowed), attribute.StringSlice("fence.reasons", decision.Reasons))
+	f.record(ctx, decision)
+	return decision
+}
+
+// evaluate looks at the EC2 state, the status checks and the ECS container instance of holder.
+func (f *Fencer) evaluate(ctx context.Context, holder string) (bool, []string) {
+	instances, err := f.ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{InstanceIds: []string{holder}})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		f.forget(holder)
+		return true, []string{"the holder instance does not exist anymore"}
+	} else if err != nil {
+		return false, []string{fmt.Sprintf("cannot describe the holder instance: %v", err)}
+	}
+	if len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		f.forget(holder)
+		return true, []string{"the holder instance does not exist anymore"}
+	}
+
+	instance := instances.Reservations[0].Instances[0]
+	if instance.State != nil {
+		switch instance.State.Name {
+		case ec2types.InstanceStateNameStopped, ec2types.InstanceStateNameTerminated:
+			f.forget(holder)
+			return true, []string{fmt.Sprintf("the holder instance is %s", instance.State.Name)}
+		}
+	}
+
+	var reasons []string
+	var impairedSince time.Time
+	statuses, err := f.ec2Client.DescribeInstanceStatus(ctx, &ec2.DescribeInstanceStatusInput{InstanceIds: []string{holder}, IncludeAllInstances: aws.Bool(true)})
+	if err != nil {
+		return false, []string{fmt.Sprintf("cannot get the status checks of the holder: %v", err)}
+	}
+	for _, status := range statuses.InstanceStatuses {
+		checks := []struct {
+			name    string
+			summary *ec2types.InstanceStatusSummary
+		}{{"instance", status.InstanceStatus}, {"system", status.SystemStatus}}
+		for _, check := range checks {
+			name, summary := check.name, check.summary
+			if summary == nil || summary.Status != ec2types.SummaryStatusImpaired {
+				continue
+			}
+			reasons = append(reasons, fmt.Sprintf("the %s status check of the holder is impaired", name))
+			for _, detail := range summary.Details {
+				if detail.ImpairedSince != nil && (impairedSince.IsZero() || detail.ImpairedSince.Before(impairedSince)) {
+					impairedSince = *detail.ImpairedSince
+				}
+			}
+		}
+	}
+
+	agentReasons, err := containerInstanceReasons(ctx, f.index, holder)
+	if err != nil {
+		return false, append(reasons, fmt.Sprintf("cannot check the ECS container instance of the holder: %v", err))
+	}
+	reasons = append(reasons, agentReasons...)
+
+	if len(reasons) == 0 {
+		f.forget(holder)
+		state := "running"
+		if instance.State != nil {
+			state = string(instance.State.Name)
+		}
+		return false, []string{fmt.Sprintf("the holder instance is %s and reachable", state)}
+	}
+
+	since := f.unreachableSince(holder, impairedSince)
+	grace := time.Duration(f.cfg.Fencing.GracePeriod)
+	if elapsed := time.Since(since); elapsed < grace {
+		return false, append(reasons, fmt.Sprintf("the holder has been unreachable for %s, less than the grace period of %s", elapsed.Round(time.Second), grace))
+	}
+	return true, append(reasons, fmt.Sprintf("the holder has been unreachable since %s, past the grace period of %s", since.Format(time.RFC3339), grace))
+}
+
+// containerInstanceReasons reports what makes the ECS container instance of holder look unreachable, in the
+// clusters of the scope of the index. An instance that is not registered in any of them gives no reason either way.
+func containerInstanceReasons(ctx context.Context, idx *TaskIndex, holder string) ([]string, error) {
+	clusters, unverified, err := idx.clusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Not finding the holder there only means fewer reasons to take its volume
+	for cluster, reason := range unverified {
+		slog.WarnContext(ctx, "Cannot look for the holder in cluster", "cluster", cluster, "error", reason)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reasons []string
+	var errs []error
+	for _, cluster := range clusters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := clusterInstanceReasons(ctx, idx, cluster, holder)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			reasons = append(reasons, found...)
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	slices.Sort(reasons)
+	return reasons, nil
+}
+
+// clusterInstanceReasons reports what makes the container instance of holder in cluster look unreachable.
+func clusterInstanceReasons(ctx context.Context, idx *TaskIndex, cluster, holder string) ([]string, error) {
+	listed, err := withCallSlot(ctx, idx, func() (*ecs.ListContainerInstancesOutput, error) {
+		return idx.ecsClient.ListContainerInstances(ctx, &ecs.ListContainerInstancesInput{Cluster: aws.String(cluster), Filter: aws.String("ec2InstanceId == " + holder)})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the container instances of %s: %w", cluster, err)
+	}
+	if len(listed.ContainerInstanceArns) == 0 {
+		return nil, nil
+	}
+	described, err := withCallSlot(ctx, idx, func() (*ecs.DescribeContainerInstancesOutput, error) {
+		return idx.ecsClient.DescribeContainerInstances(ctx, &ecs.DescribeContainerInstancesInput{Cluster: aws.String(cluster), ContainerInstances: listed.ContainerInstanceArns})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot describe the container instances of %s: %w", cluster, err)
+	}
+
+	var reasons []string
+	for _, ci := range described.ContainerInstances {
+		if !ci.AgentConnected {
+			reasons = append(reasons, fmt.Sprintf("the ECS agent of the holder is disconnected from %s", cluster))
+		}
+		if status := aws.ToString(ci.Status); status == "INACTIVE" || status == "DEREGISTERING" {
+			reasons = append(reasons, fmt.Sprintf("the holder container instance is %s in %s", status, cluster))
+		}
+	}
+	return reasons, nil
+}
+
+// unreachableSince returns when holder was first seen unreachable, preferring the time EC2 reports.
+func (f *Fencer) unreachableSince(holder string, reported time.Time) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	since, ok := f.unreachable[holder]
+	if !ok {
+		since = time.Now()
+	}
+	if !reported.IsZero() && reported.Before(since) {
+		since = reported
+	}
+	f.unreachable[holder] = since
+	return since
+}
+
+func (f *Fencer) forget(holder string) {
+	f.mu.Lock()
+	delete(f.unreachable, holder)
+	f.mu.Unlock()
+}
+
+// record logs decision and appends it to the fencing decisions of the state directory, one JSON line per write so
+// that a rotation never splits one.
+func (f *Fencer) record(ctx context.Context, decision FenceDecision) {
+	level := slog.LevelInfo
+	if !decision.Allowed {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "Fencing decision", "holder", decision.Holder, "allowed", decision.Allowed, "reasons", decision.Reasons)
+
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return
+	}
+	if _, err := f.decisions.Write(append(data, '\n')); err != nil {
+		slog.WarnContext(ctx, "Failed to record fencing decision", "error", err)
+	}
+}
+
+func hasForceStealTag(volume *ec2types.Volume) bool {
+	for _, tag := range volume.Tags {
+		if aws.ToString(tag.Key) == ForceStealTag && strings.EqualFold(aws.ToString(tag.Value), "true") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+func newTestFencer(t *testing.T, fake *fakeaws.Server) *Fencer {
+	t.Helper()
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	awsCfg := fakeaws.Config(server.URL)
+	cfg := DefaultConfig()
+	cfg.StateDir = t.TempDir()
+	cfg.Fencing.GracePeriod = Duration(time.Minute)
+	ec2Client := ec2.NewFromConfig(awsCfg)
+	fencer := NewFencer(cfg, ec2Client, NewTaskIndex(cfg, ecs.NewFromConfig(awsCfg), ec2Client, testAZ))
+	t.Cleanup(func() { fencer.Close() })
+	return fencer
+}
+
+func TestFencerCheck(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: "i-running", AvailabilityZone: testAZ})
+	fake.AddInstance(fakeaws.Instance{ID: "i-stopped", AvailabilityZone: testAZ, State: "stopped"})
+	fake.AddInstance(fakeaws.Instance{ID: "i-impaired", AvailabilityZone: testAZ, ImpairedSince: time.Now().Add(-time.Hour)})
+	fake.AddInstance(fakeaws.Instance{ID: "i-flapping", AvailabilityZone: testAZ, ImpairedSince: time.Now()})
+	fake.AddInstance(fakeaws.Instance{ID: "i-disconnected", AvailabilityZone: testAZ})
+	fake.AddCluster("apps", nil)
+	fake.AddContainerInstance("apps", fakeaws.ContainerInstance{EC2InstanceID: "i-running", Status: "ACTIVE", AgentConnected: true})
+	fake.AddContainerInstance("apps", fakeaws.ContainerInstance{EC2InstanceID: "i-disconnected", Status: "ACTIVE", AgentConnected: false})
+	fencer := newTestFencer(t, fake)
+
+	tests := []struct {
+		holder  string
+		allowed bool
+		reason  string
+	}{
+		{"i-running", false, "running and reachable"},
+		{"i-stopped", true, "is stopped"},
+		{"i-gone", true, "does not exist anymore"},
+		{"i-impaired", true, "past the grace period"},
+		{"i-flapping", false, "less than the grace period"},
+		{"i-disconnected", false, "ECS agent of the holder is disconnected"},
+	}
+	for _, tt := range tests {
+		volume := &ec2types.Volume{VolumeId: aws.String("vol-1")}
+		decision := fencer.Check(context.Background(), volume, tt.holder, false)
+		if decision.Allowed != tt.allowed || !strings.Contains(strings.Join(decision.Reasons, "; "), tt.reason) {
+			t.Errorf("%s: expected allowed=%v with %q, got %+v", tt.holder, tt.allowed, tt.reason, decision)
+		}
+	}
+
+	volume := &ec2types.Volume{VolumeId: aws.String("vol-1"), Tags: []ec2types.Tag{{Key: aws.String(ForceStealTag), Value: aws.String("true")}}}
+	if decision := fencer.Check(context.Background(), volume, "i-running", false); !decision.Allowed {
+		t.Errorf("expected the force-steal tag to allow the detach, got %+v", decision)
+	}
+
+	data, err := os.ReadFile(filepath.Join(fencer.cfg.StateDir, fenceDecisionsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != len(tests)+1 {
+		t.Fatalf("expected %d recorded decisions, got %d", len(tests)+1, lines)
+	}
+}
+
+func TestFencerStatusChecks(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: "i-impaired", AvailabilityZone: testAZ, ImpairedSince: time.Now().Add(-time.Hour)})
+	fencer := newTestFencer(t, fake)
+	volume := &ec2types.Volume{VolumeId: aws.String("vol-1")}
+
+	decision := fencer.Check(context.Background(), volume, "i-impaired", false)
+	reasons := strings.Join(decision.Reasons, "; ")
+	if !decision.Allowed || !strings.Contains(reasons, "instance status check of the holder is impaired") {
+		t.Fatalf("expected the impaired status check to be reported, got %+v", decision)
+	}
+	// The time EC2 reports the check as impaired since counts, not when the fencer first saw it
+	if !strings.Contains(reasons, fencer.unreachable["i-impaired"].Format(time.RFC3339)) || time.Since(fencer.unreachable["i-impaired"]) < time.Hour {
+		t.Fatalf("expected the holder to be unreachable since the reported time, got %+v", decision)
+	}
+
+	// Without status checks nothing tells the holder is gone
+	fake.Fail("DescribeInstanceStatus", "")
+	if decision := fencer.Check(context.Background(), volume, "i-impaired", false); decision.Allowed || !strings.Contains(strings.Join(decision.Reasons, "; "), "cannot get the status checks") {
+		t.Fatalf("expected a failed status check to refuse the detach, got %+v", decision)
+	}
+}
+
+func TestFencerGracePeriod(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: "i-disconnected", AvailabilityZone: testAZ})
+	fake.AddCluster("apps", nil)
+	fake.AddContainerInstance("apps", fakeaws.ContainerInstance{EC2InstanceID: "i-disconnected", Status: "ACTIVE", AgentConnected: false})
+	fencer := newTestFencer(t, fake)
+	fencer.cfg.Fencing.GracePeriod = Duration(100 * time.Millisecond)
+	volume := &ec2types.Volume{VolumeId: aws.String("vol-1")}
+
+	// EC2 reports no time, the grace period runs from the first check that saw the holder unreachable
+	if decision := fencer.Check(context.Background(), volume, "i-disconnected", false); decision.Allowed {
+		t.Fatalf("expected the holder to be protected during the grace period, got %+v", decision)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if decision := fencer.Check(context.Background(), volume, "i-disconnected", false); !decision.Allowed || !strings.Contains(strings.Join(decision.Reasons, "; "), "past the grace period") {
+		t.Fatalf("expected the holder to be fenced after the grace period, got %+v", decision)
+	}
+
+}
+
+func TestFencerForceSteal(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: "i-running", AvailabilityZone: testAZ})
+	fencer := newTestFencer(t, fake)
+
+	tests := []struct {
+		name       string
+		tags       []ec2types.Tag
+		forceSteal bool
+		allowed    bool
+		reason     string
+	}{
+		{name: "none", allowed: false, reason: "running and reachable"},
+		{name: "option", forceSteal: true, allowed: true, reason: "force-steal was requested"},
+		{name: "tag", tags: []ec2types.Tag{{Key: aws.String(ForceStealTag), Value: aws.String("true")}}, allowed: true, reason: "tagged " + ForceStealTag},
+		{name: "tag turned off", tags: []ec2types.Tag{{Key: aws.String(ForceStealTag), Value: aws.String("false")}}, allowed: false, reason: "running and reachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := &ec2types.Volume{VolumeId: aws.String("vol-1"), Tags: tt.tags}
+			decision := fencer.Check(context.Background(), volume, "i-running", tt.forceSteal)
+			if decision.Allowed != tt.allowed || !strings.Contains(strings.Join(decision.Reasons, "; "), tt.reason) {
+				t.Fatalf("expected allowed=%v with %q, got %+v", tt.allowed, tt.reason, decision)
+			}
+		})
+	}
+}
+
+func TestFencerClusterScope(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: "i-holder", AvailabilityZone: testAZ})
+	fake.AddCluster("apps", map[string]string{"team": "apps"})
+	fake.AddCluster("other", nil)
+	fake.AddContainerInstance("other", fakeaws.ContainerInstance{EC2InstanceID: "i-holder", Status: "ACTIVE", AgentConnected: false})
+	// IAM scoped to the apps cluster denies the others
+	fake.Fail("ListContainerInstances", "other")
+	fake.Fail("DescribeContainerInstances", "other")
+	volume := &ec2types.Volume{VolumeId: aws.String("vol-1")}
+
+	tests := []struct {
+		name     string
+		scope    string
+		clusters []string
+		tags     []string
+		allowed  bool
+		reason   string
+	}{
+		{name: "all", scope: ClusterScopeAll, reason: "cannot check the ECS container instance"},
+		{name: "list", scope: ClusterScopeList, clusters: []string{"apps"}, reason: "running and reachable"},
+		{name: "tags", scope: ClusterScopeAll, tags: []string{"team=apps"}, reason: "running and reachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fencer := newTestFencer(t, fake)
+			fencer.cfg.ECS.ClusterScope = tt.scope
+			fencer.cfg.ECS.Clusters = tt.clusters
+			fencer.cfg.ECS.ClusterTags = tt.tags
+			fake.ResetCalls()
+
+			// The disconnected agent of the other cluster is out of scope, it is not looked at
+			decision := fencer.Check(context.Background(), volume, "i-holder", false)
+			if decision.Allowed != tt.allowed || !strings.Contains(strings.Join(decision.Reasons, "; "), tt.reason) {
+				t.Fatalf("expected allowed=%v with %q, got %+v", tt.allowed, tt.reason, decision)
+			}
+			if tt.scope == ClusterScopeList && fake.Calls("ListClusters") != 0 {
+				t.Error("the list scope should not list the clusters of the region")
+			}
+		})
+	}
+
+	// In scope, the disconnected agent counts
+	fake.ClearFailures()
+	fencer := newTestFencer(t, fake)
+	fencer.cfg.ECS.ClusterScope = ClusterScopeList
+	fencer.cfg.ECS.Clusters = []string{"other"}
+	if decision := fencer.Check(context.Background(), volume, "i-holder", false); !strings.Contains(strings.Join(decision.Reasons, "; "), "ECS agent of the holder is disconnected") {
+		t.Fatalf("expected the disconnected agent to be reported, got %+v", decision)
+	}
+}
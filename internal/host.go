@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotMounted is returned by Host.Unmount for a target nothing is mounted on.
+var ErrNotMounted = errors.New("not mounted")
+
+// Host is the machine the block devices of the volumes show up on and get mounted. Devices are named as in
+// /sys/block, such as nvme1n1. RealHost works on the actual machine, FakeHost keeps a model of one in memory.
+type Host interface {
+	// BlockDevices lists the block devices of the machine.
+	BlockDevices() ([]string, error)
+	// NVMeIdentity identifies the controller of the NVMe block device name.
+	NVMeIdentity(name string) (NVMeIdentity, error)
+	// DiskByID resolves the udev link id of /dev/disk/by-id to a block device, or returns "" when there is none.
+	DiskByID(id string) (string, error)
+	// RootDisks returns the block devices holding the root filesystems, which never back a volume.
+	RootDisks() map[string]bool
+	// WatchBlockDevices signals on the returned channel whenever a block device is added or changed, until ctx is
+	// done. Missed signals are caught up by scanning again.
+	WatchBlockDevices(ctx context.Context) (<-chan struct{}, error)
+
+	// Filesystem returns the type of the filesystem on device, or "" when it has none.
+	Filesystem(ctx context.Context, device string) (string, error)
+	// Format creates a filesystem of type fsType on device.
+	Format(ctx context.Context, device, fsType string) error
+	// Mountpoint returns where device is mounted, or "" when it is not.
+	Mountpoint(ctx context.Context, device string) (string, error)
+	// Mount mounts the fsType filesystem of device on target, an existing directory.
+	Mount(ctx context.Context, device, target, fsType string) error
+	// Unmount unmounts target, failing with ErrNotMounted when nothing is mounted there.
+	Unmount(ctx context.Context, target string) error
+}
+
+// RealHost is the machine the plugin runs on. Mounts go through the mount syscalls, filesystems are probed with
+// blkid and created with mkfs.
+type RealHost struct {
+	// SysBlock lists the block devices, /sys/block.
+	SysBlock string
+	// DiskByIDDir holds the udev links to the disks by ID, /dev/disk/by-id.
+	DiskByIDDir string
+	// Dev holds the device nodes, /dev.
+	Dev string
+}
+
+var _ Host = (*RealHost)(nil)
+
+func NewRealHost(cfg *Config) *RealHost {
+	return &RealHost{SysBlock: cfg.Device.SysBlock, DiskByIDDir: cfg.Device.DiskByIDDir, Dev: cfg.Device.Dev}
+}
+
+// devicePath returns the device node of the block device name.
+func (h *RealHost) devicePath(name string) string {
+	return filepath.Join(h.Dev, strings.TrimPrefix(name, "/dev/"))
+}
+
+func (h *RealHost) BlockDevices() ([]string, error) {
+	entries, err := os.ReadDir(h.SysBlock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", h.SysBlock, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// NVMeIdentity sends an identify command to the controller, falling back to the model and serial sysfs exposes when
+// it cannot be sent.
+func (h *RealHost) NVMeIdentity(name string) (NVMeIdentity, error) {
+	if identity, err := identifyNVMeController(h.SysBlock, h.Dev, name); err == nil {
+		return identity, nil
+	}
+
+	model, err := os.ReadFile(filepath.Join(h.SysBlock, name, "device", "model"))
+	if err != nil {
+		return NVMeIdentity{}, err
+	}
+	serial, err := os.ReadFile(filepath.Join(h.SysBlock, name, "device", "serial"))
+	if err != nil {
+		return NVMeIdentity{}, err
+	}
+	return NVMeIdentity{Model: strings.TrimSpace(string(model)), Serial: strings.TrimSpace(string(serial))}, nil
+}
+
+func (h *RealHost) DiskByID(id string) (string, error) {
+	link := filepath.Join(h.DiskByIDDir, id)
+	target, err := filepath.EvalSymlinks(link)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", link, err)
+	}
+	return filepath.Base(target), nil
+}
+
+func (h *RealHost) RootDisks() map[string]bool {
+	return rootDisks()
+}
+
+func (h *RealHost) WatchBlockDevices(ctx context.Context) (<-chan struct{}, error) {
+	return watchBlockDevices(ctx)
+}
+
+// Filesystem probes the superblocks of device with blkid, which exits with 2 when it finds no signature at all.
+func (h *RealHost) Filesystem(ctx context.Context, device string) (string, error) {
+	output, err := runCommand(ctx, "blkid", "-p", "-o", "value", "-s", "TYPE", h.devicePath(device))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to run blkid on %s: %v", device, err)
+	}
+	return output, nil
+}
+
+func (h *RealHost) Format(ctx context.Context, device, fsType string) error {
+	if _, err := runCommand(ctx, "mkfs."+fsType, h.devicePath(device)); err != nil {
+		return fmt.Errorf("failed to run mkfs.%s on %s: %v", fsType, device, err)
+	}
+	return nil
+}
+
+func (h *RealHost) Mountpoint(ctx context.Context, device string) (string, error) {
+	return findMountpoint(h.devicePath(device))
+}
+
+func (h *RealHost) Mount(ctx context.Context, device, target, fsType string) error {
+	return mountDevice(ctx, h.devicePath(device), target, fsType)
+}
+
+func (h *RealHost) Unmount(ctx context.Context, target string) error {
+	return unmountPath(ctx, target)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// splitDev splits a device number into its major and minor numbers, as the kernel encodes them.
+func splitDev(dev uint64) (major, minor uint64) {
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff, dev&0xff | (dev>>12)&^0xff
+}
+
+// findMountpoint returns where the block device at devicePath is mounted in the mount namespace of the plugin, or
+// "" when it is not. Mounts are matched by device number, so that any name of the device is recognized.
+func findMountpoint(devicePath string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(devicePath, &st); err != nil {
+		return "", fmt.Errorf("failed to stat %s: %v", devicePath, err)
+	}
+	major, minor := splitDev(st.Rdev)
+	want := fmt.Sprintf("%d:%d", major, minor)
+
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", mountInfoPath, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options... - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		// The root of the filesystem rather than a bind mount of one of its directories
+		if len(fields) >= 5 && fields[2] == want && fields[3] == "/" {
+			return unescapeMountInfo(fields[4]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", mountInfoPath, err)
+	}
+	return "", nil
+}
+
+// unescapeMountInfo decodes the octal escapes mountinfo uses for spaces, tabs, newlines and backslashes.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func mountDevice(ctx context.Context, devicePath, target, fsType string) (err error) {
+	_, span := startSpan(ctx, "mount", attribute.String("mount.device", devicePath), attribute.String("mount.target", target), attribute.String("mount.fs_type", fsType))
+	defer func() { endSpan(span, err) }()
+
+	if err := syscall.Mount(devicePath, target, fsType, 0, ""); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %w", devicePath, target, err)
+	}
+	return nil
+}
+
+func unmountPath(ctx context.Context, target string) (err error) {
+	_, span := startSpan(ctx, "umount", attribute.String("mount.target", target))
+	defer func() { endSpan(span, err) }()
+
+	err = syscall.Unmount(target, 0)
+	// EINVAL is what the kernel says about a target that is not a mountpoint
+	if errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("%s: %w", target, ErrNotMounted)
+	} else if err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", target, err)
+	}
+	return nil
+}
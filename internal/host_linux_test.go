@@ -0,0 +1,17 @@
+package internal
+
+import "testing"
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := map[string]string{
+		"/mnt/volumes/vol-1":       "/mnt/volumes/vol-1",
+		`/mnt/my\040volume`:        "/mnt/my volume",
+		`/mnt/tab\011and\134slash`: "/mnt/tab\tand\\slash",
+		`/mnt/trailing\04`:         `/mnt/trailing\04`,
+	}
+	for escaped, want := range tests {
+		if got := unescapeMountInfo(escaped); got != want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", escaped, got, want)
+		}
+	}
+}
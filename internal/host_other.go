@@ -0,0 +1,22 @@
+//go:build !linux
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+var errMountUnsupported = errors.New("mounting volumes is only available on Linux")
+
+func findMountpoint(devicePath string) (string, error) {
+	return "", errMountUnsupported
+}
+
+func mountDevice(ctx context.Context, devicePath, target, fsType string) error {
+	return errMountUnsupported
+}
+
+func unmountPath(ctx context.Context, target string) error {
+	return errMountUnsupported
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Lease records which instance owns a volume, and until when.
+type Lease struct {
+	Volume    string
+	Owner     string
+	Heartbeat time.Time
+	Expires   time.Time
+}
+
+// LeaseHeldError is returned when another owner holds an unexpired lease on the volume.
+type LeaseHeldError struct {
+	Lease Lease
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("volume %s is leased by %s until %s", e.Lease.Volume, e.Lease.Owner, e.Lease.Expires.Format(time.RFC3339))
+}
+
+// LeaseBackend stores the leases shared by the plugins of every host.
+type LeaseBackend interface {
+	// Acquire takes or renews the lease of volume for owner until now+ttl, unless someone else holds an unexpired
+	// one, in which case it returns a *LeaseHeldError.
+	Acquire(ctx context.Context, volume, owner string, ttl time.Duration) (Lease, error)
+	// Release gives up the lease of volume, if owner still holds it.
+	Release(ctx context.Context, volume, owner string) error
+}
+
+// NewLeaseBackend returns the backend chosen by cfg.Lease.Backend, or nil when leases are disabled. The dynamodb
+// backend gets its own client from awsCfg.
+func NewLeaseBackend(cfg *Config, awsCfg aws.Config, ec2Client EC2API) (LeaseBackend, error) {
+	switch cfg.Lease.Backend {
+	case "none":
+		return nil, nil
+	case "tags":
+		return NewTagLeases(ec2Client, time.Duration(cfg.Lease.TagSettle)), nil
+	case "dynamodb":
+		client := dynamodb.NewFromConfig(awsCfg, func(o *dynamodb.Options) {
+			if cfg.Lease.DynamoDBEndpoint != "" {
+				o.BaseEndpoint = aws.String(cfg.Lease.DynamoDBEndpoint)
+			}
+		})
+		return NewDynamoDBLeases(client, cfg.Lease.Table), nil
+	default:
+		return nil, fmt.Errorf("unknown lease backend %q", cfg.Lease.Backend)
+	}
+}
+
+// Leases keeps the leases of the volumes mounted on this instance, renewing them until they are released. A lease
+// found held by someone else while renewing it is lost: another host may have taken the volume over, so it is not
+// acquired again before it is released.
+type Leases struct {
+	backend LeaseBackend
+	owner   string
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	renewals map[string]*leaseRenewal
+	lost     map[string]*LeaseHeldError
+}
+
+type leaseRenewal struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLeases returns the leases of owner on backend, or nil when backend is nil, which makes every method a no-op.
+func NewLeases(backend LeaseBackend, owner string, ttl time.Duration) *Leases {
+	if backend == nil {
+		return nil
+	}
+	return &Leases{backend: backend, owner: owner, ttl: ttl, renewals: make(map[string]*leaseRenewal), lost: make(map[string]*LeaseHeldError)}
+}
+
+// Acquire takes the lease of volume and keeps renewing it every third of its ttl until Release. A lost lease is
+// refused until then.
+func (l *Leases) Acquire(ctx context.Context, volume string) (err error) {
+	if l == nil {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "AcquireLease")
+	defer func() { endSpan(span, err) }()
+
+	l.mu.Lock()
+	lost := l.lost[volume]
+	l.mu.Unlock()
+	if lost != nil {
+		return fmt.Errorf("the lease of volume %s was lost while it was mounted, it must be unmounted before it is mounted again: %w", volume, lost)
+	}
+
+	lease, err := l.backend.Acquire(ctx, volume, l.owner, l.ttl)
+	if err != nil {
+		return fmt.Errorf("failed to acquire the lease of volume %s: %w", volume, err)
+	}
+	slog.InfoContext(ctx, "Acquired volume lease", "expires", lease.Expires)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.renewals[volume]; ok {
+		return nil
+	}
+	// Renewals outlive the request that acquired the lease
+	renewCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	renewal := &leaseRenewal{cancel: cancel, done: make(chan struct{})}
+	l.renewals[volume] = renewal
+	go l.renew(renewCtx, volume, renewal.done)
+	return nil
+}
+
+func (l *Leases) renew(ctx context.Context, volume string, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := l.backend.Acquire(ctx, volume, l.owner, l.ttl)
+			var held *LeaseHeldError
+			switch {
+			case errors.As(err, &held):
+				slog.ErrorContext(ctx, "Lost the volume lease, another host may take the volume over", "owner", held.Lease.Owner)
+				l.mu.Lock()
+				l.lost[volume] = held
+				l.mu.Unlock()
+				return
+			case err != nil && ctx.Err() == nil:
+				slog.WarnContext(ctx, "Failed to renew the volume lease", "error", err)
+			}
+		}
+	}
+}
+
+// Release stops renewing the lease of volume and gives it up, or forgets it was lost.
+func (l *Leases) Release(ctx context.Context, volume string) (err error) {
+	if l == nil {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "ReleaseLease")
+	defer func() { endSpan(span, err) }()
+
+	l.mu.Lock()
+	renewal, ok := l.renewals[volume]
+	delete(l.renewals, volume)
+	l.mu.Unlock()
+	if ok {
+		// A renewal still in flight would write the lease back after it is released
+		renewal.cancel()
+		<-renewal.done
+	}
+	l.mu.Lock()
+	delete(l.lost, volume)
+	l.mu.Unlock()
+
+	if err := l.backend.Release(ctx, volume, l.owner); err != nil {
+		return fmt.Errorf("failed to release the lease of volume %s: %w", volume, err)
+	}
+	slog.InfoContext(ctx, "Released volume lease")
+	return nil
+}
+
+// Reacquire takes back the leases of the volumes under cfg.MountRoot that are still mounted for a container. Leases
+// are only renewed in memory, those of the previous run of the plugin stopped being renewed with it.
+func (l *Leases) Reacquire(ctx context.Context, cfg *Config, mounts *MountRefs) error {
+	if l == nil {
+		return nil
+	}
+	names, err := VolumeNames(cfg)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to list volumes: %w", err)
+	}
+	for _, name := range names {
+		volumeCtx := WithVolume(ctx, name)
+		count, err := mounts.Count(name)
+		if err != nil {
+			slog.ErrorContext(volumeCtx, "Failed to read the mounts of the volume, its lease is not taken back", "error", err)
+			continue
+		}
+		if count == 0 {
+			continue
+		}
+		if err := l.Acquire(volumeCtx, name); err != nil {
+			slog.ErrorContext(volumeCtx, "Failed to take back the lease of a mounted volume, another host may take it over", "error", err)
+		}
+	}
+	return nil
+}
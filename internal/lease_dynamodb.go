@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBLeases keeps the leases in a DynamoDB table whose partition key is the string VolumeId. Conditional
+// writes make taking a lease atomic.
+type DynamoDBLeases struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func NewDynamoDBLeases(client *dynamodb.Client, table string) *DynamoDBLeases {
+	return &DynamoDBLeases{client: client, table: table}
+}
+
+func (d *DynamoDBLeases) Acquire(ctx context.Context, volume, owner string, ttl time.Duration) (Lease, error) {
+	now := time.Now()
+	lease := Lease{Volume: volume, Owner: owner, Heartbeat: now, Expires: now.Add(ttl)}
+
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]types.AttributeValue{
+			"VolumeId":  &types.AttributeValueMemberS{Value: volume},
+			"Owner":     &types.AttributeValueMemberS{Value: owner},
+			"Heartbeat": unixMillis(lease.Heartbeat),
+			"ExpiresAt": unixMillis(lease.Expires),
+		},
+		// Owner is a reserved word, hence the placeholder
+		ConditionExpression:      aws.String("attribute_not_exists(VolumeId) OR #owner = :owner OR ExpiresAt < :now"),
+		ExpressionAttributeNames: map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: owner},
+			":now":   unixMillis(now),
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		held := Lease{Volume: volume}
+		if item := conditionErr.Item; item != nil {
+			if v, ok := item["Owner"].(*types.AttributeValueMemberS); ok {
+				held.Owner = v.Value
+			}
+			held.Heartbeat = fromUnixMillis(item["Heartbeat"])
+			held.Expires = fromUnixMillis(item["ExpiresAt"])
+		}
+		return Lease{}, &LeaseHeldError{Lease: held}
+	} else if err != nil {
+		return Lease{}, fmt.Errorf("failed to write lease: %w", err)
+	}
+	return lease, nil
+}
+
+func (d *DynamoDBLeases) Release(ctx context.Context, volume, owner string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(d.table),
+		Key:                       map[string]types.AttributeValue{"VolumeId": &types.AttributeValueMemberS{Value: volume}},
+		ConditionExpression:       aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "Owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":owner": &types.AttributeValueMemberS{Value: owner}},
+	})
+
+	// Somebody else took over an expired lease, there is nothing left to release
+	var conditionErr *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &conditionErr) {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+	return nil
+}
+
+func unixMillis(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+func fromUnixMillis(v types.AttributeValue) time.Time {
+	n, ok := v.(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	leaseOwnerTag   = "polarity-ecs-ebs:lease-owner"
+	leaseExpiresTag = "polarity-ecs-ebs:lease-expires"
+	leaseTokenTag   = "polarity-ecs-ebs:lease-token"
+)
+
+// TagLeases keeps the leases in tags of the volumes themselves. EC2 has no conditional tag writes, so a lease is
+// written with a random token and only counts as taken when the token is still there after settle: of two hosts
+// writing at the same time, the last write wins and the other one sees it. DynamoDBLeases has no such window.
+type TagLeases struct {
+	client EC2API
+	settle time.Duration
+
+	mu sync.Mutex
+	// tokens holds the token last written for each volume, a lease rewritten since then is not ours to release
+	tokens map[string]string
+}
+
+func NewTagLeases(client EC2API, settle time.Duration) *TagLeases {
+	return &TagLeases{client: client, settle: settle, tokens: make(map[string]string)}
+}
+
+func (t *TagLeases) Acquire(ctx context.Context, volume, owner string, ttl time.Duration) (Lease, error) {
+	current, _, err := t.read(ctx, volume)
+	if err != nil {
+		return Lease{}, err
+	}
+	now := time.Now()
+	if current.Owner != "" && current.Owner != owner && now.Before(current.Expires) {
+		return Lease{}, &LeaseHeldError{Lease: current}
+	}
+
+	tokenBytes := make([]byte, 8)
+	rand.Read(tokenBytes)
+	token := hex.EncodeToString(tokenBytes)
+
+	lease := Lease{Volume: volume, Owner: owner, Heartbeat: now, Expires: now.Add(ttl)}
+	_, err = t.client.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{volume},
+		Tags: []types.Tag{
+			{Key: aws.String(leaseOwnerTag), Value: aws.String(owner)},
+			{Key: aws.String(leaseExpiresTag), Value: aws.String(lease.Expires.UTC().Format(time.RFC3339Nano))},
+			{Key: aws.String(leaseTokenTag), Value: aws.String(token)},
+		},
+	})
+	if err != nil {
+		return Lease{}, fmt.Errorf("failed to tag lease: %w", err)
+	}
+	t.mu.Lock()
+	t.tokens[volume] = token
+	t.mu.Unlock()
+
+	// Renewing a lease that is already ours cannot race with anyone, unless it expired and is up for grabs
+	if current.Owner == owner && now.Before(current.Expires) {
+		return lease, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return Lease{}, ctx.Err()
+	case <-time.After(t.settle):
+	}
+	written, writtenToken, err := t.read(ctx, volume)
+	if err != nil {
+		return Lease{}, err
+	}
+	if writtenToken != token {
+		return Lease{}, &LeaseHeldError{Lease: written}
+	}
+	return lease, nil
+}
+
+func (t *TagLeases) Release(ctx context.Context, volume, owner string) error {
+	t.mu.Lock()
+	ours := t.tokens[volume]
+	delete(t.tokens, volume)
+	t.mu.Unlock()
+
+	current, token, err := t.read(ctx, volume)
+	if err != nil {
+		return err
+	}
+	// The owner alone does not tell a lease written by another request or a previous run of the plugin apart
+	if current.Owner != owner || token != ours {
+		return nil
+	}
+	_, err = t.client.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{volume},
+		Tags:      []types.Tag{{Key: aws.String(leaseOwnerTag)}, {Key: aws.String(leaseExpiresTag)}, {Key: aws.String(leaseTokenTag)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove lease tags: %w", err)
+	}
+	return nil
+}
+
+// read returns the lease recorded in the tags of volume, and its token.
+func (t *TagLeases) read(ctx context.Context, volume string) (Lease, string, error) {
+	v, err := DescribeVolume(ctx, t.client, volume)
+	if err != nil {
+		return Lease{}, "", err
+	}
+	lease := Lease{Volume: volume}
+	var token string
+	for _, tag := range v.Tags {
+		switch aws.ToString(tag.Key) {
+		case leaseOwnerTag:
+			lease.Owner = aws.ToString(tag.Value)
+		case leaseExpiresTag:
+			lease.Expires, _ = time.Parse(time.RFC3339Nano, aws.ToString(tag.Value))
+		case leaseTokenTag:
+			token = aws.ToString(tag.Value)
+		}
+	}
+	return lease, token, nil
+}
@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+// fakeDynamoDB is a DynamoDB stand-in that speaks enough of the JSON protocol for DynamoDBLeases: PutItem and
+// DeleteItem with condition expressions made of OR-ed attribute_not_exists, = and < comparisons.
+type fakeDynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]fakeItem
+}
+
+// fakeItem maps attribute names to their typed value, such as {"S": "vol-1"} or {"N": "42"}.
+type fakeItem map[string]map[string]string
+
+type fakeDynamoDBRequest struct {
+	TableName                 string
+	Item                      fakeItem
+	Key                       fakeItem
+	ConditionExpression       string
+	ExpressionAttributeNames  map[string]string
+	ExpressionAttributeValues map[string]map[string]string
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req fakeDynamoDBRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tables == nil {
+		f.tables = make(map[string]map[string]fakeItem)
+	}
+	if f.tables[req.TableName] == nil {
+		f.tables[req.TableName] = make(map[string]fakeItem)
+	}
+	table := f.tables[req.TableName]
+
+	key := req.Key
+	if key == nil {
+		key = req.Item
+	}
+	id := key["VolumeId"]["S"]
+	current := table[id]
+
+	switch operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); operation {
+	case "CreateTable":
+		w.Write([]byte(`{}`))
+		return
+	case "PutItem", "DeleteItem":
+		if req.ConditionExpression != "" && !evalCondition(req, current) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"__type":  "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException",
+				"message": "The conditional request failed",
+				"Item":    current,
+			})
+			return
+		}
+		if operation == "PutItem" {
+			table[id] = req.Item
+		} else {
+			delete(table, id)
+		}
+		w.Write([]byte(`{}`))
+	default:
+		http.Error(w, "unsupported operation "+operation, http.StatusBadRequest)
+	}
+}
+
+var conditionClause = regexp.MustCompile(`^(?:attribute_not_exists\((\S+)\)|(\S+) (=|<) (:\S+))$`)
+
+func evalCondition(req fakeDynamoDBRequest, item fakeItem) bool {
+	resolve := func(name string) string {
+		if resolved, ok := req.ExpressionAttributeNames[name]; ok {
+			return resolved
+		}
+		return name
+	}
+	for _, clause := range strings.Split(req.ConditionExpression, " OR ") {
+		m := conditionClause.FindStringSubmatch(strings.TrimSpace(clause))
+		if m == nil {
+			panic("unsupported condition " + clause)
+		}
+		if m[1] != "" {
+			if _, ok := item[resolve(m[1])]; !ok {
+				return true
+			}
+			continue
+		}
+		attribute, ok := item[resolve(m[2])]
+		if !ok {
+			continue
+		}
+		value := req.ExpressionAttributeValues[m[4]]
+		switch {
+		case m[3] == "=" && fmt.Sprint(attribute) == fmt.Sprint(value):
+			return true
+		case m[3] == "<" && attribute["N"] != "" && value["N"] != "":
+			a, _ := strconv.ParseFloat(attribute["N"], 64)
+			b, _ := strconv.ParseFloat(value["N"], 64)
+			if a < b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var leaseTables atomic.Int32
+
+// newTestDynamoDBLeases returns leases on a fresh table of the DynamoDB at DYNAMODB_ENDPOINT, such as DynamoDB
+// Local, or of a fakeDynamoDB when it is not set.
+func newTestDynamoDBLeases(t *testing.T) *DynamoDBLeases {
+	t.Helper()
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		server := httptest.NewServer(&fakeDynamoDB{})
+		t.Cleanup(server.Close)
+		endpoint = server.URL
+	}
+
+	client := dynamodb.NewFromConfig(aws.Config{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+	}, func(o *dynamodb.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	})
+
+	table := fmt.Sprintf("leases-%d-%d", time.Now().UnixNano(), leaseTables.Add(1))
+	_, err := client.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+		TableName:            aws.String(table),
+		AttributeDefinitions: []types.AttributeDefinition{{AttributeName: aws.String("VolumeId"), AttributeType: types.ScalarAttributeTypeS}},
+		KeySchema:            []types.KeySchemaElement{{AttributeName: aws.String("VolumeId"), KeyType: types.KeyTypeHash}},
+		BillingMode:          types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		t.Fatalf("failed to create the lease table: %v", err)
+	}
+	return NewDynamoDBLeases(client, table)
+}
+
+func TestDynamoDBLeasesExclusive(t *testing.T) {
+	leases := newTestDynamoDBLeases(t)
+	ctx := context.Background()
+
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := leases.Acquire(ctx, "vol-1", "i-b", time.Minute)
+	var held *LeaseHeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("expected the lease to be held, got %v", err)
+	}
+	if held.Lease.Owner != "i-a" || held.Lease.Expires.Before(time.Now()) {
+		t.Fatalf("expected the error to name the owner and a future expiry, got %+v", held.Lease)
+	}
+
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatalf("the owner should be able to renew its lease: %v", err)
+	}
+	if _, err := leases.Acquire(ctx, "vol-2", "i-b", time.Minute); err != nil {
+		t.Fatalf("leases of other volumes should be independent: %v", err)
+	}
+}
+
+func TestDynamoDBLeasesTakeOverAfterExpiry(t *testing.T) {
+	leases := newTestDynamoDBLeases(t)
+	ctx := context.Background()
+
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := leases.Acquire(ctx, "vol-1", "i-b", time.Minute); err != nil {
+		t.Fatalf("an expired lease should be taken over: %v", err)
+	}
+
+	// The previous owner releasing late must not drop the new lease
+	if err := leases.Release(ctx, "vol-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", time.Minute); err == nil {
+		t.Fatal("a stale release removed the lease of the new owner")
+	}
+
+	if err := leases.Release(ctx, "vol-1", "i-b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatalf("a released lease should be free: %v", err)
+	}
+}
+
+func TestDynamoDBLeasesConcurrentAcquire(t *testing.T) {
+	leases := newTestDynamoDBLeases(t)
+
+	var winners atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := leases.Acquire(context.Background(), "vol-1", fmt.Sprintf("i-%d", i), time.Minute)
+			var held *LeaseHeldError
+			switch {
+			case err == nil:
+				winners.Add(1)
+			case !errors.As(err, &held):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := winners.Load(); n != 1 {
+		t.Fatalf("expected exactly one owner, got %d", n)
+	}
+}
+
+func TestLeasesRenewUntilReleased(t *testing.T) {
+	backend := newTestDynamoDBLeases(t)
+	ctx := context.Background()
+	leases := NewLeases(backend, "i-a", 150*time.Millisecond)
+
+	if err := leases.Acquire(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Well past the ttl, the renewals keep the lease alive
+	time.Sleep(400 * time.Millisecond)
+	if _, err := backend.Acquire(ctx, "vol-1", "i-b", time.Minute); err == nil {
+		t.Fatal("the lease expired although it was being renewed")
+	}
+
+	if err := leases.Release(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Acquire(ctx, "vol-1", "i-b", time.Minute); err != nil {
+		t.Fatalf("a released lease should be free: %v", err)
+	}
+}
+
+// stealableLeases answers every renewal with the lease of another host while stolen is set.
+type stealableLeases struct {
+	LeaseBackend
+	stolen atomic.Bool
+}
+
+func (s *stealableLeases) Acquire(ctx context.Context, volume, owner string, ttl time.Duration) (Lease, error) {
+	if s.stolen.Load() {
+		return Lease{}, &LeaseHeldError{Lease: Lease{Volume: volume, Owner: "i-b", Expires: time.Now().Add(ttl)}}
+	}
+	return s.LeaseBackend.Acquire(ctx, volume, owner, ttl)
+}
+
+func TestLeasesLost(t *testing.T) {
+	backend := &stealableLeases{LeaseBackend: newTestDynamoDBLeases(t)}
+	ctx := context.Background()
+	leases := NewLeases(backend, "i-a", 150*time.Millisecond)
+
+	if err := leases.Acquire(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	backend.stolen.Store(true)
+	time.Sleep(200 * time.Millisecond)
+	backend.stolen.Store(false)
+
+	// The backend would hand the lease back, but the volume may have been written by i-b in the meantime
+	var held *LeaseHeldError
+	if err := leases.Acquire(ctx, "vol-1"); !errors.As(err, &held) || held.Lease.Owner != "i-b" {
+		t.Fatalf("expected the lost lease to be refused, got %v", err)
+	}
+
+	if err := leases.Release(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leases.Acquire(ctx, "vol-1"); err != nil {
+		t.Fatalf("expected a released lease to be acquired again: %v", err)
+	}
+	if err := leases.Release(ctx, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNilLeasesAreNoOps(t *testing.T) {
+	leases := NewLeases(nil, "i-a", time.Minute)
+	if err := leases.Acquire(context.Background(), "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leases.Release(context.Background(), "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTagLeasesExclusive(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: "eu-west-1a"})
+	leases := NewTagLeases(newTestEC2(t, fake), 10*time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := leases.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var held *LeaseHeldError
+	if _, err := leases.Acquire(ctx, "vol-1", "i-b", time.Minute); !errors.As(err, &held) || held.Lease.Owner != "i-a" {
+		t.Fatalf("expected the lease to be held by i-a, got %v", err)
+	}
+
+	if err := leases.Release(ctx, "vol-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease tags to be removed, got %v", volume.Tags)
+	}
+	if _, err := leases.Acquire(ctx, "vol-1", "i-b", time.Minute); err != nil {
+		t.Fatalf("a released lease should be free: %v", err)
+	}
+}
+
+func TestTagLeasesReleaseComparesToken(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: "eu-west-1a"})
+	client := newTestEC2(t, fake)
+	previous := NewTagLeases(client, 0)
+	current := NewTagLeases(client, 0)
+	ctx := context.Background()
+
+	if _, err := previous.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := current.Acquire(ctx, "vol-1", "i-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner is the same, but the lease was rewritten since: it is not the one to release
+	if err := previous.Release(ctx, "vol-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if volume, _ := fake.Volume("vol-1"); volume.Tags[leaseOwnerTag] != "i-a" {
+		t.Fatalf("expected the rewritten lease to be kept, got %v", volume.Tags)
+	}
+
+	if err := current.Release(ctx, "vol-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if volume, _ := fake.Volume("vol-1"); len(volume.Tags) != 0 {
+		t.Fatalf("expected the lease tags to be removed, got %v", volume.Tags)
+	}
+}
+
+// concurrentTagWriter stands for another host writing its lease right after every one of ours.
+type concurrentTagWriter struct {
+	EC2API
+}
+
+func (c concurrentTagWriter) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	out, err := c.EC2API.CreateTags(ctx, params, optFns...)
+	if err != nil {
+		return out, err
+	}
+	return c.EC2API.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: params.Resources,
+		Tags: []ec2types.Tag{
+			{Key: aws.String(leaseOwnerTag), Value: aws.String("i-b")},
+			{Key: aws.String(leaseExpiresTag), Value: aws.String(time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano))},
+			{Key: aws.String(leaseTokenTag), Value: aws.String("theirs")},
+		},
+	}, optFns...)
+}
+
+func TestTagLeasesExpiredOwnLeaseSettles(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires time.Time
+		wantErr bool
+	}{
+		{name: "renewal of an unexpired lease", expires: time.Now().Add(time.Minute)},
+		{name: "expired lease", expires: time.Now().Add(-time.Second), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeaws.NewServer()
+			fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: "eu-west-1a", Tags: map[string]string{
+				leaseOwnerTag:   "i-a",
+				leaseExpiresTag: tt.expires.UTC().Format(time.RFC3339Nano),
+				leaseTokenTag:   "ours",
+			}})
+			leases := NewTagLeases(concurrentTagWriter{newTestEC2(t, fake)}, 10*time.Millisecond)
+
+			// An expired lease is up for grabs like anyone else's, the write of i-b must be noticed
+			_, err := leases.Acquire(context.Background(), "vol-1", "i-a", time.Minute)
+			var held *LeaseHeldError
+			if tt.wantErr != errors.As(err, &held) {
+				t.Fatalf("expected a held lease: %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLeasesReacquire(t *testing.T) {
+	backend := newTestDynamoDBLeases(t)
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.MountRoot = t.TempDir()
+	cfg.StateDir = cfg.MountPath(".state")
+	mounts := NewMountRefs(cfg.StateDir)
+	for _, name := range []string{"vol-mounted", "vol-unmounted"} {
+		if err := os.MkdirAll(cfg.MountPath(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mounts.Add("vol-mounted", "mount-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	leases := NewLeases(backend, "i-a", time.Minute)
+	if err := leases.Reacquire(ctx, cfg, mounts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Acquire(ctx, "vol-mounted", "i-b", time.Minute); err == nil {
+		t.Fatal("expected the lease of the mounted volume to be taken back")
+	}
+	if _, err := backend.Acquire(ctx, "vol-unmounted", "i-b", time.Minute); err != nil {
+		t.Fatalf("expected the unmounted volume to be left unleased: %v", err)
+	}
+	if err := leases.Release(ctx, "vol-mounted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mount root that is not there yet has nothing to take back
+	cfg.MountRoot = cfg.MountPath("missing")
+	if err := leases.Reacquire(ctx, cfg, mounts); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// VolumeLocks serializes the operations on each volume while letting different volumes proceed independently.
+// Operations waiting for the same volume get it in the order they asked for it.
+type VolumeLocks struct {
+	mu      sync.Mutex
+	volumes map[string]*volumeLock
+	timeout time.Duration
+}
+
+type volumeLock struct {
+	held    bool
+	waiters []chan struct{}
+}
+
+// NewVolumeLocks returns a lock manager whose Lock gives up after timeout. A zero timeout waits as long as the
+// context allows.
+func NewVolumeLocks(timeout time.Duration) *VolumeLocks {
+	return &VolumeLocks{volumes: make(map[string]*volumeLock), timeout: timeout}
+}
+
+// Lock waits until the caller is the only operation on volume and returns the function that releases it.
+func (l *VolumeLocks) Lock(ctx context.Context, volume string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.volumes[volume]
+	if !ok {
+		lock = &volumeLock{}
+		l.volumes[volume] = lock
+	}
+	if !lock.held {
+		lock.held = true
+		l.mu.Unlock()
+		return l.unlockFunc(volume), nil
+	}
+
+	granted := make(chan struct{})
+	lock.waiters = append(lock.waiters, granted)
+	l.mu.Unlock()
+
+	slog.DebugContext(ctx, "Waiting for another operation on the volume to finish")
+	start := time.Now()
+
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	select {
+	case <-granted:
+		slog.DebugContext(ctx, "Acquired volume lock", "waited", time.Since(start).String())
+		return l.unlockFunc(volume), nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	select {
+	case <-granted:
+		// The lock was handed over while giving up, pass it on to the next in line
+		l.mu.Unlock()
+		l.unlock(volume)
+	default:
+		for i, waiter := range lock.waiters {
+			if waiter == granted {
+				lock.waiters = append(lock.waiters[:i], lock.waiters[i+1:]...)
+				break
+			}
+		}
+		l.mu.Unlock()
+	}
+
+	return nil, fmt.Errorf("timed out after %s waiting for another operation on volume %s: %w", time.Since(start).Round(time.Millisecond), volume, ctx.Err())
+}
+
+func (l *VolumeLocks) unlockFunc(volume string) func() {
+	var once sync.Once
+	return func() { once.Do(func() { l.unlock(volume) }) }
+}
+
+// unlock hands the lock of volume to the oldest waiter, or forgets it when nobody is waiting.
+func (l *VolumeLocks) unlock(volume string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.volumes[volume]
+	if !ok || !lock.held {
+		return
+	}
+	if len(lock.waiters) == 0 {
+		delete(l.volumes, volume)
+		return
+	}
+
+	next := lock.waiters[0]
+	lock.waiters = lock.waiters[1:]
+	close(next)
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVolumeLocksSerializeSameVolume(t *testing.T) {
+	locks := NewVolumeLocks(0)
+
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.Lock(context.Background(), "vol-1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxActive != 1 {
+		t.Fatalf("expected at most 1 concurrent holder, got %d", maxActive)
+	}
+	if len(locks.volumes) != 0 {
+		t.Fatalf("expected released locks to be forgotten, %d left", len(locks.volumes))
+	}
+}
+
+func TestVolumeLocksIndependentVolumes(t *testing.T) {
+	locks := NewVolumeLocks(0)
+
+	unlockA, err := locks.Lock(context.Background(), "vol-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlockA()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unlockB, err := locks.Lock(ctx, "vol-b")
+	if err != nil {
+		t.Fatalf("lock on another volume should not wait: %v", err)
+	}
+	unlockB()
+}
+
+func TestVolumeLocksFIFO(t *testing.T) {
+	locks := NewVolumeLocks(0)
+
+	unlock, err := locks.Lock(context.Background(), "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.Lock(context.Background(), "vol-1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			unlock()
+		}()
+		waitForWaiters(t, locks, "vol-1", i+1)
+	}
+
+	unlock()
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("waiters were not served in arrival order: %v", order)
+		}
+	}
+}
+
+func TestVolumeLocksTimeout(t *testing.T) {
+	locks := NewVolumeLocks(20 * time.Millisecond)
+
+	unlock, err := locks.Lock(context.Background(), "vol-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := locks.Lock(context.Background(), "vol-1"); err == nil {
+		t.Fatal("expected a timeout while the volume is locked")
+	}
+
+	unlock()
+	unlock() // releasing twice must not release someone else's lock
+
+	unlock, err = locks.Lock(context.Background(), "vol-1")
+	if err != nil {
+		t.Fatalf("expected the lock to be free after the timed out waiter left: %v", err)
+	}
+	unlock()
+}
+
+func TestVolumeLocksCancelledWaitersUnderLoad(t *testing.T) {
+	locks := NewVolumeLocks(0)
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Very short deadlines make waiters give up while the lock is being handed to them
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i%5)*100*time.Microsecond)
+			defer cancel()
+			unlock, err := locks.Lock(ctx, fmt.Sprintf("vol-%d", i%3))
+			if err == nil {
+				time.Sleep(50 * time.Microsecond)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range 3 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		unlock, err := locks.Lock(ctx, fmt.Sprintf("vol-%d", i))
+		cancel()
+		if err != nil {
+			t.Fatalf("lock leaked after cancelled waiters: %v", err)
+		}
+		unlock()
+	}
+	if len(locks.volumes) != 0 {
+		t.Fatalf("expected released locks to be forgotten, %d left", len(locks.volumes))
+	}
+}
+
+func waitForWaiters(t *testing.T, locks *VolumeLocks, volume string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		locks.mu.Lock()
+		waiting := 0
+		if lock, ok := locks.volumes[volume]; ok {
+			waiting = len(lock.waiters)
+		}
+		locks.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters on %s", n, volume)
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type logAttrsKey struct{}
+
+// LogLevel is the level of the default logger. It can be changed while the plugin is running.
+var LogLevel = new(slog.LevelVar)
+
+// InitLogging installs a JSON logger on stdout as the default slog and log logger. When cfg.File is set, records are
+// also written to that file, which is rotated by size and age.
+func InitLogging(cfg LogConfig) (io.Closer, error) {
+	if err := LogLevel.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	var out io.Writer = os.Stdout
+	var closer io.Closer = io.NopCloser(nil)
+	if cfg.File != "" {
+		fileSink := &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.FileMaxSizeMB,
+			MaxAge:     cfg.FileMaxAgeDays,
+			MaxBackups: cfg.FileMaxBackups,
+		}
+		out = io.MultiWriter(os.Stdout, fileSink)
+		closer = fileSink
+	}
+
+	handler := slog.NewJSONHandler(out, &slog.HandlerOptions{Level: LogLevel})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	return closer, nil
+}
+
+// WithLogAttrs returns a copy of ctx whose log records carry attrs. An attribute replaces any previous one with the
+// same key, so nested phases report the innermost one.
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	previous, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(previous)+len(attrs))
+	for _, attr := range previous {
+		replaced := false
+		for _, a := range attrs {
+			if a.Key == attr.Key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, attr)
+		}
+	}
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// WithVolume tags both the current span and the log records of ctx with the volume the request is about.
+func WithVolume(ctx context.Context, volume string) context.Context {
+	SetSpanVolume(ctx, volume)
+	return WithLogAttrs(ctx, slog.String("volume", volume))
+}
+
+// LogHandler assigns a request ID to every request served by next and logs its completion.
+func LogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithLogAttrs(r.Context(), slog.String("request_id", newRequestID()))
+		start := time.Now()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		slog.DebugContext(ctx, "Request completed", "path", r.URL.Path, "duration", time.Since(start))
+	})
+}
+
+// contextHandler adds the attributes stored with WithLogAttrs and the current trace to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logAWSCalls adds a middleware to cfg that logs every AWS API attempt together with its AWS request ID.
+func logAWSCalls(cfg *aws.Config) {
+	cfg.APIOptions = append(cfg.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("LogAWSCall", func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+			start := time.Now()
+			out, metadata, err := next.HandleDeserialize(ctx, in)
+
+			requestID, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+			attrs := []slog.Attr{
+				slog.String("aws_service", awsmiddleware.GetServiceID(ctx)),
+				slog.String("aws_operation", awsmiddleware.GetOperationName(ctx)),
+				slog.String("aws_request_id", requestID),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if err != nil {
+				slog.LogAttrs(ctx, slog.LevelWarn, "AWS call failed", append(attrs, slog.Any("error", err))...)
+			} else {
+				slog.LogAttrs(ctx, slog.LevelDebug, "AWS call", attrs...)
+			}
+			return out, metadata, err
+		}), middleware.After)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
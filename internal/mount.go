@@ -2,148 +2,155 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func runCommand(cmdStr string, args ...string) (string, error) {
+// defaultFilesystem is created on volumes that have no filesystem yet.
+const defaultFilesystem = "xfs"
+
+func runCommand(ctx context.Context, cmdStr string, args ...string) (_ string, err error) {
+	ctx, span := startSpan(ctx, cmdStr, attribute.StringSlice("command.args", args))
+	defer func() { endSpan(span, err) }()
+
+	slog.DebugContext(ctx, "Running command", "command", cmdStr, "args", args)
+
+	// The command is not bound to ctx on purpose: killing mkfs or mount halfway leaves the device in a worse state
 	cmd := exec.Command(cmdStr, args...)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	err = cmd.Run()
 	return strings.TrimSpace(out.String()), err
 }
 
-func FindDeviceByVolumeID(volumeID string) (string, error) {
-	log.Println("Finding device for volumeID:", volumeID)
-	dataVolumeID := volumeID[4:]
-	sysBlockPath := "/sys/block"
-
-	for attempt := 1; attempt <= 5; attempt++ {
-		entries, err := os.ReadDir(sysBlockPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read %s: %v", sysBlockPath, err)
-		}
-
-		log.Printf("Attempt %d to find device for volumeID %s", attempt, dataVolumeID)
-
-		for _, e := range entries {
-			name := e.Name()
-			if !strings.HasPrefix(name, "nvme") {
-				continue
-			}
-
-			serialPath := filepath.Join(sysBlockPath, name, "device", "serial")
-			serialBytes, err := os.ReadFile(serialPath)
-			if err != nil {
-				continue
-			}
-
-			serial := (string(serialBytes))
-			if strings.Contains(serial, dataVolumeID) {
-				return strings.TrimPrefix(name, "/dev/"), nil
-			}
-		}
-
-		time.Sleep(time.Duration(attempt) * time.Second)
-	}
+// FindDeviceByVolumeID waits until the block device of volumeID, attached as attachDevice, shows up on host and
+// returns its name. The wait is woken by the kernel device events, with a scan every cfg.Device.RescanInterval in case one is
+// missed, and lasts until ctx is done.
+func FindDeviceByVolumeID(ctx context.Context, cfg *Config, host Host, volumeID, attachDevice string) (_ string, err error) {
+	ctx, span := startSpan(ctx, "FindDeviceByVolumeID", attribute.String("volume.id", volumeID), attribute.String("volume.attach_device", attachDevice))
+	defer func() { endSpan(span, err) }()
 
-	return "", fmt.Errorf("device with volumeID %s not found after 5 attempts", volumeID)
-}
+	slog.DebugContext(ctx, "Finding device for volume")
 
-func GetFilesystem(device string) (string, error) {
-	if !strings.HasPrefix(device, "/dev") {
-		device = "/dev/" + device
-	}
-	output, err := runCommand("blkid", device)
+	// Watch before the first scan, so that a device showing up in between is not missed
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	events, err := host.WatchBlockDevices(watchCtx)
 	if err != nil {
-		return "", fmt.Errorf("failed to run blkid on %s: %v", device, err)
-	}
-
-	fsType := ""
-	for part := range strings.FieldsSeq(output) {
-		if strings.HasPrefix(part, "TYPE=") {
-			fsType = strings.Trim(part[len("TYPE="):], `"`)
-			break
-		}
+		slog.WarnContext(ctx, "Cannot watch block device events, falling back to scanning", "error", err)
 	}
 
-	log.Printf("Device %s has filesystem type: %s", device, fsType)
-	return fsType, nil
-}
+	ticker := time.NewTicker(time.Duration(cfg.Device.RescanInterval))
+	defer ticker.Stop()
 
-func getMountpoint(device string) (string, error) {
-	output, err := runCommand("lsblk", "-f")
-	if err != nil {
-		return "", fmt.Errorf("failed to run lsblk: %v", err)
-	}
+	start := time.Now()
+	for {
+		device, strategy, err := scanDeviceByVolumeID(host, volumeID, attachDevice)
+		if err != nil {
+			return "", err
+		}
+		if device != "" {
+			slog.DebugContext(ctx, "Found device for volume", "device", device, "strategy", strategy, "waited", time.Since(start).String())
+			return device, nil
+		}
 
-	lines := strings.Split(output, "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) >= 6 && fields[0] == device {
-			return fields[5], nil
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("device with volumeID %s did not show up after %s: %w", volumeID, time.Since(start).Round(time.Millisecond), ctx.Err())
+		case <-events:
+		case <-ticker.C:
 		}
 	}
-
-	return "", nil
 }
 
-func Mount(volumeID string) error {
-	device, err := FindDeviceByVolumeID(volumeID)
+// Mount mounts the block device of volumeID on its mountpoint, creating an xfs filesystem first when the volume has
+// none. A device mounted somewhere else, by an earlier run of the plugin, is moved to the mountpoint.
+func Mount(ctx context.Context, cfg *Config, host Host, volumeID, attachDevice string) (err error) {
+	ctx, span := startSpan(ctx, "Mount", attribute.String("volume.id", volumeID))
+	defer func() { endSpan(span, err) }()
+
+	// Normally the device is already there, the wait matters for a volume that was attached by a previous request
+	findCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeouts.Attach))
+	defer cancel()
+	device, err := FindDeviceByVolumeID(findCtx, cfg, host, volumeID, attachDevice)
 	if err != nil {
 		return fmt.Errorf("error finding device: %v", err)
 	}
 
-	filesystem, err := GetFilesystem(device)
+	filesystem, err := host.Filesystem(ctx, device)
 	if err != nil {
 		return fmt.Errorf("error getting filesystem: %v", err)
 	}
-
-	mountpointPath := fmt.Sprintf("/mnt/%s", volumeID)
+	slog.InfoContext(ctx, "Device filesystem detected", "device", device, "filesystem", filesystem)
 
 	if filesystem == "" {
-		if _, err := runCommand("mkfs.xfs", "/dev/"+device); err != nil {
+		if err := host.Format(ctx, device, defaultFilesystem); err != nil {
 			return fmt.Errorf("error creating filesystem: %v", err)
 		}
-
-		filesystem = "xfs"
-
-		os.MkdirAll(mountpointPath, 0755)
-		if _, err := runCommand("mount", "-t", filesystem, "/dev/"+device, mountpointPath); err != nil {
-			return fmt.Errorf("error mounting device: %v", err)
-		}
-
-		// Clear directory contents
-		if err := os.RemoveAll(mountpointPath + "/*"); err != nil {
-			return fmt.Errorf("error clearing mount directory: %v", err)
-		}
+		filesystem = defaultFilesystem
 	}
 
-	mountpoint, err := getMountpoint(device)
+	mountpointPath := cfg.MountPath(volumeID)
+	mountpoint, err := host.Mountpoint(ctx, device)
 	if err != nil {
 		return fmt.Errorf("error getting mountpoint: %v", err)
 	}
-
-	if mountpoint == "" {
-		os.MkdirAll(mountpointPath, 0755)
-		if _, err := runCommand("mount", "-t", filesystem, "/dev/"+device, mountpointPath); err != nil {
-			return fmt.Errorf("error mounting device: %v", err)
-		}
-	} else if mountpoint != mountpointPath {
-		if _, err := runCommand("umount", mountpoint); err != nil {
+	switch mountpoint {
+	case mountpointPath:
+		slog.InfoContext(ctx, "Device is already mounted", "device", device)
+		return nil
+	case "":
+	default:
+		slog.InfoContext(ctx, "Device is mounted elsewhere, moving it", "device", device, "mountpoint", mountpoint)
+		if err := host.Unmount(ctx, mountpoint); err != nil && !errors.Is(err, ErrNotMounted) {
 			return fmt.Errorf("error unmounting device: %v", err)
 		}
-		if _, err := runCommand("mount", "-t", filesystem, "/dev/"+device, mountpointPath); err != nil {
-			return fmt.Errorf("error remounting device: %v", err)
-		}
 	}
 
+	if err := os.MkdirAll(mountpointPath, 0755); err != nil {
+		return fmt.Errorf("error creating mountpoint: %v", err)
+	}
+	if err := host.Mount(ctx, device, mountpointPath, filesystem); err != nil {
+		return fmt.Errorf("error mounting device: %v", err)
+	}
 	return nil
 }
+
+// Unmount unmounts the mountpoint of volumeID. A volume that is not mounted is left as it is.
+func Unmount(ctx context.Context, cfg *Config, host Host, volumeID string) (err error) {
+	ctx, span := startSpan(ctx, "Unmount", attribute.String("volume.id", volumeID))
+	defer func() { endSpan(span, err) }()
+
+	err = host.Unmount(ctx, cfg.MountPath(volumeID))
+	if errors.Is(err, ErrNotMounted) {
+		slog.WarnContext(ctx, "Volume is not mounted, nothing to unmount")
+		return nil
+	}
+	return err
+}
+
+// VolumeNames returns the volumes that have a mountpoint under cfg.MountRoot. Hidden directories, such as the default
+// state directory, are not volumes.
+func VolumeNames(cfg *Config) ([]string, error) {
+	entries, err := os.ReadDir(cfg.MountRoot)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
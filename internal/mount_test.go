@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMountConfig(t *testing.T) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.MountRoot = t.TempDir()
+	cfg.Timeouts.Attach = Duration(200 * time.Millisecond)
+	cfg.Device.RescanInterval = Duration(20 * time.Millisecond)
+	return cfg
+}
+
+func TestFindDeviceByVolumeID(t *testing.T) {
+	tests := []struct {
+		name         string
+		devices      []FakeDevice
+		attachDevice string
+		want         string
+		wantErr      string
+	}{
+		{
+			name:    "nvme serial",
+			devices: []FakeDevice{{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}}},
+			want:    "nvme1n1",
+		},
+		{
+			name:    "instance store with the same serial",
+			devices: []FakeDevice{{Name: "nvme1n1", Identity: NVMeIdentity{Model: "Amazon EC2 NVMe Instance Storage", Serial: "vol1"}}},
+		},
+		{
+			name:    "root disk",
+			devices: []FakeDevice{{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}, Root: true}},
+		},
+		{
+			name: "several namespaces told apart by the attach name",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdf"}},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "sdg"}},
+			},
+			attachDevice: "/dev/sdg",
+			want:         "nvme2n1",
+		},
+		{
+			name: "several namespaces",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}},
+			},
+			wantErr: "several NVMe devices",
+		},
+		{
+			name: "several namespaces, none with the attach name",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdf"}},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdg"}},
+			},
+			attachDevice: "/dev/sdh",
+			wantErr:      "nvme1n1, nvme2n1",
+		},
+		{
+			name: "several namespaces with the attach name",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdf"}},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "sdf"}},
+				{Name: "nvme3n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdg"}},
+			},
+			attachDevice: "/dev/sdf",
+			wantErr:      "nvme1n1, nvme2n1",
+		},
+		{
+			name:         "single namespace with another attach name",
+			devices:      []FakeDevice{{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1", VendorDevice: "/dev/sdg"}}},
+			attachDevice: "/dev/sdf",
+			want:         "nvme1n1",
+		},
+		{
+			name: "root disk with the same serial is not a second match",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}, Root: true},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}},
+			},
+			want: "nvme2n1",
+		},
+		{
+			name: "instance store and other volumes are not matches",
+			devices: []FakeDevice{
+				{Name: "nvme1n1", Identity: NVMeIdentity{Model: "Amazon EC2 NVMe Instance Storage", Serial: "vol1"}},
+				{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol10"}},
+				{Name: "nvme3n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}},
+			},
+			want: "nvme3n1",
+		},
+		{
+			name:    "udev link",
+			devices: []FakeDevice{{Name: "sdb", ByID: "nvme-Amazon_Elastic_Block_Store_vol1"}},
+			want:    "sdb",
+		},
+		{
+			name:    "root disk behind the udev link",
+			devices: []FakeDevice{{Name: "sdb", ByID: "nvme-Amazon_Elastic_Block_Store_vol1", Root: true}},
+		},
+		{
+			name:         "xen name not there yet",
+			devices:      []FakeDevice{{Name: "xvda", Root: true}, {Name: "xvdg"}},
+			attachDevice: "/dev/sdf",
+		},
+		{
+			name:    "xen without an attach name",
+			devices: []FakeDevice{{Name: "xvda", Root: true}, {Name: "xvdf"}},
+		},
+		{
+			name:         "xen name",
+			devices:      []FakeDevice{{Name: "xvda", Root: true}, {Name: "xvdf"}},
+			attachDevice: "/dev/sdf",
+			want:         "xvdf",
+		},
+		{
+			name:         "root disk with the xen name",
+			devices:      []FakeDevice{{Name: "xvda", Root: true}},
+			attachDevice: "/dev/sda",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := NewFakeHost()
+			for _, device := range tt.devices {
+				host.AddDevice(device)
+			}
+			got, _, err := scanDeviceByVolumeID(host, "vol-1", tt.attachDevice)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error with %q, got %q, %v", tt.wantErr, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("expected %q, got %q, %v", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestFindDeviceByVolumeIDWaitsForDevice(t *testing.T) {
+	cfg := newTestMountConfig(t)
+	cfg.Device.RescanInterval = Duration(time.Hour)
+	host := NewFakeHost()
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		host.AddEBSDevice("vol-1", "/dev/sdf")
+	}()
+
+	// Only the device event can wake the wait up before the timeout
+	device, err := FindDeviceByVolumeID(context.Background(), cfg, host, "vol-1", "/dev/sdf")
+	if err != nil || device != "nvme1n1" {
+		t.Fatalf("expected nvme1n1, got %q, %v", device, err)
+	}
+}
+
+func TestFindDeviceByVolumeIDRescans(t *testing.T) {
+	errScan := errors.New("sysfs is gone")
+	tests := []struct {
+		name string
+		// watchFails leaves the wait without device events, to the periodic scans alone
+		watchFails bool
+		// other is a device that shows up before the one of the volume, waking the wait up for nothing
+		other    bool
+		volume   bool
+		scanFail bool
+		rescan   time.Duration
+		want     string
+		wantErr  string
+		// minScans is the fewest scans the wait must have gone through
+		minScans int
+	}{
+		{name: "woken by the event", volume: true, rescan: time.Hour, want: "nvme2n1"},
+		{name: "woken for another device", other: true, volume: true, rescan: time.Hour, want: "nvme2n1", minScans: 3},
+		{name: "without events", watchFails: true, volume: true, rescan: 10 * time.Millisecond, want: "nvme2n1", minScans: 2},
+		{name: "timeout", rescan: 20 * time.Millisecond, wantErr: "did not show up", minScans: 3},
+		{name: "timeout without events", watchFails: true, rescan: 20 * time.Millisecond, wantErr: "did not show up", minScans: 3},
+		{name: "scan failure", scanFail: true, rescan: 10 * time.Millisecond, wantErr: errScan.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestMountConfig(t)
+			cfg.Device.RescanInterval = Duration(tt.rescan)
+			host := NewFakeHost()
+			if tt.watchFails {
+				host.Fail("WatchBlockDevices", errors.New("no uevent socket"))
+			}
+			if tt.scanFail {
+				host.Fail("BlockDevices", errScan)
+			}
+
+			go func() {
+				if tt.other {
+					time.Sleep(30 * time.Millisecond)
+					host.AddDevice(FakeDevice{Name: "nvme1n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol2"}})
+				}
+				if tt.volume {
+					time.Sleep(30 * time.Millisecond)
+					host.AddDevice(FakeDevice{Name: "nvme2n1", Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}})
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+			device, err := FindDeviceByVolumeID(ctx, cfg, host, "vol-1", "/dev/sdf")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error with %q, got %q, %v", tt.wantErr, device, err)
+				}
+			} else if err != nil || device != tt.want {
+				t.Fatalf("expected %q, got %q, %v", tt.want, device, err)
+			}
+			if scans := host.Calls("BlockDevices"); scans < tt.minScans {
+				t.Fatalf("expected at least %d scans, got %d", tt.minScans, scans)
+			}
+			if tt.scanFail && host.Calls("BlockDevices") != 1 {
+				t.Fatalf("expected a failed scan to end the wait, got %d scans", host.Calls("BlockDevices"))
+			}
+		})
+	}
+}
+
+func TestMountAndUnmount(t *testing.T) {
+	cfg := newTestMountConfig(t)
+	host := NewFakeHost()
+	device := host.AddEBSDevice("vol-1", "/dev/sdf")
+	ctx := context.Background()
+	mountpoint := cfg.MountPath("vol-1")
+
+	if err := Mount(ctx, cfg, host, "vol-1", "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := host.Device(device); d.Filesystem != defaultFilesystem {
+		t.Fatalf("expected the device to be formatted with %s, got %q", defaultFilesystem, d.Filesystem)
+	}
+	if got := host.Mounts()[mountpoint]; got != device {
+		t.Fatalf("expected %s to be mounted on %s, got %q", device, mountpoint, got)
+	}
+
+	// Mounting again is a no-op
+	if err := Mount(ctx, cfg, host, "vol-1", "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := host.Calls("Mount"); calls != 1 {
+		t.Fatalf("expected a mounted volume not to be mounted again, got %d mounts", calls)
+	}
+
+	if err := Unmount(ctx, cfg, host, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.Mounts()) != 0 {
+		t.Fatalf("expected nothing to be mounted, got %v", host.Mounts())
+	}
+	if err := Unmount(ctx, cfg, host, "vol-1"); err != nil {
+		t.Fatalf("unmounting a volume that is not mounted should succeed: %v", err)
+	}
+
+	// The filesystem is kept the second time around
+	if err := Mount(ctx, cfg, host, "vol-1", "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := host.Calls("Format"); calls != 1 {
+		t.Fatalf("expected the volume to be formatted once, got %d", calls)
+	}
+}
+
+func TestMountMovesDeviceMountedElsewhere(t *testing.T) {
+	cfg := newTestMountConfig(t)
+	host := NewFakeHost()
+	device := host.AddEBSDevice("vol-1", "/dev/sdf")
+	host.AddDevice(FakeDevice{Name: device, Identity: NVMeIdentity{Model: ebsModel, Serial: "vol1"}, Filesystem: "ext4"})
+	ctx := context.Background()
+
+	elsewhere := filepath.Join(t.TempDir(), "old")
+	if err := os.Mkdir(elsewhere, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Mount(ctx, device, elsewhere, "ext4"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Mount(ctx, cfg, host, "vol-1", "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+	mounts := host.Mounts()
+	if _, ok := mounts[elsewhere]; ok || mounts[cfg.MountPath("vol-1")] != device {
+		t.Fatalf("expected the device to be moved to its mountpoint, got %v", mounts)
+	}
+	if calls := host.Calls("Format"); calls != 0 {
+		t.Fatalf("expected the ext4 filesystem to be kept, got %d formats", calls)
+	}
+}
+
+func TestMountFailures(t *testing.T) {
+	injected := errors.New("injected")
+	tests := []struct {
+		method string
+		// byID adds a device only its udev link finds
+		byID bool
+		// formatted tells whether the failure leaves the device formatted
+		formatted bool
+		wantErr   string
+	}{
+		{method: "BlockDevices", wantErr: "error finding device"},
+		{method: "NVMeIdentity", wantErr: "did not show up"},
+		{method: "DiskByID", byID: true, wantErr: "error finding device"},
+		{method: "Filesystem", wantErr: "error getting filesystem"},
+		{method: "Format", wantErr: "error creating filesystem"},
+		{method: "Mountpoint", formatted: true, wantErr: "error getting mountpoint"},
+		{method: "Mount", formatted: true, wantErr: "error mounting device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			cfg := newTestMountConfig(t)
+			host := NewFakeHost()
+			device := "sdb"
+			if tt.byID {
+				host.AddDevice(FakeDevice{Name: device, ByID: "nvme-Amazon_Elastic_Block_Store_vol1"})
+			} else {
+				device = host.AddEBSDevice("vol-1", "/dev/sdf")
+			}
+			host.Fail(tt.method, injected)
+
+			err := Mount(context.Background(), cfg, host, "vol-1", "/dev/sdf")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error with %q, got %v", tt.wantErr, err)
+			}
+			if d, _ := host.Device(device); (d.Filesystem != "") != tt.formatted {
+				t.Fatalf("expected formatted=%v, got filesystem %q", tt.formatted, d.Filesystem)
+			}
+			if len(host.Mounts()) != 0 {
+				t.Fatalf("expected nothing to be mounted, got %v", host.Mounts())
+			}
+
+			// Once the failure is gone the same volume mounts
+			host.ClearFailures()
+			if err := Mount(context.Background(), cfg, host, "vol-1", "/dev/sdf"); err != nil {
+				t.Fatal(err)
+			}
+			if d, _ := host.Device(device); d.Filesystem != defaultFilesystem || host.Mounts()[cfg.MountPath("vol-1")] != device {
+				t.Fatalf("expected the volume to be formatted and mounted, got %+v and %v", d, host.Mounts())
+			}
+		})
+	}
+}
+
+func TestUnmountFailure(t *testing.T) {
+	cfg := newTestMountConfig(t)
+	host := NewFakeHost()
+	host.AddEBSDevice("vol-1", "/dev/sdf")
+	ctx := context.Background()
+	if err := Mount(ctx, cfg, host, "vol-1", "/dev/sdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	host.Fail("Unmount", errors.New("target is busy"))
+	if err := Unmount(ctx, cfg, host, "vol-1"); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("expected the unmount to fail, got %v", err)
+	}
+	if len(host.Mounts()) != 1 {
+		t.Fatalf("expected the volume to stay mounted, got %v", host.Mounts())
+	}
+
+	// A device that cannot be moved from its old mountpoint is not mounted twice
+	host.ClearFailures()
+	if err := Unmount(ctx, cfg, host, "vol-1"); err != nil {
+		t.Fatal(err)
+	}
+	device := host.AddEBSDevice("vol-2", "/dev/sdg")
+	elsewhere := t.TempDir()
+	if err := host.Mount(ctx, device, elsewhere, defaultFilesystem); err == nil {
+		t.Fatal("expected a device without a filesystem not to mount")
+	}
+	host.AddDevice(FakeDevice{Name: device, Identity: NVMeIdentity{Model: ebsModel, Serial: "vol2"}, Filesystem: defaultFilesystem})
+	if err := host.Mount(ctx, device, elsewhere, defaultFilesystem); err != nil {
+		t.Fatal(err)
+	}
+	host.Fail("Unmount", errors.New("target is busy"))
+	if err := Mount(ctx, cfg, host, "vol-2", "/dev/sdg"); err == nil || !strings.Contains(err.Error(), "error unmounting device") {
+		t.Fatalf("expected moving the device to fail, got %v", err)
+	}
+	if mounts := host.Mounts(); len(mounts) != 1 || mounts[elsewhere] != device {
+		t.Fatalf("expected the device to stay where it was, got %v", mounts)
+	}
+}
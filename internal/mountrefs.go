@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// MountRefs records the mounts of each volume. Docker sends one Mount and one Unmount per container, with the same
+// random mount ID, so the volume is only given up after the Unmount of the last one. The mount IDs are kept in the
+// state directory, a restarted plugin still knows which volumes are in use.
+type MountRefs struct {
+	mu       sync.Mutex
+	stateDir string
+}
+
+func NewMountRefs(stateDir string) *MountRefs {
+	return &MountRefs{stateDir: stateDir}
+}
+
+func mountRefsPath(stateDir, volume string) string {
+	return filepath.Join(stateDir, "mounts", volume+".json")
+}
+
+// Add records the mount id of volume and returns how many mounts the volume has. Adding a mount twice counts it once.
+func (m *MountRefs) Add(volume, id string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mounts, err := m.load(volume)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(mounts, id) {
+		mounts = append(mounts, id)
+	}
+	return len(mounts), m.save(volume, mounts)
+}
+
+// Remove forgets the mount id of volume and returns how many mounts are left.
+func (m *MountRefs) Remove(volume, id string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mounts, err := m.load(volume)
+	if err != nil {
+		return 0, err
+	}
+	mounts = slices.DeleteFunc(mounts, func(c string) bool { return c == id })
+	return len(mounts), m.save(volume, mounts)
+}
+
+// Count returns how many mounts volume has.
+func (m *MountRefs) Count(volume string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mounts, err := m.load(volume)
+	return len(mounts), err
+}
+
+func (m *MountRefs) load(volume string) ([]string, error) {
+	data, err := os.ReadFile(mountRefsPath(m.stateDir, volume))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read volume mounts: %w", err)
+	}
+	var mounts []string
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		return nil, fmt.Errorf("failed to parse volume mounts: %w", err)
+	}
+	return mounts, nil
+}
+
+// save stores the mounts of volume, forgetting the volume once none is left.
+func (m *MountRefs) save(volume string, mounts []string) error {
+	path := mountRefsPath(m.stateDir, volume)
+	if len(mounts) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove volume mounts: %w", err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(mounts)
+	if err != nil {
+		return fmt.Errorf("failed to encode volume mounts: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write volume mounts: %w", err)
+	}
+	return nil
+}
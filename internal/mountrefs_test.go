@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMountRefs(t *testing.T) {
+	stateDir := t.TempDir()
+	mounts := NewMountRefs(stateDir)
+
+	steps := []struct {
+		add  bool
+		id   string
+		want int
+	}{
+		{add: true, id: "mount-1", want: 1},
+		{add: true, id: "mount-2", want: 2},
+		// The same mount ID counts once
+		{add: true, id: "mount-1", want: 2},
+		{add: false, id: "mount-unknown", want: 2},
+		{add: false, id: "mount-1", want: 1},
+	}
+	for _, step := range steps {
+		var count int
+		var err error
+		if step.add {
+			count, err = mounts.Add("vol-1", step.id)
+		} else {
+			count, err = mounts.Remove("vol-1", step.id)
+		}
+		if err != nil || count != step.want {
+			t.Fatalf("add=%v %s: expected %d mounts, got %d, %v", step.add, step.id, step.want, count, err)
+		}
+	}
+
+	// The mounts outlive the plugin
+	restarted := NewMountRefs(stateDir)
+	if count, err := restarted.Count("vol-1"); err != nil || count != 1 {
+		t.Fatalf("expected one mount after a restart, got %d, %v", count, err)
+	}
+	if count, err := restarted.Remove("vol-1", "mount-2"); err != nil || count != 0 {
+		t.Fatalf("expected no mount left, got %d, %v", count, err)
+	}
+	if _, err := os.Stat(mountRefsPath(stateDir, "vol-1")); !os.IsNotExist(err) {
+		t.Fatalf("expected the volume to be forgotten, got %v", err)
+	}
+	if count, err := restarted.Count("vol-2"); err != nil || count != 0 {
+		t.Fatalf("expected an unknown volume to have no mount, got %d, %v", count, err)
+	}
+
+	if err := os.WriteFile(mountRefsPath(stateDir, "vol-3"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Add("vol-3", "mount-1"); err == nil {
+		t.Fatal("expected a parse error")
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// _IOWR('N', 0x41, struct nvme_admin_cmd) from linux/nvme_ioctl.h
+	nvmeIoctlAdminCmd = 0xc0484e41
+	nvmeAdminIdentify = 0x06
+	// CNS 1 returns the identify controller data structure
+	nvmeIdentifyController = 1
+	nvmeIdentifySize       = 4096
+)
+
+// nvmeAdminCommand is struct nvme_passthru_cmd from linux/nvme_ioctl.h.
+type nvmeAdminCommand struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// identifyNVMeController sends an identify controller command to the controller of the block device name, as listed
+// in sysBlock with its device node in dev.
+func identifyNVMeController(sysBlock, dev, name string) (NVMeIdentity, error) {
+	controllerPath, err := filepath.EvalSymlinks(filepath.Join(sysBlock, name, "device"))
+	if err != nil {
+		return NVMeIdentity{}, fmt.Errorf("failed to resolve the controller of %s: %v", name, err)
+	}
+	controller := filepath.Join(dev, filepath.Base(controllerPath))
+
+	f, err := os.Open(controller)
+	if err != nil {
+		return NVMeIdentity{}, fmt.Errorf("failed to open %s: %v", controller, err)
+	}
+	defer f.Close()
+
+	data := make([]byte, nvmeIdentifySize)
+	cmd := nvmeAdminCommand{
+		opcode:  nvmeAdminIdentify,
+		addr:    uint64(uintptr(unsafe.Pointer(&data[0]))),
+		dataLen: nvmeIdentifySize,
+		cdw10:   nvmeIdentifyController,
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd))); errno != 0 {
+		return NVMeIdentity{}, fmt.Errorf("identify controller %s failed: %v", controller, errno)
+	}
+	return parseNVMeIdentify(data), nil
+}
+
+// parseNVMeIdentify extracts the serial (bytes 4-23), the model (24-63) and, for EBS, the device name the volume
+// was attached with, which Amazon stores at the start of the vendor specific area (3072).
+func parseNVMeIdentify(data []byte) NVMeIdentity {
+	return NVMeIdentity{
+		Serial:       strings.TrimSpace(string(data[4:24])),
+		Model:        strings.TrimSpace(string(data[24:64])),
+		VendorDevice: strings.TrimSpace(strings.TrimRight(string(data[3072:3104]), "\x00")),
+	}
+}
+
+// rootDisks returns the block devices holding the root filesystem of the plugin and of the host, as far as they
+// can be seen.
+func rootDisks() map[string]bool {
+	disks := make(map[string]bool)
+	for _, path := range []string{"/", "/proc/1/root"} {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			continue
+		}
+		major, minor := splitDev(st.Dev)
+		if major == 0 {
+			// overlay, tmpfs and friends are not backed by a block device
+			continue
+		}
+
+		devPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(devPath, "partition")); err == nil {
+			devPath = filepath.Dir(devPath)
+		}
+		disks[filepath.Base(devPath)] = true
+	}
+	return disks
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// identifyNVMeController is only available on Linux, elsewhere the identity is read from sysfs.
+func identifyNVMeController(sysBlock, dev, name string) (NVMeIdentity, error) {
+	return NVMeIdentity{}, errors.New("NVMe identify is only available on Linux")
+}
+
+func rootDisks() map[string]bool {
+	return nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const unfinishedOperationsFile = "unfinished-operations.json"
+
+type operationKey struct{}
+
+// Operation is a VolumeDriver request that changes the state of a volume.
+type Operation struct {
+	Kind      string    `json:"kind"`
+	Volume    string    `json:"volume"`
+	Phase     string    `json:"phase"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// OperationTracker keeps track of the operations that are running, so that the ones cut short by a shutdown can be
+// recorded and looked at after the restart.
+type OperationTracker struct {
+	mu     sync.Mutex
+	nextID uint64
+	ops    map[uint64]*Operation
+}
+
+type trackedOperation struct {
+	tracker *OperationTracker
+	id      uint64
+}
+
+func NewOperationTracker() *OperationTracker {
+	return &OperationTracker{ops: make(map[uint64]*Operation)}
+}
+
+// Begin registers an operation and returns a context that records its phases, along with the function that marks
+// it as finished.
+func (t *OperationTracker) Begin(ctx context.Context, kind, volume string) (context.Context, func()) {
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.ops[id] = &Operation{Kind: kind, Volume: volume, StartedAt: time.Now()}
+	t.mu.Unlock()
+
+	done := func() {
+		t.mu.Lock()
+		delete(t.ops, id)
+		t.mu.Unlock()
+	}
+	return context.WithValue(ctx, operationKey{}, trackedOperation{tracker: t, id: id}), done
+}
+
+// Pending returns a copy of the operations that have not finished yet, oldest first.
+func (t *OperationTracker) Pending() []Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := make([]Operation, 0, len(t.ops))
+	for _, op := range t.ops {
+		pending = append(pending, *op)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].StartedAt.Before(pending[j].StartedAt) })
+	return pending
+}
+
+// setOperationPhase records phase on the operation carried by ctx, if any.
+func setOperationPhase(ctx context.Context, phase string) {
+	tracked, ok := ctx.Value(operationKey{}).(trackedOperation)
+	if !ok {
+		return
+	}
+	tracked.tracker.mu.Lock()
+	if op, ok := tracked.tracker.ops[tracked.id]; ok {
+		op.Phase = phase
+	}
+	tracked.tracker.mu.Unlock()
+}
+
+// SaveUnfinishedOperations writes ops to stateDir, where LoadUnfinishedOperations finds them on the next start.
+func SaveUnfinishedOperations(stateDir string, ops []Operation) error {
+	data, err := json.MarshalIndent(ops, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode unfinished operations: %w", err)
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, unfinishedOperationsFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write unfinished operations: %w", err)
+	}
+	return nil
+}
+
+// LoadUnfinishedOperations returns the operations recorded by the previous shutdown and forgets them.
+func LoadUnfinishedOperations(stateDir string) ([]Operation, error) {
+	path := filepath.Join(stateDir, unfinishedOperationsFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read unfinished operations: %w", err)
+	}
+
+	var ops []Operation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	return ops, nil
+}
+
+// ListenSocket listens on the unix socket at path. A socket file left behind by a previous run is removed first,
+// but only when nothing answers on it anymore.
+func ListenSocket(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tracker := NewOperationTracker()
+	if pending := tracker.Pending(); len(pending) != 0 {
+		t.Fatalf("expected no pending operations, got %v", pending)
+	}
+
+	mountCtx, mountDone := tracker.Begin(context.Background(), "Mount", "vol-1")
+	time.Sleep(time.Millisecond)
+	_, unmountDone := tracker.Begin(context.Background(), "Unmount", "vol-2")
+
+	// Phases are recorded through the context of their operation only
+	setOperationPhase(mountCtx, "AttachVolumeAndWait")
+	setOperationPhase(context.Background(), "Unrelated")
+
+	pending := tracker.Pending()
+	if len(pending) != 2 {
+		t.Fatalf("expected two pending operations, got %v", pending)
+	}
+	if pending[0].Kind != "Mount" || pending[0].Volume != "vol-1" || pending[0].Phase != "AttachVolumeAndWait" {
+		t.Fatalf("expected the mount first, in its phase, got %+v", pending[0])
+	}
+	if pending[1].Kind != "Unmount" || pending[1].Volume != "vol-2" || pending[1].Phase != "" {
+		t.Fatalf("expected the unmount second, without a phase, got %+v", pending[1])
+	}
+
+	// The returned operations are copies
+	pending[0].Phase = "changed"
+	if tracker.Pending()[0].Phase != "AttachVolumeAndWait" {
+		t.Fatal("expected Pending to return copies")
+	}
+
+	mountDone()
+	setOperationPhase(mountCtx, "Mount")
+	if pending := tracker.Pending(); len(pending) != 1 || pending[0].Kind != "Unmount" {
+		t.Fatalf("expected only the unmount to be pending, got %v", pending)
+	}
+	unmountDone()
+	if pending := tracker.Pending(); len(pending) != 0 {
+		t.Fatalf("expected no pending operations, got %v", pending)
+	}
+}
+
+func TestUnfinishedOperations(t *testing.T) {
+	stateDir := filepath.Join(t.TempDir(), "state")
+
+	// Nothing recorded is not an error
+	ops, err := LoadUnfinishedOperations(stateDir)
+	if err != nil || ops != nil {
+		t.Fatalf("expected no operations, got %v, %v", ops, err)
+	}
+
+	saved := []Operation{
+		{Kind: "Mount", Volume: "vol-1", Phase: "WaitAttachment", StartedAt: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{Kind: "Unmount", Volume: "vol-2", StartedAt: time.Date(2024, 5, 1, 10, 0, 1, 0, time.UTC)},
+	}
+	if err := SaveUnfinishedOperations(stateDir, saved); err != nil {
+		t.Fatal(err)
+	}
+	ops, err = LoadUnfinishedOperations(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ops, saved) {
+		t.Fatalf("expected %v, got %v", saved, ops)
+	}
+
+	// They are only reported once
+	if ops, err := LoadUnfinishedOperations(stateDir); err != nil || ops != nil {
+		t.Fatalf("expected the operations to be forgotten once loaded, got %v, %v", ops, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(stateDir, unfinishedOperationsFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUnfinishedOperations(stateDir); err == nil || !strings.Contains(err.Error(), "failed to parse") {
+		t.Fatalf("expected a parse error, got %v", err)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	// Unix socket paths are limited to around a hundred bytes, shorter than some temporary directories
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "plugin.sock")
+
+	running, err := ListenSocket(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := running.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// A socket that answers belongs to a running plugin
+	if _, err := ListenSocket(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected the socket to be in use, got %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the socket in use to be kept: %v", err)
+	}
+
+	// One left behind by a plugin that is gone is replaced
+	running.(*net.UnixListener).SetUnlinkOnClose(false)
+	running.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the stale socket to be left behind: %v", err)
+	}
+	listener, err := ListenSocket(path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	listener.Close()
+
+	// So is a plain file
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err = ListenSocket(path)
+	if err != nil {
+		t.Fatalf("expected the stale file to be replaced, got %v", err)
+	}
+	listener.Close()
+}
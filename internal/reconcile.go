@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ReconcileOperation brings the volume of op, an operation cut short by the previous shutdown, back to a state the
+// next request can start from.
+//
+// Docker took an interrupted Mount as failed, so a volume attached to instanceID without being mounted on its
+// mountpoint is half attached: its device is unmounted from wherever else it is mounted and the volume is detached.
+// A volume that made it to its mountpoint is left as it is, another container may be using it. An interrupted
+// Unmount is finished. Create and Remove leave nothing behind to clean up.
+func ReconcileOperation(ctx context.Context, cfg *Config, client EC2API, host Host, names *DeviceNames, instanceID string, op Operation) (err error) {
+	ctx = WithVolume(ctx, op.Volume)
+	ctx, span := startSpan(ctx, "ReconcileOperation", attribute.String("volume.id", op.Volume), attribute.String("operation", op.Kind))
+	defer func() { endSpan(span, err) }()
+
+	switch op.Kind {
+	case "Mount":
+		return reconcileMount(ctx, cfg, client, host, names, instanceID, op.Volume)
+	case "Unmount":
+		slog.InfoContext(ctx, "Finishing an interrupted unmount")
+		return Unmount(ctx, cfg, host, op.Volume)
+	default:
+		slog.InfoContext(ctx, "Nothing to reconcile after the interrupted operation", "operation", op.Kind)
+		return nil
+	}
+}
+
+func reconcileMount(ctx context.Context, cfg *Config, client EC2API, host Host, names *DeviceNames, instanceID, volumeID string) error {
+	volume, err := DescribeVolume(ctx, client, volumeID)
+	if err != nil {
+		return fmt.Errorf("failed to describe volume: %w", err)
+	}
+	attachment := findAttachment(volume, instanceID)
+	if attachment == nil || attachment.State == types.VolumeAttachmentStateDetaching {
+		slog.InfoContext(ctx, "Volume is not attached to this instance, nothing to reconcile")
+		return nil
+	}
+
+	device, _, err := scanDeviceByVolumeID(host, volumeID, aws.ToString(attachment.Device))
+	if err != nil {
+		return fmt.Errorf("error finding device: %w", err)
+	}
+	if device != "" {
+		mountpoint, err := host.Mountpoint(ctx, device)
+		if err != nil {
+			return fmt.Errorf("error getting mountpoint: %w", err)
+		}
+		switch mountpoint {
+		case cfg.MountPath(volumeID):
+			slog.InfoContext(ctx, "Volume is mounted, leaving it as it is", "device", device)
+			return nil
+		case "":
+		default:
+			slog.InfoContext(ctx, "Unmounting the device of a half attached volume", "device", device, "mountpoint", mountpoint)
+			if err := host.Unmount(ctx, mountpoint); err != nil && !errors.Is(err, ErrNotMounted) {
+				return fmt.Errorf("error unmounting device: %w", err)
+			}
+		}
+	}
+
+	// An attachment is only detached once it is attached
+	if attachment.State != types.VolumeAttachmentStateAttached {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeouts.Attach))
+		_, err := WaitAttachment(waitCtx, cfg, client, volumeID, instanceID)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("half attached volume did not finish attaching: %w", err)
+		}
+	}
+
+	slog.WarnContext(ctx, "Detaching a half attached volume", "state", attachment.State)
+	if _, err := DetachVolumeAndWait(ctx, cfg, client, names, volumeID, instanceID); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+func TestReconcileOperation(t *testing.T) {
+	tests := []struct {
+		name string
+		kind string
+		// attachment is the state of the attachment to this instance, none when empty
+		attachment string
+		// device is set when the block device of the volume shows up on the host
+		device bool
+		// mountpoint is where the device is mounted, relative to the mount root
+		mountpoint   string
+		wantDetached bool
+		wantMounted  bool
+	}{
+		{name: "attached, no device", kind: "Mount", attachment: "attached", wantDetached: true},
+		{name: "attached, not mounted", kind: "Mount", attachment: "attached", device: true, wantDetached: true},
+		{name: "attaching", kind: "Mount", attachment: "attaching", wantDetached: true},
+		{name: "mounted elsewhere", kind: "Mount", attachment: "attached", device: true, mountpoint: "elsewhere", wantDetached: true},
+		{name: "mounted", kind: "Mount", attachment: "attached", device: true, mountpoint: "vol-1", wantMounted: true},
+		{name: "not attached", kind: "Mount"},
+		{name: "unmount", kind: "Unmount", attachment: "attached", device: true, mountpoint: "vol-1"},
+		{name: "remove", kind: "Remove", attachment: "attached", device: true, mountpoint: "vol-1", wantMounted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeaws.NewServer()
+			fake.AttachDelay = 20 * time.Millisecond
+			fake.DetachDelay = 20 * time.Millisecond
+			fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+			volume := fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ}
+			if tt.attachment != "" {
+				volume.Attachments = []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf", State: tt.attachment}}
+			}
+			fake.AddVolume(volume)
+			if tt.attachment == "attaching" {
+				// The fake leaves an attachment it did not start in its state, it is finished here instead
+				attached := volume
+				attached.Attachments = []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}
+				timer := time.AfterFunc(50*time.Millisecond, func() { fake.AddVolume(attached) })
+				t.Cleanup(func() { timer.Stop() })
+			}
+			client := newTestEC2(t, fake)
+			cfg := newTestVolumeConfig()
+			cfg.MountRoot = t.TempDir()
+
+			host := NewFakeHost()
+			if tt.device {
+				device := "nvme1n1"
+				host.AddDevice(FakeDevice{Name: device, Identity: NVMeIdentity{Model: ebsModel, Serial: ebsSerial("vol-1"), VendorDevice: "/dev/sdf"}, Filesystem: "xfs"})
+				if tt.mountpoint != "" {
+					target := cfg.MountPath(tt.mountpoint)
+					if err := os.MkdirAll(target, 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := host.Mount(context.Background(), device, target, "xfs"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			op := Operation{Kind: tt.kind, Volume: "vol-1", StartedAt: time.Now()}
+			if err := ReconcileOperation(context.Background(), cfg, client, host, NewDeviceNames(nil), testInstance, op); err != nil {
+				t.Fatal(err)
+			}
+
+			volume, _ = fake.Volume("vol-1")
+			if detached := len(volume.Attachments) == 0 && tt.attachment != ""; detached != tt.wantDetached {
+				t.Fatalf("expected detached to be %v, got %+v", tt.wantDetached, volume)
+			}
+			mounts := host.Mounts()
+			if _, mounted := mounts[cfg.MountPath("vol-1")]; mounted != tt.wantMounted {
+				t.Fatalf("expected mounted to be %v, got %v", tt.wantMounted, mounts)
+			}
+			if _, ok := mounts[cfg.MountPath("elsewhere")]; ok {
+				t.Fatalf("expected the device to be unmounted from elsewhere, got %v", mounts)
+			}
+		})
+	}
+}
+
+func TestVolumeNames(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MountRoot = t.TempDir()
+	cfg.StateDir = cfg.MountPath(".state")
+	for _, dir := range []string{"vol-1", "vol-2", ".state"} {
+		if err := os.MkdirAll(cfg.MountPath(dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(cfg.MountPath("file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := VolumeNames(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"vol-1", "vol-2"}) {
+		t.Fatalf("expected only the volume directories, got %v", names)
+	}
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const tracerName = "github.com/polarity-dev/polarity-ecs-ebs-plugin"
+
+// InitTracing installs the global tracer provider and returns a function that flushes and stops it.
+//
+// With the "otlp" exporter, the endpoint, headers and TLS settings are read from the standard
+// OTEL_EXPORTER_OTLP_* variables. With the "file" exporter, spans are appended as JSON to cfg.Trace.File, which is
+// rotated like the log file.
+func InitTracing(ctx context.Context, cfg *Config, serviceVersion string) (func(context.Context) error, error) {
+	exporterName := cfg.Trace.Exporter
+	if exporterName == "" {
+		exporterName = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			exporterName = "otlp"
+		}
+	}
+
+	var exporter sdktrace.SpanExporter
+	var tracesFile io.Closer
+	switch exporterName {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		otlpExporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		exporter = otlpExporter
+	case "file":
+		f := &lumberjack.Logger{
+			Filename:   cfg.Trace.File,
+			MaxSize:    cfg.Log.FileMaxSizeMB,
+			MaxAge:     cfg.Log.FileMaxAgeDays,
+			MaxBackups: cfg.Log.FileMaxBackups,
+		}
+		fileExporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to create file trace exporter: %w", err)
+		}
+		exporter = fileExporter
+		tracesFile = f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporterName)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "polarity-ecs-ebs-plugin"),
+		attribute.String("service.version", serviceVersion),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if tracesFile != nil {
+			tracesFile.Close()
+		}
+		return err
+	}, nil
+}
+
+// InstrumentAWSConfig adds the tracing and logging middlewares to cfg so that every SDK call gets its own span and
+// log record.
+func InstrumentAWSConfig(cfg *aws.Config) {
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+	logAWSCalls(cfg)
+}
+
+// TraceHandler starts a new trace for every request served by next. The span fails when the request does, that is
+// when the response has an error status or a non-empty Err, which is how the VolumeDriver protocol reports a failed
+// operation.
+func TraceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := startSpan(r.Context(), r.URL.Path, attribute.String("http.route", r.URL.Path))
+		defer span.End()
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		var response struct {
+			Err string
+		}
+		json.Unmarshal(recorder.body.Bytes(), &response)
+		switch {
+		case response.Err != "":
+			span.SetStatus(codes.Error, response.Err)
+		case recorder.status >= http.StatusBadRequest:
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// maxRecordedBody bounds how much of a response responseRecorder keeps, the Err of the protocol responses comes well
+// before that.
+const maxRecordedBody = 64 << 10
+
+// responseRecorder passes a response through while keeping its status and the start of its body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if room := maxRecordedBody - r.body.Len(); room > 0 {
+		r.body.Write(b[:min(len(b), room)])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// SetSpanVolume tags the span carried by ctx with the volume the request is about.
+func SetSpanVolume(ctx context.Context, volume string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("volume.name", volume))
+}
+
+// startSpan starts a child span of the one carried by ctx. The span name is also used as the phase of the log
+// records emitted with the returned context and of the operation being tracked, if any.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx = WithLogAttrs(ctx, slog.String("phase", name))
+	setOperationPhase(ctx, name)
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
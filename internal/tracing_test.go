@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceHandlerStatus(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		code    codes.Code
+		message string
+	}{
+		{name: "success", status: http.StatusOK, body: `{"Err":""}`, code: codes.Unset},
+		{name: "no body", status: http.StatusOK, body: ``, code: codes.Unset},
+		{name: "not JSON", status: http.StatusOK, body: `OK`, code: codes.Unset},
+		{name: "failed operation", status: http.StatusOK, body: `{"Err":"volume vol-1 is in use"}`, code: codes.Error, message: "volume vol-1 is in use"},
+		{name: "bad request", status: http.StatusBadRequest, body: `{"Err":"Invalid JSON: EOF"}`, code: codes.Error, message: "Invalid JSON: EOF"},
+		{name: "error status", status: http.StatusInternalServerError, body: ``, code: codes.Error, message: "Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := TraceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/VolumeDriver.Mount", strings.NewReader(`{}`)))
+
+			// The response goes through unchanged
+			if rec.Code != tt.status || rec.Body.String() != tt.body {
+				t.Fatalf("expected %d %q, got %d %q", tt.status, tt.body, rec.Code, rec.Body.String())
+			}
+			spans := recorder.Ended()
+			span := spans[len(spans)-1]
+			if span.Name() != "/VolumeDriver.Mount" {
+				t.Fatalf("expected the span of the request, got %s", span.Name())
+			}
+			if span.Status().Code != tt.code || span.Status().Description != tt.message {
+				t.Fatalf("expected status %v %q, got %v %q", tt.code, tt.message, span.Status().Code, span.Status().Description)
+			}
+		})
+	}
+}
+
+func TestTraceHandlerLargeResponse(t *testing.T) {
+	large := `{"Volumes":[` + strings.Repeat(`{"Name":"vol-1"},`, maxRecordedBody/16) + `{"Name":"vol-1"}],"Err":""}`
+	handler := TraceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, large)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/VolumeDriver.List", nil))
+	if rec.Body.String() != large {
+		t.Fatalf("expected the whole response to go through, got %d of %d bytes", rec.Body.Len(), len(large))
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// watchBlockDevices listens for the kernel uevents of the block subsystem and signals on the returned channel
+// whenever a block device is added or changed, until ctx is done. The plugin shares the host network namespace,
+// where the kernel broadcasts them.
+func watchBlockDevices(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open uevent socket: %w", err)
+	}
+	// Group 1 carries the events sent by the kernel, as opposed to the ones relayed by udev
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind uevent socket: %w", err)
+	}
+
+	// A non-blocking descriptor goes through the runtime poller, so closing the file unblocks Read
+	socket := os.NewFile(uintptr(fd), "uevent")
+	events := make(chan struct{}, 1)
+
+	go func() {
+		<-ctx.Done()
+		socket.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				return
+			}
+			if !isBlockDeviceEvent(buf[:n]) {
+				continue
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// isBlockDeviceEvent reports whether msg, a NUL separated "action@devpath" header followed by KEY=value pairs, adds
+// or changes a block device.
+func isBlockDeviceEvent(msg []byte) bool {
+	var block, relevant bool
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		switch string(field) {
+		case "SUBSYSTEM=block":
+			block = true
+		case "ACTION=add", "ACTION=change":
+			relevant = true
+		}
+	}
+	return block && relevant
+}
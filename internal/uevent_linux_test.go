@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsBlockDeviceEvent(t *testing.T) {
+	// uevent builds a message the way the kernel does: the header, then the KEY=value pairs, each NUL terminated
+	uevent := func(header string, fields ...string) []byte {
+		return []byte(strings.Join(append([]string{header}, fields...), "\x00") + "\x00")
+	}
+	tests := []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{
+			name: "disk added",
+			msg:  uevent("add@/devices/pci0000:00/0000:00:1f.0/nvme/nvme1/nvme1n1", "ACTION=add", "DEVPATH=/devices/pci0000:00/0000:00:1f.0/nvme/nvme1/nvme1n1", "SUBSYSTEM=block", "MAJOR=259", "MINOR=1", "DEVNAME=nvme1n1", "DEVTYPE=disk", "SEQNUM=4242"),
+			want: true,
+		},
+		{
+			name: "disk changed",
+			msg:  uevent("change@/devices/vbd-51792/block/xvdf", "ACTION=change", "DEVPATH=/devices/vbd-51792/block/xvdf", "SUBSYSTEM=block", "DEVNAME=xvdf", "DEVTYPE=disk"),
+			want: true,
+		},
+		{
+			name: "disk removed",
+			msg:  uevent("remove@/devices/pci0000:00/0000:00:1f.0/nvme/nvme1/nvme1n1", "ACTION=remove", "SUBSYSTEM=block", "DEVNAME=nvme1n1"),
+		},
+		{
+			name: "nvme controller added",
+			msg:  uevent("add@/devices/pci0000:00/0000:00:1f.0/nvme/nvme1", "ACTION=add", "SUBSYSTEM=nvme", "DEVNAME=nvme1"),
+		},
+		{
+			name: "driver bound",
+			msg:  uevent("bind@/devices/pci0000:00/0000:00:1f.0", "ACTION=bind", "SUBSYSTEM=pci", "DRIVER=nvme"),
+		},
+		{
+			name: "block only in the header",
+			msg:  uevent("add@/devices/virtual/block/loop0", "ACTION=add", "SUBSYSTEM=bdi"),
+		},
+		{
+			name: "values are matched whole",
+			msg:  uevent("add@/devices/virtual/block/loop0", "ACTION=added", "SUBSYSTEM=blocks"),
+		},
+		{
+			name: "fields in any order, without the trailing NUL",
+			msg:  []byte("add@/devices/virtual/block/loop0\x00SUBSYSTEM=block\x00DEVNAME=loop0\x00ACTION=add"),
+			want: true,
+		},
+		{name: "empty", msg: nil},
+		{name: "truncated", msg: []byte("add@/devices/virtual/block/loop0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBlockDeviceEvent(tt.msg); got != tt.want {
+				t.Fatalf("expected %v for %q, got %v", tt.want, tt.msg, got)
+			}
+		})
+	}
+}
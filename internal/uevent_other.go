@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+// watchBlockDevices is only available on Linux, elsewhere the device wait falls back to scanning.
+func watchBlockDevices(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("block device events are only available on Linux")
+}
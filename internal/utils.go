@@ -2,76 +2,106 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var deviceOptions = []string{
-	"/dev/sdb", "/dev/sdc", "/dev/sdd", "/dev/sde", "/dev/sdf",
-	"/dev/sdg", "/dev/sdh", "/dev/sdi", "/dev/sdj",
-}
-
-// findAvailableDevice finds the first available device name to attach a volume.
-func findAvailableDevice(ctx context.Context, client *ec2.Client, instanceID string) (string, error) {
+// instanceDeviceMappings returns the block device mappings of instanceID, device name to volume ID.
+func instanceDeviceMappings(ctx context.Context, client EC2API, instanceID string) (_ map[string]string, err error) {
+	ctx, span := startSpan(ctx, "instanceDeviceMappings", attribute.String("instance.id", instanceID))
+	defer func() { endSpan(span, err) }()
 
 	commandEc2 := &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
 	}
 	responseEc2, err := client.DescribeInstances(ctx, commandEc2)
 	if err != nil {
-		return "", fmt.Errorf("failed to describe instances: %w", err)
+		return nil, fmt.Errorf("failed to describe instances: %w", err)
 	}
 
 	if len(responseEc2.Reservations) == 0 || len(responseEc2.Reservations[0].Instances) == 0 {
-		return "", fmt.Errorf("instance not found with ID: %s", instanceID)
+		return nil, fmt.Errorf("instance not found with ID: %s", instanceID)
 	}
 
 	instance := responseEc2.Reservations[0].Instances[0]
-	usedDevices := make(map[string]bool)
+	mapped := make(map[string]string)
 	for _, mapping := range instance.BlockDeviceMappings {
-		usedDevices[aws.ToString(mapping.DeviceName)] = true
-	}
-
-	for _, device := range deviceOptions {
-		if !usedDevices[device] {
-			return device, nil
+		var volumeID string
+		if mapping.Ebs != nil {
+			volumeID = aws.ToString(mapping.Ebs.VolumeId)
 		}
+		mapped[aws.ToString(mapping.DeviceName)] = volumeID
 	}
-
-	return "", fmt.Errorf("no available device name found")
+	return mapped, nil
 }
 
-// attachVolume attaches a volume to the EC2 instance.
-func AttachVolume(ctx context.Context, client *ec2.Client, volumeID string, instanceID string) (*ec2.AttachVolumeOutput, error) {
-	device, err := findAvailableDevice(ctx, client, instanceID)
+// AttachVolume attaches volumeID to instanceID with a device name reserved in names. A name EC2 reports as already
+// in use, because of an attach it had not listed yet, is skipped in favour of the next one.
+func AttachVolume(ctx context.Context, client EC2API, names *DeviceNames, volumeID string, instanceID string) (_ *ec2.AttachVolumeOutput, err error) {
+	ctx, span := startSpan(ctx, "AttachVolume", attribute.String("volume.id", volumeID), attribute.String("instance.id", instanceID))
+	defer func() { endSpan(span, err) }()
+
+	mapped, err := instanceDeviceMappings(ctx, client, instanceID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find available device: %w", err)
 	}
 
-	commandAttach := &ec2.AttachVolumeInput{
-		Device:     aws.String(device),
-		InstanceId: aws.String(instanceID),
-		VolumeId:   aws.String(volumeID),
-	}
-	ebs, err := client.AttachVolume(ctx, commandAttach)
-	if err != nil {
-		return nil, fmt.Errorf("failed to attach volume: %w", err)
+	skip := make(map[string]bool)
+	for {
+		device, err := names.Reserve(volumeID, mapped, skip)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find available device: %w", err)
+		}
+
+		commandAttach := &ec2.AttachVolumeInput{
+			Device:     aws.String(device),
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+		}
+		ebs, err := client.AttachVolume(ctx, commandAttach)
+		if err == nil {
+			return ebs, nil
+		}
+
+		names.Release(volumeID)
+		if !isDeviceInUse(err) {
+			return nil, fmt.Errorf("failed to attach volume: %w", err)
+		}
+		slog.WarnContext(ctx, "Device name is already in use, trying the next one", "device", device)
+		skip[device] = true
 	}
+}
 
-	return ebs, nil
+// isDeviceInUse reports whether err is EC2 refusing a device name that is taken on the instance.
+func isDeviceInUse(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidParameterValue" && strings.Contains(apiErr.ErrorMessage(), "already in use")
 }
 
-// detachVolume detaches a volume from the EC2 instance.
-func DetachVolume(ctx context.Context, client *ec2.Client, volumeID, instanceID string) (*ec2.DetachVolumeOutput, error) {
+// DetachVolume detaches a volume from the EC2 instance. A forced detach skips the clean unmount on the instance.
+func DetachVolume(ctx context.Context, client EC2API, volumeID, instanceID string, force bool) (_ *ec2.DetachVolumeOutput, err error) {
+	ctx, span := startSpan(ctx, "DetachVolume", attribute.String("volume.id", volumeID), attribute.String("instance.id", instanceID), attribute.Bool("force", force))
+	defer func() { endSpan(span, err) }()
+
 	commandDetach := &ec2.DetachVolumeInput{
 		InstanceId: aws.String(instanceID),
 		VolumeId:   aws.String(volumeID),
+		Force:      aws.Bool(force),
 	}
 	ebs, err := client.DetachVolume(ctx, commandDetach)
 	if err != nil {
@@ -82,29 +112,207 @@ func DetachVolume(ctx context.Context, client *ec2.Client, volumeID, instanceID
 }
 
 // waitVolume waits for a volume to reach a specific state.
-func WaitVolume(ctx context.Context, client *ec2.Client, volumeID string, state types.VolumeState) (*types.Volume, error) {
-	ticker := time.NewTicker(1 * time.Second)
+func WaitVolume(ctx context.Context, cfg *Config, client EC2API, volumeID string, state types.VolumeState) (_ *types.Volume, err error) {
+	ctx, span := startSpan(ctx, "WaitVolume", attribute.String("volume.id", volumeID), attribute.String("volume.target_state", string(state)))
+	defer func() { endSpan(span, err) }()
+
+	ticker := time.NewTicker(time.Duration(cfg.VolumePollInterval))
 	defer ticker.Stop()
 
+	var lastState types.VolumeState
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			return nil, fmt.Errorf("volume %s is still %s instead of %s: %w", volumeID, lastState, state, ctx.Err())
 		case <-ticker.C:
 			volume, err := DescribeVolume(ctx, client, volumeID)
 			if err != nil {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("volume %s is still %s instead of %s: %w", volumeID, lastState, state, ctx.Err())
+				}
 				return nil, fmt.Errorf("failed to describe volume while waiting: %w", err)
 			}
 			if volume.State == state {
 				return volume, nil
 			}
-			log.Printf("Volume %s is in state %s, waiting for %s...", volumeID, volume.State, state)
+			lastState = volume.State
+			slog.DebugContext(ctx, "Waiting for volume state", "state", volume.State, "target_state", state)
 		}
 	}
 }
 
+// WaitVolumeFor is WaitVolume bounded by timeout.
+func WaitVolumeFor(ctx context.Context, cfg *Config, client EC2API, volumeID string, state types.VolumeState, timeout Duration) (*types.Volume, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout))
+	defer cancel()
+
+	volume, err := WaitVolume(ctx, cfg, client, volumeID, state)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s: %w", time.Duration(timeout), err)
+	}
+	return volume, err
+}
+
+// DetachVolumeAndWait detaches volumeID from instanceID and waits until it is available. A detach that is still
+// pending after cfg.Timeouts.ForceDetachAfter is escalated to a forced one, and the whole wait is bounded by
+// cfg.Timeouts.Detach.
+//
+// names holds the device names of this instance: when instanceID is this instance, the name of the volume is given
+// back once it is detached. It is nil when the volume is taken from another instance, whose names are not ours.
+func DetachVolumeAndWait(ctx context.Context, cfg *Config, client EC2API, names *DeviceNames, volumeID, instanceID string) (_ *types.Volume, err error) {
+	ctx, span := startSpan(ctx, "DetachVolumeAndWait", attribute.String("volume.id", volumeID), attribute.String("instance.id", instanceID))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		if err == nil && names != nil {
+			names.Release(volumeID)
+		}
+	}()
+
+	if _, err := DetachVolume(ctx, client, volumeID, instanceID, false); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeouts.Detach))
+	defer cancel()
+
+	forceAfter := cfg.Timeouts.ForceDetachAfter
+	if forceAfter > 0 && forceAfter < cfg.Timeouts.Detach {
+		volume, err := WaitVolumeFor(ctx, cfg, client, volumeID, types.VolumeStateAvailable, forceAfter)
+		if err == nil {
+			return volume, nil
+		}
+		// Only the grace period running out escalates, a cancelled request or an API error does not
+		if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return nil, err
+		}
+
+		slog.WarnContext(ctx, "Volume is still detaching after the grace period, forcing the detach", "instance_id", instanceID, "grace_period", time.Duration(forceAfter).String())
+		if _, err := DetachVolume(ctx, client, volumeID, instanceID, true); err != nil {
+			return nil, fmt.Errorf("failed to force the detach: %w", err)
+		}
+	}
+
+	volume, err := WaitVolume(ctx, cfg, client, volumeID, types.VolumeStateAvailable)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s was not detached from %s within %s: %w", volumeID, instanceID, time.Duration(cfg.Timeouts.Detach), err)
+	}
+	return volume, nil
+}
+
+// WaitAttachment waits until the attachment of volumeID to instanceID is attached. Unlike the volume state, which
+// turns in-use as soon as the attachment starts, this is when the instance can see the device.
+func WaitAttachment(ctx context.Context, cfg *Config, client EC2API, volumeID, instanceID string) (_ *types.Volume, err error) {
+	ctx, span := startSpan(ctx, "WaitAttachment", attribute.String("volume.id", volumeID), attribute.String("instance.id", instanceID))
+	defer func() { endSpan(span, err) }()
+
+	ticker := time.NewTicker(time.Duration(cfg.VolumePollInterval))
+	defer ticker.Stop()
+
+	var lastState types.VolumeAttachmentState = "missing"
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("attachment of volume %s to %s is still %s: %w", volumeID, instanceID, lastState, ctx.Err())
+		case <-ticker.C:
+			volume, err := DescribeVolume(ctx, client, volumeID)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("attachment of volume %s to %s is still %s: %w", volumeID, instanceID, lastState, ctx.Err())
+				}
+				return nil, fmt.Errorf("failed to describe volume while waiting: %w", err)
+			}
+
+			attachment := findAttachment(volume, instanceID)
+			if attachment == nil {
+				// Right after AttachVolume it may not be listed yet, once listed it only goes away when EC2 gives up on it
+				if lastState != "missing" {
+					return nil, fmt.Errorf("attachment of volume %s to %s went away while %s", volumeID, instanceID, lastState)
+				}
+				continue
+			}
+			if attachment.State == types.VolumeAttachmentStateAttached {
+				return volume, nil
+			}
+			lastState = attachment.State
+			slog.DebugContext(ctx, "Waiting for attachment state", "state", attachment.State)
+		}
+	}
+}
+
+// AttachmentDevice returns the device name volume is attached with to instanceID, or "" when it is not attached there.
+func AttachmentDevice(volume *types.Volume, instanceID string) string {
+	if attachment := findAttachment(volume, instanceID); attachment != nil {
+		return aws.ToString(attachment.Device)
+	}
+	return ""
+}
+
+func findAttachment(volume *types.Volume, instanceID string) *types.VolumeAttachment {
+	for i, attachment := range volume.Attachments {
+		if aws.ToString(attachment.InstanceId) == instanceID {
+			return &volume.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// AttachVolumeAndWait attaches volumeID to instanceID and waits until the attachment is attached and its block
+// device has shown up on host, all within cfg.Timeouts.Attach. When that does not happen in time the attachment is
+// rolled back, so that the volume is not left half attached. Both fit in the deadline of ctx: the wait is cut short
+// to leave the rollback cfg.Timeouts.Detach, and no attach is started without that much time left.
+func AttachVolumeAndWait(ctx context.Context, cfg *Config, client EC2API, host Host, names *DeviceNames, volumeID, instanceID string) (_ *types.Volume, err error) {
+	ctx, span := startSpan(ctx, "AttachVolumeAndWait", attribute.String("volume.id", volumeID), attribute.String("instance.id", instanceID))
+	defer func() { endSpan(span, err) }()
+
+	// The wait for the attachment leaves the rollback its timeouts.detach before the deadline of ctx
+	attachTimeout := time.Duration(cfg.Timeouts.Attach)
+	rollbackDeadline := time.Now().Add(time.Duration(cfg.Timeouts.Detach))
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline) - time.Duration(cfg.Timeouts.Detach)
+		if left <= 0 {
+			return nil, fmt.Errorf("not enough time left to attach the volume and roll the attach back, %s until the deadline", time.Until(deadline).Round(time.Millisecond))
+		}
+		attachTimeout = min(attachTimeout, left)
+		rollbackDeadline = deadline
+	}
+
+	attachRes, err := AttachVolume(ctx, client, names, volumeID, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Successfully attached volume, waiting for the attachment to complete", "device", aws.ToString(attachRes.Device))
+
+	volume, err := waitAttachmentAndDevice(ctx, cfg, client, host, volumeID, instanceID, aws.ToString(attachRes.Device), attachTimeout)
+	if err == nil {
+		return volume, nil
+	}
+
+	// The request context may be the one that was cancelled, the rollback only stops at the deadline
+	rollbackCtx, cancel := context.WithDeadline(context.WithoutCancel(ctx), rollbackDeadline)
+	defer cancel()
+	slog.WarnContext(ctx, "Attachment did not complete, rolling it back", "error", err)
+	if _, rollbackErr := DetachVolumeAndWait(rollbackCtx, cfg, client, names, volumeID, instanceID); rollbackErr != nil {
+		return nil, fmt.Errorf("failed to attach volume: %w (rollback failed too: %v)", err, rollbackErr)
+	}
+	return nil, fmt.Errorf("failed to attach volume, the attachment was rolled back: %w", err)
+}
+
+func waitAttachmentAndDevice(ctx context.Context, cfg *Config, client EC2API, host Host, volumeID, instanceID, attachDevice string, timeout time.Duration) (*types.Volume, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	volume, err := WaitAttachment(ctx, cfg, client, volumeID, instanceID)
+	if err == nil {
+		_, err = FindDeviceByVolumeID(ctx, cfg, host, volumeID, attachDevice)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s: %w", timeout.Round(time.Millisecond), err)
+	}
+	return volume, err
+}
+
 // describeVolume describes a single volume.
-func DescribeVolume(ctx context.Context, client *ec2.Client, volumeID string) (*types.Volume, error) {
+func DescribeVolume(ctx context.Context, client EC2API, volumeID string) (*types.Volume, error) {
 	command := &ec2.DescribeVolumesInput{
 		VolumeIds: []string{volumeID},
 	}
@@ -120,11 +328,43 @@ func DescribeVolume(ctx context.Context, client *ec2.Client, volumeID string) (*
 	return &response.Volumes[0], nil
 }
 
-// initClient loads AWS configuration and creates a new EC2 client.
-func InitClient(ctx context.Context, region string) (*ec2.Client, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+// LoadAWSConfig loads the AWS configuration shared by every client of the plugin, with the retries and HTTP timeouts
+// of awsCfg, its endpoint override and a user agent that carries commitHash.
+func LoadAWSConfig(ctx context.Context, awsCfg AWSConfig, region, commitHash string) (aws.Config, error) {
+	httpClient := awshttp.NewBuildableClient().
+		WithTimeout(time.Duration(awsCfg.RequestTimeout)).
+		WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = time.Duration(awsCfg.ConnectTimeout)
+		}).
+		WithTransportOptions(func(t *http.Transport) {
+			t.TLSHandshakeTimeout = time.Duration(awsCfg.ConnectTimeout)
+		})
+
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithHTTPClient(httpClient),
+		config.WithRetryer(func() aws.Retryer { return newRetryer(awsCfg) }),
+	)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load SDK config: %w", err)
+		return aws.Config{}, fmt.Errorf("unable to load SDK config: %w", err)
+	}
+	if awsCfg.Endpoint != "" {
+		cfg.BaseEndpoint = aws.String(awsCfg.Endpoint)
+	}
+	cfg.APIOptions = append(cfg.APIOptions, awsmiddleware.AddUserAgentKeyValue("polarity-ecs-ebs-plugin", commitHash))
+	InstrumentAWSConfig(&cfg)
+	return cfg, nil
+}
+
+func newRetryer(awsCfg AWSConfig) aws.Retryer {
+	standard := func(o *retry.StandardOptions) {
+		o.MaxAttempts = awsCfg.MaxAttempts
+		o.MaxBackoff = time.Duration(awsCfg.MaxBackoff)
+	}
+	if awsCfg.RetryMode == string(aws.RetryModeAdaptive) {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, standard)
+		})
 	}
-	return ec2.NewFromConfig(cfg), nil
+	return retry.NewStandard(standard)
 }
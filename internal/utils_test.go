@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/polarity-dev/polarity-ecs-ebs-plugin/internal/fakeaws"
+)
+
+const testInstance = "i-0123456789abcdef0"
+
+func newTestEC2(t *testing.T, fake *fakeaws.Server) EC2API {
+	t.Helper()
+	server := fake.Start()
+	t.Cleanup(server.Close)
+	return ec2.NewFromConfig(fakeaws.Config(server.URL))
+}
+
+// newTestVolumeConfig polls and times out fast enough for the delays of the fake.
+func newTestVolumeConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.VolumePollInterval = Duration(10 * time.Millisecond)
+	cfg.Timeouts.Available = Duration(2 * time.Second)
+	cfg.Timeouts.Detach = Duration(2 * time.Second)
+	cfg.Timeouts.ForceDetachAfter = 0
+	cfg.Timeouts.Attach = Duration(300 * time.Millisecond)
+	return cfg
+}
+
+func TestWaitVolumeForCreatingVolume(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.CreateDelay = 50 * time.Millisecond
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, State: "creating"})
+	client := newTestEC2(t, fake)
+	cfg := newTestVolumeConfig()
+
+	volume, err := WaitVolumeFor(context.Background(), cfg, client, "vol-1", types.VolumeStateAvailable, cfg.Timeouts.Available)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.State != types.VolumeStateAvailable {
+		t.Fatalf("expected the volume to be available, got %s", volume.State)
+	}
+
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-2", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: "i-other", Device: "/dev/sdf"}}})
+	_, err = WaitVolumeFor(context.Background(), cfg, client, "vol-2", types.VolumeStateAvailable, Duration(50*time.Millisecond))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected waiting for an attached volume to time out, got %v", err)
+	}
+}
+
+func TestAttachVolumeSkipsMappedDevices(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-root", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	client := newTestEC2(t, fake)
+	names := NewDeviceNames(DefaultConfig().Device.Pool)
+
+	attached, err := AttachVolume(context.Background(), client, names, "vol-1", testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := *attached.Device; device != "/dev/sdg" {
+		t.Fatalf("expected the first free device /dev/sdg, got %s", device)
+	}
+
+	volume, _ := fake.Volume("vol-1")
+	if volume.State != "in-use" || len(volume.Attachments) != 1 || volume.Attachments[0].Device != "/dev/sdg" {
+		t.Fatalf("unexpected volume after the attach: %+v", volume)
+	}
+}
+
+func TestDetachVolumeAndWait(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.DetachDelay = 50 * time.Millisecond
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}})
+	client := newTestEC2(t, fake)
+
+	volume, err := DetachVolumeAndWait(context.Background(), newTestVolumeConfig(), client, NewDeviceNames(nil), "vol-1", testInstance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.State != types.VolumeStateAvailable || len(volume.Attachments) != 0 {
+		t.Fatalf("expected the volume to be available and unattached, got %s with %d attachments", volume.State, len(volume.Attachments))
+	}
+	if calls := fake.Calls("DetachVolume"); calls != 1 {
+		t.Fatalf("expected a single detach, got %d", calls)
+	}
+}
+
+func TestDetachVolumeAndWaitForcesStuckDetach(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, StuckDetaching: true, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}})
+	client := newTestEC2(t, fake)
+	cfg := newTestVolumeConfig()
+
+	cfg.Timeouts.ForceDetachAfter = 0
+	cfg.Timeouts.Detach = Duration(200 * time.Millisecond)
+	if _, err := DetachVolumeAndWait(context.Background(), cfg, client, NewDeviceNames(nil), "vol-1", testInstance); err == nil {
+		t.Fatal("expected a stuck detach to time out without escalation")
+	}
+
+	cfg.Timeouts.ForceDetachAfter = Duration(100 * time.Millisecond)
+	cfg.Timeouts.Detach = Duration(2 * time.Second)
+	fake.ResetCalls()
+	if _, err := DetachVolumeAndWait(context.Background(), cfg, client, NewDeviceNames(nil), "vol-1", testInstance); err != nil {
+		t.Fatal(err)
+	}
+	if calls := fake.Calls("DetachVolume"); calls != 2 {
+		t.Fatalf("expected the detach to be retried once forced, got %d calls", calls)
+	}
+}
+
+func TestAttachVolumeAndWaitRollsBack(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AttachDelay = 20 * time.Millisecond
+	fake.DetachDelay = 20 * time.Millisecond
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	client := newTestEC2(t, fake)
+	names := NewDeviceNames(DefaultConfig().Device.Pool)
+
+	// The block device of the volume never shows up on the host
+	_, err := AttachVolumeAndWait(context.Background(), newTestVolumeConfig(), client, NewFakeHost(), names, "vol-1", testInstance)
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("expected the attachment to be rolled back, got %v", err)
+	}
+
+	volume, _ := fake.Volume("vol-1")
+	if volume.State != "available" || len(volume.Attachments) != 0 {
+		t.Fatalf("expected the volume to be left available, got %+v", volume)
+	}
+	if device, err := names.Reserve("vol-2", nil, nil); err != nil || device != DefaultConfig().Device.Pool[0] {
+		t.Fatalf("expected the device name to be released, got %q, %v", device, err)
+	}
+}
+
+func TestAttachVolumeAndWaitDeadline(t *testing.T) {
+	fake := fakeaws.NewServer()
+	fake.AttachDelay = 20 * time.Millisecond
+	fake.DetachDelay = 20 * time.Millisecond
+	fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+	fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ})
+	client := newTestEC2(t, fake)
+	cfg := newTestVolumeConfig()
+	cfg.Timeouts.Attach = Duration(time.Minute)
+	names := NewDeviceNames(DefaultConfig().Device.Pool)
+
+	// Less time left than the rollback may need: nothing is attached
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Detach)/2)
+	defer cancel()
+	if _, err := AttachVolumeAndWait(ctx, cfg, client, NewFakeHost(), names, "vol-1", testInstance); err == nil || !strings.Contains(err.Error(), "not enough time left") {
+		t.Fatalf("expected the attach to be refused, got %v", err)
+	}
+	if calls := fake.Calls("AttachVolume"); calls != 0 {
+		t.Fatalf("expected no attach, got %d calls", calls)
+	}
+
+	// The wait for the block device is cut short so that the rollback fits in the deadline too
+	start := time.Now()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.Timeouts.Detach)+300*time.Millisecond)
+	defer cancel()
+	_, err := AttachVolumeAndWait(ctx, cfg, client, NewFakeHost(), names, "vol-1", testInstance)
+	if err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("expected the attachment to be rolled back, got %v", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if time.Now().After(deadline) {
+		t.Fatalf("expected the attach and its rollback to fit in the deadline, took %s", time.Since(start))
+	}
+	if volume, _ := fake.Volume("vol-1"); volume.State != "available" {
+		t.Fatalf("expected the volume to be left available, got %+v", volume)
+	}
+}
+
+func TestDetachVolumeAndWaitEscalation(t *testing.T) {
+	tests := []struct {
+		name       string
+		stuck      bool
+		forceAfter time.Duration
+		detach     time.Duration
+		// cancelAfter cancels the request while it waits, when set
+		cancelAfter time.Duration
+		wantErr     bool
+		wantForced  int
+	}{
+		{name: "detaches within the grace period", forceAfter: 200 * time.Millisecond, detach: 2 * time.Second},
+		{name: "forced after the grace period", stuck: true, forceAfter: 100 * time.Millisecond, detach: 2 * time.Second, wantForced: 1},
+		{name: "never forced", stuck: true, forceAfter: 0, detach: 200 * time.Millisecond, wantErr: true},
+		{name: "grace period longer than the detach timeout", stuck: true, forceAfter: time.Second, detach: 200 * time.Millisecond, wantErr: true},
+		{name: "cancelled during the grace period", stuck: true, forceAfter: time.Second, detach: 2 * time.Second, cancelAfter: 100 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeaws.NewServer()
+			fake.DetachDelay = 20 * time.Millisecond
+			fake.AddInstance(fakeaws.Instance{ID: testInstance, AvailabilityZone: testAZ})
+			fake.AddVolume(fakeaws.EBSVolume{ID: "vol-1", AvailabilityZone: testAZ, StuckDetaching: tt.stuck, Attachments: []fakeaws.VolumeAttachment{{InstanceID: testInstance, Device: "/dev/sdf"}}})
+			client := newTestEC2(t, fake)
+			cfg := newTestVolumeConfig()
+			cfg.Timeouts.ForceDetachAfter = Duration(tt.forceAfter)
+			cfg.Timeouts.Detach = Duration(tt.detach)
+
+			ctx := context.Background()
+			if tt.cancelAfter > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.cancelAfter)
+				defer cancel()
+			}
+
+			start := time.Now()
+			_, err := DetachVolumeAndWait(ctx, cfg, client, NewDeviceNames(nil), "vol-1", testInstance)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error to be %v, got %v", tt.wantErr, err)
+			}
+			if forced := fake.Calls("DetachVolume.Force"); forced != tt.wantForced {
+				t.Fatalf("expected %d forced detaches, got %d", tt.wantForced, forced)
+			}
+			if tt.wantForced > 0 && time.Since(start) < tt.forceAfter {
+				t.Fatalf("expected the detach to be forced only after %s, it took %s", tt.forceAfter, time.Since(start))
+			}
+			volume, _ := fake.Volume("vol-1")
+			if attached := len(volume.Attachments) > 0; attached != tt.wantErr {
+				t.Fatalf("expected the volume to be attached only after a failure, got %+v", volume)
+			}
+		})
+	}
+}
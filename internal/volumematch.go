@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Volume match keys, see ECSConfig.VolumeMatchKeys.
+const (
+	matchKeyName          = "name"
+	matchKeyDriverOptsPre = "driverOpts."
+	matchKeyLabelsPre     = "labels."
+)
+
+// validateVolumeMatchKey reports a key of ECSConfig.VolumeMatchKeys that names nothing.
+func validateVolumeMatchKey(key string) error {
+	if key == matchKeyName {
+		return nil
+	}
+	for _, prefix := range []string{matchKeyDriverOptsPre, matchKeyLabelsPre} {
+		if rest, ok := strings.CutPrefix(key, prefix); ok && rest != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("ecs.volumeMatchKeys entry %q must be name, driverOpts.<option> or labels.<label>", key)
+}
+
+// volumeMatches tells whether vol, a volume of a task definition, is volumeToCheck: it has to be a Docker volume of
+// one of cfg.VolumeDrivers, and one of cfg.VolumeMatchKeys has to carry volumeToCheck. Host path volumes, or the
+// volumes of other drivers, never match even when they share the name.
+func volumeMatches(cfg *ECSConfig, vol ecstypes.Volume, volumeToCheck string) bool {
+	docker := vol.DockerVolumeConfiguration
+	if docker == nil {
+		return false
+	}
+	if len(cfg.VolumeDrivers) > 0 && !slices.ContainsFunc(cfg.VolumeDrivers, func(driver string) bool {
+		return sameDriver(driver, aws.ToString(docker.Driver))
+	}) {
+		return false
+	}
+
+	for _, key := range cfg.VolumeMatchKeys {
+		var value string
+		switch {
+		case key == matchKeyName:
+			value = aws.ToString(vol.Name)
+		case strings.HasPrefix(key, matchKeyDriverOptsPre):
+			value = docker.DriverOpts[strings.TrimPrefix(key, matchKeyDriverOptsPre)]
+		case strings.HasPrefix(key, matchKeyLabelsPre):
+			value = docker.Labels[strings.TrimPrefix(key, matchKeyLabelsPre)]
+		}
+		if value == volumeToCheck {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDriver compares Docker volume driver names, which may omit the :latest tag of the plugin.
+func sameDriver(a, b string) bool {
+	return strings.TrimSuffix(a, ":latest") == strings.TrimSuffix(b, ":latest")
+}
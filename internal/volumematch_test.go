@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestVolumeMatches(t *testing.T) {
+	dockerVolume := func(name, driver string, opts, labels map[string]string) ecstypes.Volume {
+		return ecstypes.Volume{
+			Name: aws.String(name),
+			DockerVolumeConfiguration: &ecstypes.DockerVolumeConfiguration{
+				Driver:     aws.String(driver),
+				DriverOpts: opts,
+				Labels:     labels,
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		vol    ecstypes.Volume
+		cfg    func(*ECSConfig)
+		expect bool
+	}{
+		{name: "named after the volume", vol: dockerVolume("vol-1", "polarity-ecs-ebs-plugin", nil, nil), expect: true},
+		{name: "driver with tag", vol: dockerVolume("vol-1", "polarity-ecs-ebs-plugin:latest", nil, nil), expect: true},
+		{name: "Name label", vol: dockerVolume("data", "polarity-ecs-ebs-plugin", nil, map[string]string{"Name": "vol-1"}), expect: true},
+		{name: "volumeId option", vol: dockerVolume("data", "polarity-ecs-ebs-plugin", map[string]string{"volumeId": "vol-1"}, nil), expect: true},
+		{name: "other volume", vol: dockerVolume("data", "polarity-ecs-ebs-plugin", nil, map[string]string{"Name": "vol-2"}), expect: false},
+		{name: "host path volume", vol: ecstypes.Volume{Name: aws.String("vol-1"), Host: &ecstypes.HostVolumeProperties{SourcePath: aws.String("/data")}}, expect: false},
+		{name: "other driver", vol: dockerVolume("vol-1", "local", nil, nil), expect: false},
+		{
+			name:   "any driver",
+			vol:    dockerVolume("vol-1", "local", nil, nil),
+			cfg:    func(cfg *ECSConfig) { cfg.VolumeDrivers = nil },
+			expect: true,
+		},
+		{
+			name:   "custom alias",
+			vol:    dockerVolume("vol-1", "ebs", nil, nil),
+			cfg:    func(cfg *ECSConfig) { cfg.VolumeDrivers = []string{"ebs"} },
+			expect: true,
+		},
+		{
+			name:   "name not a match key",
+			vol:    dockerVolume("vol-1", "polarity-ecs-ebs-plugin", nil, map[string]string{"ebs": "vol-2"}),
+			cfg:    func(cfg *ECSConfig) { cfg.VolumeMatchKeys = []string{"labels.ebs"} },
+			expect: false,
+		},
+		{
+			name:   "custom label",
+			vol:    dockerVolume("data", "polarity-ecs-ebs-plugin", nil, map[string]string{"ebs": "vol-1"}),
+			cfg:    func(cfg *ECSConfig) { cfg.VolumeMatchKeys = []string{"labels.ebs"} },
+			expect: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig().ECS
+			if tc.cfg != nil {
+				tc.cfg(&cfg)
+			}
+			if got := volumeMatches(&cfg, tc.vol, "vol-1"); got != tc.expect {
+				t.Fatalf("expected %v, got %v", tc.expect, got)
+			}
+		})
+	}
+}
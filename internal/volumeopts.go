@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// VolumeOptions are the options given to Create that the plugin acts on. Docker only passes them to Create, so
+// they are kept in the state directory for the operations that follow.
+type VolumeOptions struct {
+	ForceSteal bool `json:"forceSteal,omitempty"`
+}
+
+// ParseVolumeOptions reads the options the plugin knows about from the Create options. The others are left alone,
+// they may be there for whoever matches volumes to tasks.
+func ParseVolumeOptions(opts map[string]string) (VolumeOptions, error) {
+	var options VolumeOptions
+	if value, ok := opts[ForceStealTag]; ok {
+		forceSteal, err := strconv.ParseBool(value)
+		if err != nil {
+			return VolumeOptions{}, fmt.Errorf("invalid %s option %q: %v", ForceStealTag, value, err)
+		}
+		options.ForceSteal = forceSteal
+	}
+	return options, nil
+}
+
+func volumeOptionsPath(stateDir, volume string) string {
+	return filepath.Join(stateDir, "volumes", volume+".json")
+}
+
+// SaveVolumeOptions stores the options of volume in stateDir.
+func SaveVolumeOptions(stateDir, volume string, options VolumeOptions) error {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to encode volume options: %w", err)
+	}
+	path := volumeOptionsPath(stateDir, volume)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write volume options: %w", err)
+	}
+	return nil
+}
+
+// LoadVolumeOptions returns the options stored for volume, or the zero options when Create stored none.
+func LoadVolumeOptions(stateDir, volume string) (VolumeOptions, error) {
+	var options VolumeOptions
+	data, err := os.ReadFile(volumeOptionsPath(stateDir, volume))
+	if errors.Is(err, os.ErrNotExist) {
+		return options, nil
+	} else if err != nil {
+		return options, fmt.Errorf("failed to read volume options: %w", err)
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return options, fmt.Errorf("failed to parse volume options: %w", err)
+	}
+	return options, nil
+}
+
+// RemoveVolumeOptions forgets the options of volume.
+func RemoveVolumeOptions(stateDir, volume string) error {
+	if err := os.Remove(volumeOptionsPath(stateDir, volume)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove volume options: %w", err)
+	}
+	return nil
+}